@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"net/http"
+	"strings"
+)
+
+// AccountDetail is a card or merchant account with its volumes and a page of its own transactions, without the
+// merchant_fees transactions recording the fee schedules of a merchant
+type AccountDetail struct {
+	Address string `json:"address"`
+	// the metadata set when the account was created
+	Metadata map[string]interface{} `json:"metadata"`
+	Asset    string                 `json:"asset"`
+	// the balance in Asset
+	Balance int64 `json:"balance"`
+	// input, output and balance for each asset the account holds
+	Volumes      map[string]Volume `json:"volumes"`
+	Transactions interface{}       `json:"transactions"`
+	// Next is the cursor of the following page of transactions, omitted on the last page
+	Next string `json:"next,omitempty"`
+}
+
+type Volume struct {
+	Input   int64 `json:"input"`
+	Output  int64 `json:"output"`
+	Balance int64 `json:"balance"`
+}
+
+// accountDetail reads the account at address along with the page of its transactions selected by r. It fails
+// with account_not_found unless the address starts with prefix and the account was given metadata on creation.
+func (s *Server) accountDetail(ctx context.Context, r *http.Request, address string, prefix string) (*AccountDetail, error) {
+	page, err := readPage(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.authorizeAccount(ctx, r, address); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(address, prefix) {
+		return nil, errAccountNotFound(address)
+	}
+	account, err := s.ledger.GetAccount(ctx, address)
+	if err != nil {
+		return nil, errLedger(err, "error getting ledger account")
+	}
+	if account == nil || account.Metadata[balanceTypeKey] == nil {
+		return nil, errAccountNotFound(address)
+	}
+	transactions, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{Account: address}, page)
+	if err != nil {
+		return nil, errLedger(err, "error listing transactions of %s", address)
+	}
+
+	asset := accountAsset(account.Metadata)
+	detail := &AccountDetail{
+		Address:      address,
+		Metadata:     account.Metadata,
+		Asset:        asset,
+		Volumes:      accountVolumes(account),
+		Transactions: withoutFeeSchedules(transactions.Transactions),
+		Next:         transactions.Next,
+	}
+	detail.Balance = detail.Volumes[asset].Balance
+	return detail, nil
+}
+
+func accountVolumes(account *shared.AccountWithVolumesAndBalances) map[string]Volume {
+	volumes := make(map[string]Volume, len(account.Volumes))
+	for asset, v := range account.Volumes {
+		volume := Volume{}
+		if input, ok := v["input"]; ok && input != nil {
+			volume.Input = input.Int64()
+		}
+		if output, ok := v["output"]; ok && output != nil {
+			volume.Output = output.Int64()
+		}
+		volume.Balance = volume.Input - volume.Output
+		volumes[asset] = volume
+	}
+	return volumes
+}
+
+// metadataValue is the string held by key in metadata, empty if it is missing
+func metadataValue(metadata map[string]interface{}, key string) string {
+	v, ok := metadata[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// detailTxids returns the txids of the transactions of an account detail
+func detailTxids(detail map[string]interface{}) []int64 {
+	var txids []int64
+	for _, txn := range detail["transactions"].([]interface{}) {
+		txids = append(txids, int64(txn.(map[string]interface{})["txid"].(float64)))
+	}
+	return txids
+}
+
+func TestGetCard(t *testing.T) {
+	_, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "alice", "merchant_id": merchant, "amount": "1000"})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	card := transactionMetadata(t, res)[cardIdKey].(string)
+	purchase := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+	// another card, whose transactions are not the ones of card
+	other := purchaseTestCard(t, h, merchant, "500")
+	if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": other, "amount": "50"}); status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": card, "amount": "100"}); status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	spend := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+
+	status, res = do(t, h, http.MethodGet, "/cards/"+card, nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting card: got %d %v", status, res)
+	}
+	detail := res["card"].(map[string]interface{})
+	if detail["address"] != card || detail["asset"] != "USD/2" || detail["balance"] != float64(900) {
+		t.Errorf("card: got %v", detail)
+	}
+	metadata := detail["metadata"].(map[string]interface{})
+	for key, want := range map[string]interface{}{
+		nameKey:           "alice",
+		merchantIdKey:     merchant,
+		assetKey:          "USD/2",
+		balanceTypeKey:    string(balanceTypeCredit),
+		ledgerableTypeKey: string(ledgerableTypeExternal),
+	} {
+		if metadata[key] != want {
+			t.Errorf("metadata %s of the card: got %v, want %v", key, metadata[key], want)
+		}
+	}
+	volume := detail["volumes"].(map[string]interface{})["USD/2"].(map[string]interface{})
+	if volume["input"] != float64(1000) || volume["output"] != float64(100) || volume["balance"] != float64(900) {
+		t.Errorf("USD/2 volume of the card: got %v", volume)
+	}
+	if got := detailTxids(detail); len(got) != 2 || got[0] != spend || got[1] != purchase {
+		t.Errorf("transactions of the card: got %v, want [%d %d]", got, spend, purchase)
+	}
+
+	// the transactions are paged, most recent first
+	status, res = do(t, h, http.MethodGet, "/cards/"+card+"?page_size=1", nil)
+	detail, _ = res["card"].(map[string]interface{})
+	if status != http.StatusOK || len(detailTxids(detail)) != 1 || detailTxids(detail)[0] != spend || detail["next"] == nil {
+		t.Fatalf("first page of the card: got %d %v", status, res)
+	}
+	status, res = do(t, h, http.MethodGet, "/cards/"+card+"?cursor="+url.QueryEscape(detail["next"].(string)), nil)
+	detail, _ = res["card"].(map[string]interface{})
+	if status != http.StatusOK || len(detailTxids(detail)) != 1 || detailTxids(detail)[0] != purchase || detail["next"] != nil {
+		t.Errorf("second page of the card: got %d %v", status, res)
+	}
+
+	for _, address := range []string{"cards:missing", merchant} {
+		if status, res = do(t, h, http.MethodGet, "/cards/"+address, nil); status != http.StatusNotFound || errorCode(res) != string(errorCodeAccountNotFound) {
+			t.Errorf("getting card %s: got %d %v, want %d", address, status, res, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetMerchant(t *testing.T) {
+	_, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	spent := purchaseTestCard(t, h, merchant, "1000")
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{
+		"user_name":   "bob",
+		"merchant_id": merchant,
+		"amount":      "500",
+		"expires_at":  expiresAt,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	expiring := transactionMetadata(t, res)[cardIdKey].(string)
+	if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": spent, "amount": "300"}); status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	spend := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+	// the card of another merchant is not listed
+	purchaseTestCard(t, h, createTestMerchant(t, h), "200")
+
+	status, res = do(t, h, http.MethodGet, "/merchants/"+merchant, nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting merchant: got %d %v", status, res)
+	}
+	detail := res["merchant"].(map[string]interface{})
+	if detail["address"] != merchant || detail["balance"] != float64(300) {
+		t.Errorf("merchant: got %v", detail)
+	}
+	if metadata := detail["metadata"].(map[string]interface{}); metadata[nameKey] != "coffee shop" || metadata[assetKey] != "USD/2" {
+		t.Errorf("metadata of the merchant: got %v", metadata)
+	}
+	volume := detail["volumes"].(map[string]interface{})["USD/2"].(map[string]interface{})
+	if volume["input"] != float64(300) || volume["output"] != float64(0) {
+		t.Errorf("USD/2 volume of the merchant: got %v", volume)
+	}
+	// the purchases don't move money to the merchant, only its creation and the spend are its own
+	if got := detailTxids(detail); len(got) != 2 || got[0] != spend {
+		t.Errorf("transactions of the merchant: got %v, want the spend %d then the creation", got, spend)
+	}
+
+	cards := make(map[string]map[string]interface{})
+	for _, card := range res["cards"].([]interface{}) {
+		card := card.(map[string]interface{})
+		cards[card["address"].(string)] = card
+	}
+	want := map[string]map[string]interface{}{
+		spent:    {"address": spent, "name": "alice", "asset": "USD/2", "balance": float64(700)},
+		expiring: {"address": expiring, "name": "bob", "asset": "USD/2", "balance": float64(500), "expires_at": expiresAt},
+	}
+	if len(cards) != len(want) {
+		t.Fatalf("cards of the merchant: got %v, want %v", cards, want)
+	}
+	for address, wantCard := range want {
+		for key, value := range wantCard {
+			if cards[address][key] != value {
+				t.Errorf("%s of card %s: got %v, want %v", key, address, cards[address][key], value)
+			}
+		}
+	}
+
+	if status, res = do(t, h, http.MethodGet, "/merchants/"+spent, nil); status != http.StatusNotFound {
+		t.Errorf("getting a card as a merchant: got %d %v, want %d", status, res, http.StatusNotFound)
+	}
+}
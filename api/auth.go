@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Role string
+
+const (
+	// roleOperator may call every route and act on every account
+	roleOperator Role = "operator"
+	// roleMerchant may act on its own merchant account and the cards issued for it
+	roleMerchant Role = "merchant"
+	// roleCardholder may act on its own card
+	roleCardholder Role = "cardholder"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// Principal is who a request is authenticated as
+type Principal struct {
+	Subject string
+	Role    Role
+	// Account is the merchant address of a merchant, or the card address of a cardholder
+	Account string
+}
+
+// APIKey grants Principal to the requests sent with Key in the X-API-Key header
+type APIKey struct {
+	Key       string
+	Principal Principal
+}
+
+// Authenticator authenticates requests with an api key or an HS256 signed jwt bearer token
+type Authenticator struct {
+	jwtSecret []byte
+	// keyed by the sha256 of the api key, so keys are compared in constant time
+	apiKeys map[[sha256.Size]byte]Principal
+}
+
+// NewAuthenticator returns an Authenticator accepting apiKeys and tokens signed with jwtSecret. bearer
+// tokens are rejected when jwtSecret is empty.
+func NewAuthenticator(jwtSecret string, apiKeys []APIKey) *Authenticator {
+	a := &Authenticator{
+		jwtSecret: []byte(jwtSecret),
+		apiKeys:   make(map[[sha256.Size]byte]Principal, len(apiKeys)),
+	}
+	for _, k := range apiKeys {
+		a.apiKeys[sha256.Sum256([]byte(k.Key))] = k.Principal
+	}
+	return a
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		for k, p := range a.apiKeys {
+			if subtle.ConstantTimeCompare(k[:], sum[:]) == 1 {
+				principal := p
+				return &principal, nil
+			}
+		}
+		return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "invalid api key")
+	}
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || token == "" {
+		return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "missing %s header or bearer token", apiKeyHeader)
+	}
+	if len(a.jwtSecret) == 0 {
+		return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "bearer tokens are not accepted")
+	}
+	claims, err := parseJWT(token, a.jwtSecret, time.Now())
+	if err != nil {
+		return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "invalid bearer token: %s", err.Error())
+	}
+	switch claims.Role {
+	case roleOperator:
+	case roleMerchant, roleCardholder:
+		// without its account, the principal couldn't be restricted to it
+		if claims.Account == "" {
+			return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "invalid bearer token: the %s role requires an account claim", claims.Role)
+		}
+	default:
+		return nil, newError(http.StatusUnauthorized, errorCodeUnauthenticated, "invalid bearer token: unknown role %q", claims.Role)
+	}
+	return &Principal{
+		Subject: claims.Subject,
+		Role:    claims.Role,
+		Account: claims.Account,
+	}, nil
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal the request was authenticated as, nil when authentication is disabled
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authorize authenticates every request, then rejects the requests of principals without one of roles. it
+// lets every request through when auth is nil, or when roles is nil for the public routes such as the probes.
+func Authorize(inner http.Handler, auth *Authenticator, roles []Role) http.Handler {
+	if auth == nil || roles == nil {
+		return inner
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.authenticate(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		allowed := false
+		for _, role := range roles {
+			allowed = allowed || principal.Role == role
+		}
+		if !allowed {
+			writeError(w, newError(http.StatusForbidden, errorCodeForbidden, "the %s role can't call this route", principal.Role))
+			return
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// authorizeAccount fails with forbidden unless the principal of r may act on the account at address. an
+// account that does not exist is reported as forbidden too, so its existence isn't revealed.
+func (s *Server) authorizeAccount(ctx context.Context, r *http.Request, address string) error {
+	principal := principalFrom(r.Context())
+	if principal == nil || principal.Role == roleOperator || address == principal.Account {
+		return nil
+	}
+	if principal.Role == roleMerchant {
+		account, err := s.ledger.GetAccount(ctx, address)
+		if err != nil {
+			return errLedger(err, "error getting ledger account")
+		}
+		if account != nil && strings.HasPrefix(address, "cards:") && metadataValue(account.Metadata, merchantIdKey) == principal.Account {
+			return nil
+		}
+	}
+	e := newError(http.StatusForbidden, errorCodeForbidden, "%s %s can't act on account %s", principal.Role, principal.Account, address)
+	e.Details = map[string]interface{}{"address": address}
+	return e
+}
+
+// scopeTransactionFilter restricts the transactions a merchant or cardholder lists to the ones of its own
+// account. asking for the transactions of another merchant or card fails with forbidden.
+func scopeTransactionFilter(r *http.Request, metadata map[string]string) error {
+	principal := principalFrom(r.Context())
+	if principal == nil || principal.Role == roleOperator {
+		return nil
+	}
+	key := merchantIdKey
+	if principal.Role == roleCardholder {
+		key = cardIdKey
+	}
+	if value, ok := metadata[key]; ok && value != principal.Account {
+		return newError(http.StatusForbidden, errorCodeForbidden, "%s %s can't list the transactions of %s", principal.Role, principal.Account, value)
+	}
+	metadata[key] = principal.Account
+	return nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "secret"
+
+// signTestJWT returns an HS256 token carrying claims
+func signTestJWT(t *testing.T, claims jwtClaims) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("encoding claims: %v", err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := NewAuthenticator(testJWTSecret, []APIKey{
+		{Key: "operator-key", Principal: Principal{Subject: "ops", Role: roleOperator}},
+	})
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		wantRole Role
+	}{
+		{"api key", apiKeyHeader, "operator-key", roleOperator},
+		{"unknown api key", apiKeyHeader, "guessed-key", ""},
+		{"no credentials", "", "", ""},
+		{"operator token", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "ops", Role: roleOperator, ExpiresAt: exp}), roleOperator},
+		{"merchant token", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "m", Role: roleMerchant, Account: "merchant:1", ExpiresAt: exp}), roleMerchant},
+		{"merchant token without account", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "m", Role: roleMerchant, ExpiresAt: exp}), ""},
+		{"cardholder token without account", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "c", Role: roleCardholder, ExpiresAt: exp}), ""},
+		{"expired token", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "ops", Role: roleOperator, ExpiresAt: time.Now().Add(-time.Minute).Unix()}), ""},
+		{"unknown role", "Authorization", "Bearer " + signTestJWT(t, jwtClaims{Subject: "x", Role: "admin", ExpiresAt: exp}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			principal, err := auth.authenticate(req)
+			if tt.wantRole == "" {
+				apiErr, ok := err.(*Error)
+				if !ok || apiErr.Status != http.StatusUnauthorized || apiErr.Code != errorCodeUnauthenticated {
+					t.Fatalf("got %+v, %v, want a 401", principal, err)
+				}
+				return
+			}
+			if err != nil || principal.Role != tt.wantRole {
+				t.Fatalf("got %+v, %v, want the %s role", principal, err, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyScopedByPrincipal(t *testing.T) {
+	s, h := newTestServer(t)
+	merchants := []string{createTestMerchant(t, h), createTestMerchant(t, h)}
+	s.auth = NewAuthenticator(testJWTSecret, nil)
+	h = s.NewRouter()
+
+	// the merchants pick the same key, each gets a card of its own
+	exp := time.Now().Add(time.Hour).Unix()
+	txids := make([]interface{}, len(merchants))
+	for i, merchant := range merchants {
+		token := "Bearer " + signTestJWT(t, jwtClaims{Subject: "pos", Role: roleMerchant, Account: merchant, ExpiresAt: exp})
+		body := map[string]string{"user_name": "alice", "merchant_id": merchant, "amount": "100"}
+		status, res := do(t, h, http.MethodPost, "/card/purchase", body, "Authorization", token, idempotencyKeyHeader, "purchase-1")
+		if status != http.StatusOK || transactionMetadata(t, res)[merchantIdKey] != merchant {
+			t.Fatalf("purchasing for merchant %d: got %d %v", i, status, res)
+		}
+		txids[i] = res["transaction"].(map[string]interface{})["txid"]
+
+		// a retry of the same principal replays its own transaction
+		status, res = do(t, h, http.MethodPost, "/card/purchase", body, "Authorization", token, idempotencyKeyHeader, "purchase-1")
+		if status != http.StatusOK || res["transaction"].(map[string]interface{})["txid"] != txids[i] {
+			t.Fatalf("retrying for merchant %d: got %d %v, want txid %v", i, status, res, txids[i])
+		}
+	}
+	if txids[0] == txids[1] {
+		t.Errorf("the merchants share transaction %v", txids[0])
+	}
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+	"time"
+)
+
+type BreakageRequest struct {
+	// report the breakage that would be recognized without posting it
+	DryRun bool `json:"dry_run"`
+}
+
+type BreakageResponse struct {
+	DryRun   bool           `json:"dry_run"`
+	Breakage []CardBreakage `json:"breakage"`
+}
+
+// CardBreakage is the remaining balance of an expired card that is, or would be, moved to revenue
+type CardBreakage struct {
+	CardAddress string      `json:"card_address"`
+	MerchantId  string      `json:"merchant_id"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+	Asset       string      `json:"asset"`
+	Amount      int64       `json:"amount"`
+	Transaction interface{} `json:"transaction,omitempty"`
+}
+
+// Breakage runs the breakage job on demand
+func (s *Server) Breakage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req BreakageRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode Breakage request: %s", err.Error()))
+		return
+	}
+	breakage, err := s.RecognizeBreakage(ctx, time.Now(), req.DryRun)
+	if err != nil {
+		writeError(w, errLedger(err, "error recognizing breakage"))
+		return
+	}
+	writeJSON(ctx, w, BreakageResponse{
+		DryRun:   req.DryRun,
+		Breakage: breakage,
+	})
+}
+
+// ScheduleBreakage runs the breakage job every interval until ctx is done
+func (s *Server) ScheduleBreakage(ctx context.Context, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			breakage, err := s.RecognizeBreakage(ctx, now, dryRun)
+			if err != nil {
+				logger.Error(ctx, err, "error recognizing breakage")
+				continue
+			}
+			message := "breakage moved to revenue"
+			if dryRun {
+				message = "dry run, breakage would be moved to revenue"
+			}
+			for _, b := range breakage {
+				logger.Info(ctx, message,
+					"card_id", b.CardAddress,
+					"expires_at", b.ExpiresAt,
+					"amount", b.Amount,
+					"asset", b.Asset,
+				)
+			}
+		}
+	}
+}
+
+// RecognizeBreakage moves the remaining balance of every card that expired before now to revenue. Each
+// card is posted with the reference breakage:{card}:{input}, input being the total ever credited to the
+// card, so a balance is only ever recognized once while the funds returned to the card later, ex. by a
+// reverted spend, are recognized by the next run. The holds expire with their card, so the expired holds
+// are released first and what they still held is recognized with the balance of their card. A card that
+// fails, ex. spent concurrently, is logged and skipped. When dryRun is set nothing is posted, the returned
+// breakage is what would have been without the holds still to release.
+func (s *Server) RecognizeBreakage(ctx context.Context, now time.Time, dryRun bool) ([]CardBreakage, error) {
+	if !dryRun {
+		if err := s.ExpireHolds(ctx, now); err != nil {
+			return nil, err
+		}
+	}
+	accounts, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{AddressPrefix: "cards:"})
+	if err != nil {
+		return nil, err
+	}
+	// only the balances of the expired cards are read
+	var expired []shared.Account
+	for _, acct := range accounts {
+		ok, err := cardExpired(acct.Metadata, now)
+		if err != nil {
+			logger.Error(ctx, err, "invalid expiry on card", "card_id", acct.Address)
+			continue
+		}
+		if ok {
+			expired = append(expired, acct)
+		}
+	}
+	addresses := make([]string, len(expired))
+	for i, acct := range expired {
+		addresses[i] = acct.Address
+	}
+	balances, err := ledger.ListBalancesByPage(ctx, s.ledger, addresses)
+	if err != nil {
+		return nil, err
+	}
+	breakage := make([]CardBreakage, 0)
+	for _, acct := range expired {
+		asset := accountAsset(acct.Metadata)
+		if balances[acct.Address][asset] <= 0 {
+			continue
+		}
+		expiresAt, _ := time.Parse(time.RFC3339, fmt.Sprintf("%v", acct.Metadata[expiresAtKey]))
+		b := CardBreakage{
+			CardAddress: acct.Address,
+			MerchantId:  fmt.Sprintf("%v", acct.Metadata[merchantIdKey]),
+			ExpiresAt:   expiresAt,
+			Asset:       asset,
+			Amount:      balances[acct.Address][asset],
+		}
+		if !dryRun {
+			// the balance listed above may be stale, the volumes and the balance moved are read together
+			account, err := s.ledger.GetAccount(ctx, acct.Address)
+			if err != nil {
+				return breakage, err
+			}
+			input, balance := cardVolumes(account, asset)
+			if balance <= 0 {
+				continue
+			}
+			b.Amount = balance
+			metadata := map[string]interface{}{
+				transactionTypeKey: breakageTransaction,
+				cardIdKey:          acct.Address,
+				merchantIdKey:      b.MerchantId,
+				expiresAtKey:       acct.Metadata[expiresAtKey],
+				assetKey:           asset,
+			}
+			// see templates/breakage.num
+			script, err := templateScript(string(breakageTransaction), map[string]interface{}{
+				"card":   acct.Address,
+				"amount": ledger.Monetary{Asset: asset, Amount: b.Amount},
+			})
+			if err != nil {
+				return breakage, err
+			}
+			txn, err := s.postScript(ctx, metadata, script, fmt.Sprintf("%s:%s:%d", breakageTransaction, acct.Address, input))
+			if errors.Is(err, ledger.ErrDuplicateReference) {
+				// recognized by a concurrent run
+				continue
+			}
+			if errors.Is(err, ledger.ErrInsufficientFunds) {
+				logger.Warn(ctx, "card balance changed while recognizing its breakage, skipped until the next run",
+					"card_id", acct.Address, "error", err)
+				continue
+			}
+			if err != nil {
+				return breakage, err
+			}
+			b.Transaction = txn
+		}
+		breakage = append(breakage, b)
+	}
+	return breakage, nil
+}
+
+// cardVolumes returns the total ever credited to account in asset, and its balance
+func cardVolumes(account *shared.AccountWithVolumesAndBalances, asset string) (input int64, balance int64) {
+	if account == nil {
+		return 0, 0
+	}
+	if v := account.Volumes[asset]["input"]; v != nil {
+		input = v.Int64()
+	}
+	if v := account.Balances[asset]; v != nil {
+		balance = v.Int64()
+	}
+	return input, balance
+}
+
+// cardExpired reports whether the card with the given account metadata expired before now
+func cardExpired(metadata map[string]interface{}, now time.Time) (bool, error) {
+	expiresAt, ok, err := cardExpiry(metadata)
+	if err != nil || !ok {
+		return false, err
+	}
+	return !expiresAt.After(now), nil
+}
+
+// cardExpiry returns the expires_at metadata of a card, ok is false when the card never expires
+func cardExpiry(metadata map[string]interface{}) (expiresAt time.Time, ok bool, err error) {
+	value, ok := metadata[expiresAtKey]
+	if !ok || value == nil {
+		return time.Time{}, false, nil
+	}
+	expiresAt, err = time.Parse(time.RFC3339, fmt.Sprintf("%v", value))
+	return expiresAt, err == nil, err
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"magic-ledger/ledger"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecognizeBreakage(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	cardId := purchaseTestCard(t, h, merchantId, "1000")
+	status, res := do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": cardId, "amount": "400"})
+	if status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	spend := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+	expiresAt := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	if err := s.ledger.AddMetaDataToAccount(ctx, cardId, map[string]interface{}{expiresAtKey: expiresAt}); err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+
+	breakage, err := s.RecognizeBreakage(ctx, time.Now(), true)
+	if err != nil || len(breakage) != 1 || breakage[0].Amount != 600 || breakage[0].Transaction != nil {
+		t.Fatalf("dry run: got %+v, %v", breakage, err)
+	}
+	if got := balance(t, s, cardId, "USD/2"); got != 600 {
+		t.Fatalf("card balance after a dry run: got %d, want 600", got)
+	}
+
+	revenue := balance(t, s, revenueAccountName, "USD/2")
+	breakage, err = s.RecognizeBreakage(ctx, time.Now(), false)
+	if err != nil || len(breakage) != 1 || breakage[0].Amount != 600 {
+		t.Fatalf("breakage: got %+v, %v", breakage, err)
+	}
+	if got := balance(t, s, revenueAccountName, "USD/2") - revenue; got != 600 {
+		t.Errorf("revenue recognized: got %d, want 600", got)
+	}
+	if breakage, err = s.RecognizeBreakage(ctx, time.Now(), false); err != nil || len(breakage) != 0 {
+		t.Fatalf("breakage of a recognized card: got %+v, %v", breakage, err)
+	}
+
+	// funds returned to the expired card are recognized by the next run
+	if status, res = do(t, h, http.MethodPost, fmt.Sprintf("/transactions/%d/revert", spend), nil); status != http.StatusOK {
+		t.Fatalf("reverting the spend: got %d %v", status, res)
+	}
+	breakage, err = s.RecognizeBreakage(ctx, time.Now(), false)
+	if err != nil || len(breakage) != 1 || breakage[0].Amount != 400 {
+		t.Fatalf("breakage of returned funds: got %+v, %v", breakage, err)
+	}
+	if got := balance(t, s, cardId, "USD/2"); got != 0 {
+		t.Errorf("card balance: got %d, want 0", got)
+	}
+}
+
+// balancesReadLedger records the addresses whose balances are read
+type balancesReadLedger struct {
+	*ledger.Memory
+	mu    sync.Mutex
+	reads [][]string
+}
+
+func (l *balancesReadLedger) ListBalances(ctx context.Context, addresses ...string) (map[string]map[string]int64, error) {
+	l.mu.Lock()
+	l.reads = append(l.reads, addresses)
+	l.mu.Unlock()
+	return l.Memory.ListBalances(ctx, addresses...)
+}
+
+func TestRecognizeBreakageReadsExpiredCards(t *testing.T) {
+	ctx := context.Background()
+	backend := &balancesReadLedger{Memory: ledger.NewMemory()}
+	s := NewServer(backend, Options{})
+	if err := s.InitializeInternalAccounts(ctx); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	h := s.NewRouter()
+	merchant := createTestMerchant(t, h)
+	expired := purchaseTestCard(t, h, merchant, "1000")
+	purchaseTestCard(t, h, merchant, "500")
+	if err := s.ledger.AddMetaDataToAccount(ctx, expired, map[string]interface{}{expiresAtKey: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}); err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+
+	backend.reads = nil
+	breakage, err := s.RecognizeBreakage(ctx, time.Now(), true)
+	if err != nil || len(breakage) != 1 || breakage[0].CardAddress != expired {
+		t.Fatalf("dry run: got %+v, %v", breakage, err)
+	}
+	if want := [][]string{{expired}}; !reflect.DeepEqual(backend.reads, want) {
+		t.Errorf("balances read: got %v, want %v", backend.reads, want)
+	}
+}
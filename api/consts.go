@@ -12,15 +12,40 @@ const (
 	ledgerableTypeKey                                 = "ledgerable_type"
 	purchaseIdKey                                     = "purchase_id"
 	transactionTypeKey                                = "transaction_type"
+	idempotencyHashKey                                = "idempotency_hash"
+	revertedTxidKey                                   = "reverted_txid"
+	revertedByKey                                     = "reverted_by"
+	purchaseTxidKey                                   = "purchase_txid"
+	expiresAtKey                                      = "expires_at"
+	assetKey                                          = "asset"
+	feeScheduleKey                                    = "fee_schedule"
+	feeScheduleVersionKey                             = "fee_schedule_version"
+	batchIdKey                                        = "batch_id"
+	payoutIdKey                                       = "payout_id"
+	holdIdKey                                         = "hold_id"
+	voidReasonKey                                     = "void_reason"
+	releasedAtKey                                     = "released_at"
 	assetsAccountName                                 = "assets"
 	revenueAccountName                                = "revenue"
 	expensesAccountName                               = "expenses"
 	worldAccountName                                  = "world"
+	defaultCurrency                                   = "USD"
+	legacyAsset                                       = "USD"
 	purchaseCardTransaction           TransactionType = "purchase_card"
 	spendCardTransaction              TransactionType = "spend_card"
 	payoutMerchantTransaction         TransactionType = "payout_merchant"
 	createMerchantTransaction         TransactionType = "create_merchant"
 	createInternalAccountsTransaction TransactionType = "create_internal_account"
+	refundCardTransaction             TransactionType = "refund_card"
+	reversalTransaction               TransactionType = "reversal"
+	breakageTransaction               TransactionType = "breakage"
+	payoutBatchTransaction            TransactionType = "payout_batch"
+	payoutSettledTransaction          TransactionType = "payout_settled"
+	payoutFailedTransaction           TransactionType = "payout_failed"
+	authorizeCardTransaction          TransactionType = "authorize_card"
+	captureCardTransaction            TransactionType = "capture_card"
+	voidCardTransaction               TransactionType = "void_card"
+	merchantFeesTransaction           TransactionType = "merchant_fees"
 
 	balanceTypeCredit      BalanceType    = "credit"
 	balanceTypeDebit       BalanceType    = "debit"
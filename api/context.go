@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"magic-ledger/logger"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request ids accepted from clients, they end up in every log line
+const maxRequestIDLength = 128
+
+// RequestID tags the request with the X-Request-ID sent by the client, or a new one when it sent none or an
+// invalid one. the id is echoed in the response and logged with everything done for the request.
+func RequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		inner.ServeHTTP(w, r.WithContext(logger.WithRequestID(r.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Timeout cancels the context of the request once timeout has elapsed, the ledger calls still running then
+// fail with context.DeadlineExceeded. there is no timeout when it is 0.
+func Timeout(inner http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return inner
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// detachedContext keeps the values of its parent, such as the request id, but is never canceled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// detach returns a context for work that must finish once started even if the client goes away, like
+// adding the metadata of an account whose transaction was already posted
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/google/uuid"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		// kept is true when the id sent is the id of the request
+		kept bool
+	}{
+		{"valid", "req-42_a.b", true},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"none", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "req 42", false},
+		{"control character", "req\n42", false},
+		{"not ascii", "reqé42", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = logger.RequestID(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.sent != "" {
+				req.Header.Set(requestIDHeader, tt.sent)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(requestIDHeader)
+			if echoed != seen {
+				t.Errorf("echoed %q, the request carried %q", echoed, seen)
+			}
+			if tt.kept {
+				if seen != tt.sent {
+					t.Errorf("got request id %q, want %q", seen, tt.sent)
+				}
+				return
+			}
+			if _, err := uuid.Parse(seen); err != nil {
+				t.Errorf("got request id %q, want a new uuid", seen)
+			}
+		})
+	}
+
+	// every route echoes the id
+	_, h := newTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/templates", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "req-42" {
+		t.Errorf("request id of GET /templates: got %q, want req-42", got)
+	}
+}
+
+// blockingLedger blocks GetAccount until the context of the call is done
+type blockingLedger struct {
+	*ledger.Memory
+}
+
+func (blockingLedger) GetAccount(ctx context.Context, _ string) (*shared.AccountWithVolumesAndBalances, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	var handlerErr error
+	h := Timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			handlerErr = r.Context().Err()
+		case <-time.After(time.Second):
+		}
+	}), 10*time.Millisecond)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !errors.Is(handlerErr, context.DeadlineExceeded) {
+		t.Errorf("context of the handler: got %v, want %v", handlerErr, context.DeadlineExceeded)
+	}
+
+	// without a timeout the context of the request is left as is
+	var deadline bool
+	h = Timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, deadline = r.Context().Deadline()
+	}), 0)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if deadline {
+		t.Errorf("a timeout of 0 set a deadline")
+	}
+
+	// a ledger call outliving the timeout of its route fails the request with a 504
+	s := NewServer(blockingLedger{Memory: ledger.NewMemory()}, Options{RequestTimeout: 20 * time.Millisecond})
+	start := time.Now()
+	status, res := do(t, s.NewRouter(), http.MethodGet, "/cards/cards:a", nil)
+	if status != http.StatusGatewayTimeout || errorCode(res) != string(errorCodeTimeout) {
+		t.Errorf("request timing out: got %d %v, want %d %s", status, res, http.StatusGatewayTimeout, errorCodeTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request timing out: answered after %s", elapsed)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithTimeout(logger.WithRequestID(context.Background(), "req-42"), time.Hour)
+	detached := detach(parent)
+	cancel()
+
+	if parent.Err() == nil {
+		t.Fatalf("parent is not canceled")
+	}
+	if err := detached.Err(); err != nil {
+		t.Errorf("Err of the detached context: got %v, want nil", err)
+	}
+	if detached.Done() != nil {
+		t.Errorf("Done of the detached context: got a channel, want nil")
+	}
+	if _, ok := detached.Deadline(); ok {
+		t.Errorf("the detached context kept the deadline of its parent")
+	}
+	if got := logger.RequestID(detached); got != "req-42" {
+		t.Errorf("request id of the detached context: got %q, want req-42", got)
+	}
+}
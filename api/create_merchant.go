@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
@@ -12,53 +11,90 @@ import (
 
 type CreateMerchantRequest struct {
 	MerchantName *string `json:"merchant_name"`
+
+	// ISO 4217 code of the currency the merchant sells cards in, defaults to USD
+	Currency *string `json:"currency,omitempty"`
+}
+
+type CreateMerchantResponse struct {
+	Transaction interface{} `json:"transaction"`
 }
 
-func CreateMerchant(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) CreateMerchant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
 	decoder := json.NewDecoder(r.Body)
 	var req CreateMerchantRequest
 	err := decoder.Decode(&req)
 	if err != nil {
-		http.Error(w, "unable to decode CreateMerchant request", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("unable to decode CreateMerchant request: %s", err.Error()))
 		return
 	}
 
 	if req.MerchantName == nil {
-		http.Error(w, "merchantName cannot be null", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("merchantName cannot be null"))
+		return
+	}
+	currency := defaultCurrency
+	if req.Currency != nil {
+		currency = *req.Currency
+	}
+	asset, err := assetForCurrency(currency)
+	if err != nil {
+		writeError(w, errInvalidRequest("%s", err.Error()))
+		return
+	}
+
+	key, err := newIdempotencyKey(r, createMerchantTransaction, req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to read idempotency key: %s", err.Error()))
+		return
+	}
+	if txn, err := s.replay(ctx, key); err != nil {
+		writeError(w, errLedger(err, "error looking up idempotent request"))
+		return
+	} else if txn != nil {
+		if err = s.reconcileAccount(detach(ctx), txn); err != nil {
+			writeError(w, errLedger(err, "error reconciling merchant account"))
+			return
+		}
+		writeJSON(ctx, w, CreateMerchantResponse{Transaction: txn})
 		return
 	}
 
 	merchantId := fmt.Sprintf("merchant:%s", strings.Replace(uuid.NewString(), "-", "", -1))
+	// the transaction carries the metadata of the merchant, see createdAccount
 	metadata := map[string]interface{}{
 		transactionTypeKey: createMerchantTransaction,
 		merchantIdKey:      merchantId,
+		nameKey:            *req.MerchantName,
+		assetKey:           asset,
 	}
-	postings := []ledger.TransactionPosting{
-		{
-			Src:    worldAccountName,
-			Dest:   merchantId,
-			Amount: 0,
-		},
+	script, err := templateScript(string(createMerchantTransaction), map[string]interface{}{
+		"merchant": merchantId,
+		"amount":   ledger.Monetary{Asset: asset, Amount: 0},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	_, err = ledger.CreateTransactionWithPostings(ctx, metadata, postings)
+	txn, replayed, err := s.createFromScript(ctx, key, metadata, script)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error creating transaction: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, errLedger(err, "error creating transaction"))
 		return
 	}
-
-	// add metadata to the account we just created
-	accountMetadata := map[string]interface{}{
-		nameKey:           *req.MerchantName,
-		balanceTypeKey:    balanceTypeCredit,
-		ledgerableTypeKey: ledgerableTypeExternal,
+	if replayed {
+		if err = s.reconcileAccount(detach(ctx), txn); err != nil {
+			writeError(w, errLedger(err, "error reconciling merchant account"))
+			return
+		}
+		writeJSON(ctx, w, CreateMerchantResponse{Transaction: txn})
+		return
 	}
-	err = ledger.AddMetaDataToAccount(ctx, merchantId, accountMetadata)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error adding metadata to account %s", err.Error()), http.StatusBadRequest)
+
+	if err = s.addCreatedAccountMetadata(ctx, txn); err != nil {
+		writeError(w, errLedger(err, "error adding metadata to account %s", merchantId))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(ctx, w, CreateMerchantResponse{Transaction: txn})
 }
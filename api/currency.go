@@ -0,0 +1,38 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// currencyPrecision is the number of decimals in the minor unit of every currency a merchant can declare
+var currencyPrecision = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"MXN": 2,
+	"USD": 2,
+}
+
+// assetForCurrency returns the ledger asset, with its precision, for an ISO 4217 currency code (ex. EUR/2)
+func assetForCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(currency)
+	precision, ok := currencyPrecision[currency]
+	if !ok {
+		return "", fmt.Errorf("unsupported currency %s", currency)
+	}
+	return fmt.Sprintf("%s/%d", currency, precision), nil
+}
+
+// accountAsset returns the asset a merchant or card account is denominated in. accounts created before
+// merchants could declare a currency have no asset metadata and hold legacyAsset.
+func accountAsset(metadata map[string]interface{}) string {
+	if asset, ok := metadata[assetKey]; ok && asset != nil {
+		return fmt.Sprintf("%v", asset)
+	}
+	return legacyAsset
+}
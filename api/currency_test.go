@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMultiCurrency(t *testing.T) {
+	_, h := newTestServer(t)
+	usdMerchant := createTestMerchant(t, h)
+	usdCard := purchaseTestCard(t, h, usdMerchant, "1000")
+
+	status, res := do(t, h, http.MethodPost, "/merchant/create", map[string]string{"merchant_name": "bakery", "currency": "eur"})
+	if status != http.StatusOK {
+		t.Fatalf("creating merchant: got %d %v", status, res)
+	}
+	if got := transactionMetadata(t, res)[assetKey]; got != "EUR/2" {
+		t.Errorf("asset of the merchant creation: got %v, want EUR/2", got)
+	}
+	eurMerchant := transactionMetadata(t, res)[merchantIdKey].(string)
+
+	status, res = do(t, h, http.MethodPost, "/card/purchase", map[string]string{
+		"user_name":    "alice",
+		"merchant_id":  eurMerchant,
+		"amount":       "500",
+		"revenue_take": "50",
+		"expenses":     "20",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	// the card inherits the currency of its merchant, every posting is in it
+	if got := transactionMetadata(t, res)[assetKey]; got != "EUR/2" {
+		t.Errorf("asset of the purchase: got %v, want EUR/2", got)
+	}
+	eurCard := transactionMetadata(t, res)[cardIdKey].(string)
+	for _, p := range res["transaction"].(map[string]interface{})["postings"].([]interface{}) {
+		if asset := p.(map[string]interface{})["asset"]; asset != "EUR/2" {
+			t.Errorf("posting of the purchase: got asset %v, want EUR/2", asset)
+		}
+	}
+	if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": eurCard, "amount": "200"}); status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	for _, p := range res["transaction"].(map[string]interface{})["postings"].([]interface{}) {
+		if asset := p.(map[string]interface{})["asset"]; asset != "EUR/2" {
+			t.Errorf("posting of the spend: got asset %v, want EUR/2", asset)
+		}
+	}
+
+	status, res = do(t, h, http.MethodGet, "/accounts", nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing accounts: got %d %v", status, res)
+	}
+	accounts := make(map[string]map[string]interface{})
+	for _, account := range res["accounts"].([]interface{}) {
+		account := account.(map[string]interface{})
+		accounts[account["address"].(string)] = account
+	}
+	wantAccounts := map[string]struct {
+		asset    string
+		balances map[string]float64
+	}{
+		usdCard:     {"USD/2", map[string]float64{"USD/2": 1000}},
+		eurCard:     {"EUR/2", map[string]float64{"EUR/2": 250}},
+		eurMerchant: {"EUR/2", map[string]float64{"EUR/2": 200}},
+	}
+	for address, want := range wantAccounts {
+		account, ok := accounts[address]
+		if !ok {
+			t.Errorf("account %s is not listed", address)
+			continue
+		}
+		if account["asset"] != want.asset {
+			t.Errorf("asset of %s: got %v, want %s", address, account["asset"], want.asset)
+		}
+		balances := account["balances"].(map[string]interface{})
+		if len(balances) != len(want.balances) {
+			t.Errorf("balances of %s: got %v, want %v", address, balances, want.balances)
+		}
+		for asset, amount := range want.balances {
+			if balances[asset] != amount {
+				t.Errorf("%s balance of %s: got %v, want %v", asset, address, balances[asset], amount)
+			}
+		}
+	}
+
+	status, res = do(t, h, http.MethodGet, "/ledger", nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting ledger metadata: got %d %v", status, res)
+	}
+	// amounts in different currencies are never summed together
+	totals := []struct {
+		total string
+		asset string
+		want  float64
+	}{
+		{"assets", "USD/2", 1000},
+		{"assets", "EUR/2", 480},
+		{"revenue", "EUR/2", 50},
+		{"expenses", "EUR/2", 20},
+		{"card_liability", "USD/2", 1000},
+		{"card_liability", "EUR/2", 250},
+	}
+	for _, tt := range totals {
+		if got := res[tt.total].(map[string]interface{})[tt.asset]; got != tt.want {
+			t.Errorf("%s in %s: got %v, want %v", tt.total, tt.asset, got, tt.want)
+		}
+	}
+	debits, credits := res["debits"].(map[string]interface{}), res["credits"].(map[string]interface{})
+	for _, asset := range []string{"USD/2", "EUR/2"} {
+		if debits[asset] == nil || debits[asset] != credits[asset] {
+			t.Errorf("debits and credits in %s: got %v and %v", asset, debits[asset], credits[asset])
+		}
+	}
+
+	status, res = do(t, h, http.MethodPost, "/merchant/create", map[string]string{"merchant_name": "kiosk", "currency": "XYZ"})
+	if status != http.StatusBadRequest {
+		t.Errorf("creating a merchant in an unsupported currency: got %d %v, want %d", status, res, http.StatusBadRequest)
+	}
+}
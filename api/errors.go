@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"net/http"
+)
+
+// ErrorCode is a stable identifier clients can switch on, unlike the message which is meant for humans
+type ErrorCode string
+
+const (
+	errorCodeInvalidRequest       ErrorCode = "invalid_request"
+	errorCodeUnauthenticated      ErrorCode = "unauthenticated"
+	errorCodeForbidden            ErrorCode = "forbidden"
+	errorCodeInvalidAmount        ErrorCode = "invalid_amount"
+	errorCodeInsufficientFunds    ErrorCode = "insufficient_funds"
+	errorCodeAccountNotFound      ErrorCode = "account_not_found"
+	errorCodeTransactionNotFound  ErrorCode = "transaction_not_found"
+	errorCodeTemplateNotFound     ErrorCode = "template_not_found"
+	errorCodeTemplateHandled      ErrorCode = "template_handled"
+	errorCodePayoutNotFound       ErrorCode = "payout_not_found"
+	errorCodePayoutBatchNotFound  ErrorCode = "payout_batch_not_found"
+	errorCodeInvalidPayoutStatus  ErrorCode = "invalid_payout_status"
+	errorCodeHoldNotFound         ErrorCode = "hold_not_found"
+	errorCodeFeeScheduleNotFound  ErrorCode = "fee_schedule_not_found"
+	errorCodeHoldReleased         ErrorCode = "hold_released"
+	errorCodeHoldExpired          ErrorCode = "hold_expired"
+	errorCodeCardExpired          ErrorCode = "card_expired"
+	errorCodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	errorCodeAlreadyReverted      ErrorCode = "already_reverted"
+	errorCodeNotRevertible        ErrorCode = "not_revertible"
+	errorCodeConflict             ErrorCode = "conflict"
+	errorCodeLedgerValidation     ErrorCode = "ledger_validation_error"
+	errorCodeLedgerError          ErrorCode = "ledger_error"
+	errorCodeLedgerUnavailable    ErrorCode = "ledger_unavailable"
+	errorCodeTimeout              ErrorCode = "timeout"
+	errorCodeInternal             ErrorCode = "internal_error"
+)
+
+// Error is the error returned by every handler, rendered as {"error": {...}} with its Status
+type Error struct {
+	Code    ErrorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Status  int                    `json:"-"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+type ErrorResponse struct {
+	Error *Error `json:"error"`
+}
+
+func newError(status int, code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Status:  status,
+	}
+}
+
+func errInvalidRequest(format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, errorCodeInvalidRequest, format, args...)
+}
+
+func errAccountNotFound(address string) *Error {
+	e := newError(http.StatusNotFound, errorCodeAccountNotFound, "no ledger account associated with address %s", address)
+	e.Details = map[string]interface{}{"address": address}
+	return e
+}
+
+// errLedger wraps an error returned by the ledger backend. errors the ledger attributes to the request
+// keep a 4xx status, the formance error code is passed along in the details when there is one.
+func errLedger(err error, format string, args ...interface{}) *Error {
+	message := fmt.Sprintf("%s: %s", fmt.Sprintf(format, args...), err.Error())
+	var apiErr *Error
+	var formanceErr *ledger.FormanceError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		apiErr = newError(http.StatusBadRequest, errorCodeInsufficientFunds, "%s", message)
+	case errors.Is(err, ledger.ErrDuplicateReference):
+		apiErr = newError(http.StatusConflict, errorCodeConflict, "%s", message)
+	case errors.Is(err, ledger.ErrInvalidCursor):
+		apiErr = newError(http.StatusBadRequest, errorCodeInvalidRequest, "%s", message)
+	case errors.Is(err, ledger.ErrInvalidPostings):
+		apiErr = newError(http.StatusBadRequest, errorCodeLedgerValidation, "%s", message)
+	case errors.Is(err, ledger.ErrCircuitOpen):
+		apiErr = newError(http.StatusServiceUnavailable, errorCodeLedgerUnavailable, "%s", message)
+	case errors.Is(err, context.DeadlineExceeded):
+		apiErr = newError(http.StatusGatewayTimeout, errorCodeTimeout, "%s", message)
+	case errors.As(err, &formanceErr) && formanceErr.Code == shared.ErrorsEnumMetadataOverride:
+		apiErr = newError(http.StatusConflict, errorCodeConflict, "%s", message)
+	case errors.As(err, &formanceErr):
+		apiErr = newError(http.StatusBadGateway, errorCodeLedgerError, "%s", message)
+	default:
+		apiErr = newError(http.StatusInternalServerError, errorCodeInternal, "%s", message)
+	}
+	if formanceErr != nil || errors.As(err, &formanceErr) {
+		apiErr.Details = map[string]interface{}{
+			"formance_status_code": formanceErr.StatusCode,
+		}
+		if formanceErr.Code != "" {
+			apiErr.Details["formance_error_code"] = formanceErr.Code
+		}
+		if formanceErr.Details != "" {
+			apiErr.Details["formance_details"] = formanceErr.Details
+		}
+	}
+	return apiErr
+}
+
+// writeError renders err as a JSON error body. errors that are not an *Error are reported as internal errors.
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = newError(http.StatusInternalServerError, errorCodeInternal, "%s", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{
+		Error: apiErr,
+	})
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"magic-ledger/ledger"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "api error",
+			err:        errInvalidRequest("amount cannot be null"),
+			wantStatus: http.StatusBadRequest,
+			want:       `{"error":{"code":"invalid_request","message":"amount cannot be null"}}`,
+		},
+		{
+			name:       "details",
+			err:        validateAmount(-1),
+			wantStatus: http.StatusBadRequest,
+			want:       `{"error":{"code":"invalid_amount","message":"amount must be positive, got -1","details":{"amount":-1}}}`,
+		},
+		{
+			name:       "not found",
+			err:        errAccountNotFound("cards:missing"),
+			wantStatus: http.StatusNotFound,
+			want: `{"error":{"code":"account_not_found","message":"no ledger account associated with address cards:missing",` +
+				`"details":{"address":"cards:missing"}}}`,
+		},
+		{
+			name:       "other error",
+			err:        errors.New("boom"),
+			wantStatus: http.StatusInternalServerError,
+			want:       `{"error":{"code":"internal_error","message":"boom"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeError(rec, tt.err)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status: got %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json; charset=UTF-8" {
+				t.Errorf("content type: got %q", got)
+			}
+			if got := string(bytes.TrimSpace(rec.Body.Bytes())); got != tt.want {
+				t.Errorf("body:\ngot  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrLedger(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{"insufficient funds", fmt.Errorf("%w: account cards:a", ledger.ErrInsufficientFunds), http.StatusBadRequest, errorCodeInsufficientFunds},
+		{"duplicate reference", ledger.ErrDuplicateReference, http.StatusConflict, errorCodeConflict},
+		{"invalid cursor", ledger.ErrInvalidCursor, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"invalid postings", ledger.ErrInvalidPostings, http.StatusBadRequest, errorCodeLedgerValidation},
+		{"circuit open", ledger.ErrCircuitOpen, http.StatusServiceUnavailable, errorCodeLedgerUnavailable},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, errorCodeTimeout},
+		{"formance", &ledger.FormanceError{Operation: "get account", StatusCode: 500}, http.StatusBadGateway, errorCodeLedgerError},
+		{"api error", errAccountNotFound("cards:a"), http.StatusNotFound, errorCodeAccountNotFound},
+		{"other", errors.New("boom"), http.StatusInternalServerError, errorCodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := errLedger(tt.err, "error posting")
+			if err.Status != tt.wantStatus || err.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", err.Status, err.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+// every error response of a handler has the same shape, only the error object with a code and a message
+func TestErrorResponseShape(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, path := range []string{"/card/purchase", "/card/spend", "/merchant/create", "/merchant/payout"} {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(`{`)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+		var res map[string]map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: decoding %q: %v", path, rec.Body.String(), err)
+		}
+		var keys []string
+		for k := range res["error"] {
+			keys = append(keys, k)
+		}
+		if len(res) != 1 || len(keys) != 2 || res["error"]["code"] != string(errorCodeInvalidRequest) || res["error"]["message"] == "" {
+			t.Errorf("%s: got %v", path, res)
+		}
+		if !reflect.DeepEqual(rec.Header().Values("X-Content-Type-Options"), []string{"nosniff"}) {
+			t.Errorf("%s: X-Content-Type-Options: got %v", path, rec.Header().Values("X-Content-Type-Options"))
+		}
+	}
+}
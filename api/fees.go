@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// basisPointsPerUnit is 100%, fee percentages are counted in basis points, hundredths of a percent
+const basisPointsPerUnit = 10000
+
+// FeeSchedule computes the revenue and expenses of the purchases of a merchant's cards. fixed amounts are in
+// the minor unit of the merchant's asset.
+type FeeSchedule struct {
+	// Version is incremented every time the schedule is replaced, purchases record the version they applied
+	Version int64 `json:"version"`
+	// Revenue is the take of the purchase, sent to the revenue account instead of the card
+	Revenue Fee `json:"revenue"`
+	// Expenses is the cost of processing the card payment, ex. 2.9% + 30 cents, sent to the expenses account
+	// instead of the assets
+	Expenses Fee `json:"expenses"`
+}
+
+// Fee is a percentage of the purchased amount plus a fixed amount. the tier with the highest MinAmount not
+// above the purchased amount replaces both, a purchase below every tier pays the base fee.
+type Fee struct {
+	BasisPoints int64     `json:"basis_points"`
+	Fixed       int64     `json:"fixed,string"`
+	Tiers       []FeeTier `json:"tiers,omitempty"`
+}
+
+type FeeTier struct {
+	MinAmount   int64 `json:"min_amount,string"`
+	BasisPoints int64 `json:"basis_points"`
+	Fixed       int64 `json:"fixed,string"`
+}
+
+func (f Fee) validate(name string) error {
+	if err := validateFeeRate(name, f.BasisPoints, f.Fixed); err != nil {
+		return err
+	}
+	for i, tier := range f.Tiers {
+		tierName := fmt.Sprintf("%s.tiers[%d]", name, i)
+		if err := validateFeeRate(tierName, tier.BasisPoints, tier.Fixed); err != nil {
+			return err
+		}
+		if tier.MinAmount <= 0 || (i > 0 && tier.MinAmount <= f.Tiers[i-1].MinAmount) {
+			return errInvalidRequest("%s.min_amount must be positive and greater than the min_amount of the previous tier", tierName)
+		}
+	}
+	return nil
+}
+
+func validateFeeRate(name string, basisPoints int64, fixed int64) error {
+	if basisPoints < 0 || basisPoints > basisPointsPerUnit {
+		return errInvalidRequest("%s.basis_points must be between 0 and %d, got %d", name, basisPointsPerUnit, basisPoints)
+	}
+	if fixed < 0 {
+		return errInvalidRequest("%s.fixed cannot be negative, got %d", name, fixed)
+	}
+	return nil
+}
+
+// compute returns the fee on amount. the percentage is rounded half up to the minor unit, so the same
+// purchase always pays the same fee whatever the backend.
+func (f Fee) compute(amount int64) int64 {
+	basisPoints, fixed := f.BasisPoints, f.Fixed
+	for _, tier := range f.Tiers {
+		if amount < tier.MinAmount {
+			break
+		}
+		basisPoints, fixed = tier.BasisPoints, tier.Fixed
+	}
+	// amount * basisPoints can overflow an int64, the quotient can't since basisPoints is at most 100%
+	fee := new(big.Int).Mul(big.NewInt(amount), big.NewInt(basisPoints))
+	fee.Add(fee, big.NewInt(basisPointsPerUnit/2))
+	fee.Quo(fee, big.NewInt(basisPointsPerUnit))
+	return fee.Int64() + fixed
+}
+
+// fees returns the revenue and expenses of a purchase of amount. it fails with invalid_amount when they
+// add up to more than amount.
+func (s FeeSchedule) fees(amount int64) (revenue int64, expenses int64, err error) {
+	revenue = s.Revenue.compute(amount)
+	expenses = s.Expenses.compute(amount)
+	// the fixed fees are validated as non-negative, an overflow makes a sum negative
+	if revenue < 0 || expenses < 0 || revenue > amount || expenses > amount-revenue {
+		return 0, 0, newError(http.StatusBadRequest, errorCodeInvalidAmount,
+			"the fee schedule takes more than the amount (%d): revenue %d, expenses %d", amount, revenue, expenses)
+	}
+	return revenue, expenses, nil
+}
+
+// decodeFeeSchedule reads the fee schedule recorded in the metadata of a merchant_fees transaction
+func decodeFeeSchedule(metadata map[string]interface{}) (*FeeSchedule, error) {
+	value, ok := metadata[feeScheduleKey]
+	if !ok || value == nil {
+		return nil, errors.New("no fee schedule in the metadata")
+	}
+	// the backends return the schedule as they decoded it from json
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var schedule FeeSchedule
+	if err = json.Unmarshal(encoded, &schedule); err != nil {
+		return nil, fmt.Errorf("invalid fee schedule: %w", err)
+	}
+	return &schedule, nil
+}
+
+// feesReference is the reference of the merchant_fees transaction recording version of the fee schedule of
+// merchant, two updates can't both post the same version
+func feesReference(merchant string, version int64) string {
+	return fmt.Sprintf("fees:%s:%d", merchant, version)
+}
+
+// feeSchedule returns version of the fee schedule of merchant along with the merchant_fees transaction that
+// recorded it, the current schedule when version is 0. the schedule is nil when there is no such version.
+func (s *Server) feeSchedule(ctx context.Context, merchant string, version int64) (*FeeSchedule, *shared.Transaction, error) {
+	var recorded *shared.Transaction
+	if version != 0 {
+		txn, err := s.ledger.GetTransactionByReference(ctx, feesReference(merchant, version))
+		if err != nil || txn == nil {
+			return nil, nil, err
+		}
+		recorded = txn
+	} else {
+		// a version is only posted once the one before it is read, the latest transaction holds the latest version
+		latest, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+			Metadata: map[string]string{
+				transactionTypeKey: string(merchantFeesTransaction),
+				merchantIdKey:      merchant,
+			},
+		}, ledger.Page{PageSize: 1})
+		if err != nil || len(latest.Transactions) == 0 {
+			return nil, nil, err
+		}
+		recorded = &latest.Transactions[0]
+	}
+	schedule, err := decodeFeeSchedule(recorded.Metadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transaction %d: %w", recorded.Txid, err)
+	}
+	return schedule, recorded, nil
+}
+
+type MerchantFeesResponse struct {
+	MerchantId  string       `json:"merchant_id"`
+	FeeSchedule *FeeSchedule `json:"fee_schedule"`
+	// Txid is the merchant_fees transaction recording the schedule
+	Txid int64 `json:"txid"`
+}
+
+// SetMerchantFees replaces the fee schedule of a merchant, the purchases that follow compute their revenue and
+// expenses from it. every version is recorded by a merchant_fees transaction with the reference
+// fees:{merchant}:{version}, so concurrent updates can't both post the same version and every past version stays
+// readable. the update that loses gets a 409 and can be retried.
+func (s *Server) SetMerchantFees(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	address := mux.Vars(r)["address"]
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var schedule FeeSchedule
+	if err := decoder.Decode(&schedule); err != nil {
+		writeError(w, errInvalidRequest("unable to decode SetMerchantFees request: %s", err.Error()))
+		return
+	}
+	if err := schedule.Revenue.validate("revenue"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := schedule.Expenses.validate("expenses"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	account, err := s.merchantAccount(ctx, address)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	previous, _, err := s.feeSchedule(ctx, address, 0)
+	if err != nil {
+		writeError(w, errLedger(err, "error reading the fee schedule of merchant %s", address))
+		return
+	}
+	schedule.Version = 1
+	if previous != nil {
+		schedule.Version = previous.Version + 1
+	}
+
+	encoded, err := json.Marshal(schedule)
+	if err != nil {
+		writeError(w, newError(http.StatusInternalServerError, errorCodeInternal, "error encoding fee schedule: %s", err.Error()))
+		return
+	}
+	var stored map[string]interface{}
+	_ = json.Unmarshal(encoded, &stored)
+	asset := accountAsset(account.Metadata)
+	metadata := map[string]interface{}{
+		transactionTypeKey:    merchantFeesTransaction,
+		merchantIdKey:         address,
+		assetKey:              asset,
+		feeScheduleKey:        stored,
+		feeScheduleVersionKey: schedule.Version,
+	}
+	// see templates/merchant_fees.num
+	script, err := templateScript(string(merchantFeesTransaction), map[string]interface{}{
+		"merchant": address,
+		"amount":   ledger.Monetary{Asset: asset, Amount: 0},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	txn, err := s.postScript(ctx, metadata, script, feesReference(address, schedule.Version))
+	if errors.Is(err, ledger.ErrDuplicateReference) {
+		e := newError(http.StatusConflict, errorCodeConflict, "version %d of the fee schedule of merchant %s was set by a concurrent update", schedule.Version, address)
+		e.Details = map[string]interface{}{"version": schedule.Version}
+		writeError(w, e)
+		return
+	}
+	if err != nil {
+		writeError(w, errLedger(err, "error recording the fee schedule of merchant %s", address))
+		return
+	}
+	logger.Info(ctx, "merchant fee schedule replaced", "merchant_id", address, "version", schedule.Version, "txid", txn.Txid)
+	writeJSON(ctx, w, MerchantFeesResponse{
+		MerchantId:  address,
+		FeeSchedule: &schedule,
+		Txid:        txn.Txid,
+	})
+}
+
+// GetMerchantFees returns the current fee schedule of a merchant, or the version given in the query
+func (s *Server) GetMerchantFees(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	address := mux.Vars(r)["address"]
+	version := int64(0)
+	if value := r.URL.Query().Get("version"); value != "" {
+		var err error
+		if version, err = strconv.ParseInt(value, 10, 64); err != nil || version <= 0 {
+			writeError(w, errInvalidRequest("version must be a positive integer"))
+			return
+		}
+	}
+	if err := s.authorizeAccount(ctx, r, address); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := s.merchantAccount(ctx, address); err != nil {
+		writeError(w, err)
+		return
+	}
+	schedule, txn, err := s.feeSchedule(ctx, address, version)
+	if err != nil {
+		writeError(w, errLedger(err, "error reading the fee schedule of merchant %s", address))
+		return
+	}
+	if schedule == nil && version != 0 {
+		writeError(w, newError(http.StatusNotFound, errorCodeFeeScheduleNotFound, "merchant %s has no fee schedule version %d", address, version))
+		return
+	}
+	if schedule == nil {
+		writeError(w, newError(http.StatusNotFound, errorCodeFeeScheduleNotFound, "merchant %s has no fee schedule", address))
+		return
+	}
+	writeJSON(ctx, w, MerchantFeesResponse{
+		MerchantId:  address,
+		FeeSchedule: schedule,
+		Txid:        txn.Txid,
+	})
+}
+
+// merchantAccount returns the account of the merchant at address, account_not_found if there is none
+func (s *Server) merchantAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	if !strings.HasPrefix(address, "merchant:") {
+		return nil, errAccountNotFound(address)
+	}
+	account, err := s.ledger.GetAccount(ctx, address)
+	if err != nil {
+		return nil, errLedger(err, "error getting ledger account")
+	}
+	if account == nil || account.Metadata[balanceTypeKey] == nil {
+		return nil, errAccountNotFound(address)
+	}
+	return account, nil
+}
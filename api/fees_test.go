@@ -0,0 +1,302 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFeeCompute(t *testing.T) {
+	tiered := Fee{
+		BasisPoints: 500,
+		Tiers: []FeeTier{
+			{MinAmount: 1000, BasisPoints: 300, Fixed: 10},
+			{MinAmount: 5000, BasisPoints: 100},
+		},
+	}
+	tests := []struct {
+		name   string
+		fee    Fee
+		amount int64
+		want   int64
+	}{
+		// 5% of 1010 is 50.5, rounded half up
+		{"half rounds up", Fee{BasisPoints: 500}, 1010, 51},
+		// 5% of 1009 is 50.45
+		{"below half rounds down", Fee{BasisPoints: 500}, 1009, 50},
+		{"one basis point of 5000", Fee{BasisPoints: 1}, 5000, 1},
+		{"one basis point of 4999", Fee{BasisPoints: 1}, 4999, 0},
+		{"percentage and fixed", Fee{BasisPoints: 290, Fixed: 30}, 1000, 59},
+		{"fixed only", Fee{Fixed: 30}, 1, 30},
+		{"no fee", Fee{}, 1000, 0},
+		{"whole amount", Fee{BasisPoints: basisPointsPerUnit}, 123, 123},
+		// amount * basis points overflows an int64
+		{"largest amount", Fee{BasisPoints: basisPointsPerUnit}, math.MaxInt64, math.MaxInt64},
+		// below every tier the base fee applies, 49.95
+		{"below the first tier", tiered, 999, 50},
+		{"at the first tier", tiered, 1000, 40},
+		// 149.97 + 10
+		{"below the second tier", tiered, 4999, 160},
+		{"at the second tier", tiered, 5000, 50},
+		{"above the last tier", tiered, 10000, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fee.compute(tt.amount); got != tt.want {
+				t.Errorf("compute(%d): got %d, want %d", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeeScheduleFees(t *testing.T) {
+	tests := []struct {
+		name         string
+		schedule     FeeSchedule
+		amount       int64
+		wantRevenue  int64
+		wantExpenses int64
+		wantErr      bool
+	}{
+		{"card processing", FeeSchedule{Revenue: Fee{BasisPoints: 1000}, Expenses: Fee{BasisPoints: 290, Fixed: 30}}, 1000, 100, 59, false},
+		{"fees take the whole amount", FeeSchedule{Revenue: Fee{BasisPoints: 5000}, Expenses: Fee{BasisPoints: 5000}}, 1000, 500, 500, false},
+		{"revenue above the amount", FeeSchedule{Revenue: Fee{Fixed: 101}}, 100, 0, 0, true},
+		{"revenue and expenses above the amount", FeeSchedule{Revenue: Fee{Fixed: 60}, Expenses: Fee{Fixed: 41}}, 100, 0, 0, true},
+		// each fee is rounded up, together they take more than the amount
+		{"rounding above the amount", FeeSchedule{Revenue: Fee{BasisPoints: 5000}, Expenses: Fee{BasisPoints: 5000}}, 1, 0, 0, true},
+		{"fixed fee overflowing", FeeSchedule{Revenue: Fee{BasisPoints: basisPointsPerUnit, Fixed: math.MaxInt64}}, 100, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revenue, expenses, err := tt.schedule.fees(tt.amount)
+			if tt.wantErr {
+				if e, ok := err.(*Error); !ok || e.Code != errorCodeInvalidAmount {
+					t.Errorf("got %d, %d, %v, want an %s error", revenue, expenses, err, errorCodeInvalidAmount)
+				}
+				return
+			}
+			if err != nil || revenue != tt.wantRevenue || expenses != tt.wantExpenses {
+				t.Errorf("got %d, %d, %v, want %d, %d", revenue, expenses, err, tt.wantRevenue, tt.wantExpenses)
+			}
+		})
+	}
+}
+
+func TestSetMerchantFeesInvalid(t *testing.T) {
+	_, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	for name, body := range map[string]string{
+		"basis points above 100%":  `{"revenue": {"basis_points": 10001}}`,
+		"negative basis points":    `{"expenses": {"basis_points": -1}}`,
+		"negative fixed":           `{"revenue": {"fixed": "-1"}}`,
+		"tier at zero":             `{"revenue": {"tiers": [{"min_amount": "0", "basis_points": 100}]}}`,
+		"tiers out of order":       `{"revenue": {"tiers": [{"min_amount": "5000"}, {"min_amount": "1000"}]}}`,
+		"negative fixed of a tier": `{"revenue": {"tiers": [{"min_amount": "1000", "fixed": "-1"}]}}`,
+		"unknown field":            `{"revenue": {"percent": 5}}`,
+	} {
+		if status, res := do(t, h, http.MethodPut, "/merchants/"+merchant+"/fees", body); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d %v, want %d", name, status, res, http.StatusBadRequest)
+		}
+	}
+	if status, res := do(t, h, http.MethodPut, "/merchants/merchant:missing/fees", `{}`); status != http.StatusNotFound {
+		t.Errorf("missing merchant: got %d %v, want %d", status, res, http.StatusNotFound)
+	}
+}
+
+func TestMerchantFees(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	setFees := func(revenueBasisPoints int) map[string]interface{} {
+		t.Helper()
+		status, res := do(t, h, http.MethodPut, "/merchants/"+merchant+"/fees", map[string]interface{}{
+			"revenue":  map[string]interface{}{"basis_points": revenueBasisPoints},
+			"expenses": map[string]interface{}{"basis_points": 290, "fixed": "30"},
+		})
+		if status != http.StatusOK {
+			t.Fatalf("setting fees: got %d %v", status, res)
+		}
+		return res
+	}
+	purchase := func() map[string]interface{} {
+		t.Helper()
+		status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "alice", "merchant_id": merchant, "amount": "1000"})
+		if status != http.StatusOK {
+			t.Fatalf("purchasing card: got %d %v", status, res)
+		}
+		return res
+	}
+
+	if status, res := do(t, h, http.MethodGet, "/merchants/"+merchant+"/fees", nil); status != http.StatusNotFound || errorCode(res) != string(errorCodeFeeScheduleNotFound) {
+		t.Errorf("fees of a merchant without a schedule: got %d %v", status, res)
+	}
+
+	res := setFees(1000)
+	feeTxids := []int64{int64(res["txid"].(float64))}
+	if version := res["fee_schedule"].(map[string]interface{})["version"]; version != float64(1) {
+		t.Errorf("first version: got %v, want 1", version)
+	}
+	first := purchase()
+	if got := transactionMetadata(t, first)[feeScheduleVersionKey]; got != float64(1) {
+		t.Errorf("fee_schedule_version of the purchase: got %v, want 1", got)
+	}
+	// 10% of 1000 is revenue, 2.9% + 30 expenses
+	if got := balance(t, s, revenueAccountName, "USD/2"); got != 100 {
+		t.Errorf("revenue balance: got %d, want 100", got)
+	}
+	if got := balance(t, s, expensesAccountName, "USD/2"); got != 59 {
+		t.Errorf("expenses balance: got %d, want 59", got)
+	}
+	card := transactionMetadata(t, first)[cardIdKey].(string)
+	if got := balance(t, s, card, "USD/2"); got != 900 {
+		t.Errorf("card balance: got %d, want 900", got)
+	}
+
+	// revenue_take and expenses come from the schedule only
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "bob", "merchant_id": merchant, "amount": "1000", "revenue_take": "10"})
+	if status != http.StatusBadRequest {
+		t.Errorf("purchasing with a revenue_take: got %d %v, want %d", status, res, http.StatusBadRequest)
+	}
+
+	res = setFees(500)
+	feeTxids = append(feeTxids, int64(res["txid"].(float64)))
+	if version := res["fee_schedule"].(map[string]interface{})["version"]; version != float64(2) {
+		t.Errorf("second version: got %v, want 2", version)
+	}
+	if got := transactionMetadata(t, purchase())[feeScheduleVersionKey]; got != float64(2) {
+		t.Errorf("fee_schedule_version of the purchase: got %v, want 2", got)
+	}
+	if got := balance(t, s, revenueAccountName, "USD/2"); got != 150 {
+		t.Errorf("revenue balance: got %d, want 150", got)
+	}
+
+	// the version recorded on the first purchase can still be read
+	for _, tt := range []struct {
+		query       string
+		wantVersion float64
+		wantRevenue float64
+	}{
+		{"", 2, 500},
+		{"?version=1", 1, 1000},
+		{"?version=2", 2, 500},
+	} {
+		status, res := do(t, h, http.MethodGet, "/merchants/"+merchant+"/fees"+tt.query, nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET fees%s: got %d %v", tt.query, status, res)
+		}
+		schedule := res["fee_schedule"].(map[string]interface{})
+		if schedule["version"] != tt.wantVersion || schedule["revenue"].(map[string]interface{})["basis_points"] != tt.wantRevenue || res["txid"] == nil {
+			t.Errorf("GET fees%s: got %v", tt.query, res)
+		}
+	}
+	for _, tt := range []struct {
+		query      string
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{"?version=3", http.StatusNotFound, errorCodeFeeScheduleNotFound},
+		{"?version=0", http.StatusBadRequest, errorCodeInvalidRequest},
+		{"?version=latest", http.StatusBadRequest, errorCodeInvalidRequest},
+	} {
+		status, res := do(t, h, http.MethodGet, "/merchants/"+merchant+"/fees"+tt.query, nil)
+		if status != tt.wantStatus || errorCode(res) != string(tt.wantCode) {
+			t.Errorf("GET fees%s: got %d %v, want %d %s", tt.query, status, res, tt.wantStatus, tt.wantCode)
+		}
+	}
+
+	// the schedules are left out of the history of the merchant, operators still list them
+	status, res = do(t, h, http.MethodGet, "/merchants/"+merchant, nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting merchant: got %d %v", status, res)
+	}
+	if txids := detailTxids(res["merchant"].(map[string]interface{})); len(txids) == 0 || containsTxid(txids, feeTxids...) {
+		t.Errorf("transactions of the merchant: got %v, want them without %v", txids, feeTxids)
+	}
+	s.auth = NewAuthenticator(testJWTSecret, []APIKey{
+		{Key: "operator-key", Principal: Principal{Subject: "ops", Role: roleOperator}},
+	})
+	h = s.NewRouter()
+	token := "Bearer " + signTestJWT(t, jwtClaims{Subject: "m", Role: roleMerchant, Account: merchant, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	status, res = do(t, h, http.MethodGet, "/transactions", nil, "Authorization", token)
+	if status != http.StatusOK {
+		t.Fatalf("listing transactions as the merchant: got %d %v", status, res)
+	}
+	var txids []int64
+	for _, txn := range res["transactions"].([]interface{}) {
+		txids = append(txids, int64(txn.(map[string]interface{})["txid"].(float64)))
+	}
+	if len(txids) != 3 || containsTxid(txids, feeTxids...) {
+		t.Errorf("transactions listed to the merchant: got %v, want 3 without %v", txids, feeTxids)
+	}
+	query := url.Values{"transaction_type": {string(merchantFeesTransaction)}, "merchant_id": {merchant}}
+	status, res = do(t, h, http.MethodGet, "/transactions?"+query.Encode(), nil, apiKeyHeader, "operator-key")
+	if status != http.StatusOK || len(res["transactions"].([]interface{})) != 2 {
+		t.Errorf("merchant_fees transactions listed to an operator: got %d %v, want 2", status, res)
+	}
+}
+
+// containsTxid reports whether txids holds any of want
+func containsTxid(txids []int64, want ...int64) bool {
+	for _, txid := range txids {
+		for _, w := range want {
+			if txid == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestSetMerchantFeesConcurrently(t *testing.T) {
+	_, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+
+	const updates = 8
+	codes := make([]int, updates)
+	responses := make([]map[string]interface{}, updates)
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], responses[i] = do(t, h, http.MethodPut, "/merchants/"+merchant+"/fees", map[string]interface{}{
+				"revenue": map[string]interface{}{"basis_points": 100 + i},
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// every version is set by one update only, and reads back as the schedule of that update
+	versions := make(map[float64]float64)
+	for i, code := range codes {
+		if code == http.StatusConflict {
+			if errorCode(responses[i]) != string(errorCodeConflict) {
+				t.Errorf("update %d: got %v, want %s", i, responses[i], errorCodeConflict)
+			}
+			continue
+		}
+		if code != http.StatusOK {
+			t.Fatalf("update %d: got %d %v", i, code, responses[i])
+		}
+		version := responses[i]["fee_schedule"].(map[string]interface{})["version"].(float64)
+		if _, ok := versions[version]; ok {
+			t.Fatalf("version %v set twice", version)
+		}
+		versions[version] = float64(100 + i)
+	}
+	if len(versions) == 0 {
+		t.Fatalf("no update succeeded: %v", codes)
+	}
+	for version, basisPoints := range versions {
+		status, res := do(t, h, http.MethodGet, fmt.Sprintf("/merchants/%s/fees?version=%v", merchant, version), nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET version %v: got %d %v", version, status, res)
+		}
+		if got := res["fee_schedule"].(map[string]interface{})["revenue"].(map[string]interface{})["basis_points"]; got != basisPoints {
+			t.Errorf("version %v: got basis points %v, want %v", version, got, basisPoints)
+		}
+	}
+}
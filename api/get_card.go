@@ -0,0 +1,23 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+type GetCardResponse struct {
+	Card *AccountDetail `json:"card"`
+}
+
+// GetCard returns a card, its volumes and its transactions, most recent first
+func (s *Server) GetCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	card, err := s.accountDetail(ctx, r, mux.Vars(r)["address"], "cards:")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(ctx, w, GetCardResponse{
+		Card: card,
+	})
+}
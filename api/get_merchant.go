@@ -0,0 +1,70 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
+	"net/http"
+)
+
+type GetMerchantResponse struct {
+	Merchant *AccountDetail `json:"merchant"`
+	// every card issued for the merchant
+	Cards []CardBalance `json:"cards"`
+}
+
+// CardBalance is the outstanding balance of a card issued for a merchant
+type CardBalance struct {
+	Address   string `json:"address"`
+	Name      string `json:"name"`
+	Asset     string `json:"asset"`
+	Balance   int64  `json:"balance"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// GetMerchant returns a merchant, its volumes and its transactions, most recent first, along with the
+// cards issued for it
+func (s *Server) GetMerchant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	address := mux.Vars(r)["address"]
+	merchant, err := s.accountDetail(ctx, r, address, "merchant:")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	issued, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{
+		AddressPrefix: "cards:",
+		Metadata:      map[string]string{merchantIdKey: address},
+	})
+	if err != nil {
+		writeError(w, errLedger(err, "error listing ledger accounts"))
+		return
+	}
+	// only the balances of its cards are read, without any address ListBalances would read the whole ledger
+	balances := make(map[string]map[string]int64)
+	if len(issued) > 0 {
+		addresses := make([]string, len(issued))
+		for i, acct := range issued {
+			addresses[i] = acct.Address
+		}
+		if balances, err = s.ledger.ListBalances(ctx, addresses...); err != nil {
+			writeError(w, errLedger(err, "error listing ledger balances"))
+			return
+		}
+	}
+	cards := make([]CardBalance, 0, len(issued))
+	for _, acct := range issued {
+		asset := accountAsset(acct.Metadata)
+		cards = append(cards, CardBalance{
+			Address:   acct.Address,
+			Name:      metadataValue(acct.Metadata, nameKey),
+			Asset:     asset,
+			Balance:   balances[acct.Address][asset],
+			ExpiresAt: metadataValue(acct.Metadata, expiresAtKey),
+		})
+	}
+	writeJSON(ctx, w, GetMerchantResponse{
+		Merchant: merchant,
+		Cards:    cards,
+	})
+}
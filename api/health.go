@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"magic-ledger/ledger"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the checks of /readyz, a probe is better failed than left hanging
+const readinessTimeout = 5 * time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Checks maps the name of every check to ok, or to the reason it failed
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz answers as long as the server is able to serve requests, it checks no dependency so a ledger
+// outage doesn't get the server restarted
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	res := HealthResponse{Status: "ok"}
+	// reported for visibility only, an open circuit is no reason to restart the server
+	if check, ok := s.breakerCheck(); ok {
+		res.Checks = map[string]string{"ledger_circuit_breaker": check}
+	}
+	writeJSON(r.Context(), w, res)
+}
+
+// breakerCheck describes the state of the ledger circuit breaker, ok is false when there is none
+func (s *Server) breakerCheck() (check string, ok bool) {
+	if s.ledgerBreaker == nil {
+		return "", false
+	}
+	state, openedAt := s.ledgerBreaker.State()
+	if state == ledger.CircuitClosed {
+		return "ok", true
+	}
+	return fmt.Sprintf("%s since %s", state, openedAt.UTC().Format(time.RFC3339)), true
+}
+
+// Readyz answers with a 503 until the ledger is reachable and the internal accounts were created
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	res := HealthResponse{
+		Status: "ready",
+		Checks: map[string]string{
+			"ledger":            "ok",
+			"internal_accounts": "ok",
+		},
+	}
+	if _, err := s.ledger.GetAccount(ctx, worldAccountName); err != nil {
+		res.Checks["ledger"] = err.Error()
+		res.Checks["internal_accounts"] = "skipped, the ledger is unreachable"
+	} else if err = s.checkInternalAccounts(ctx); err != nil {
+		res.Checks["internal_accounts"] = err.Error()
+	}
+	// read after the probe, which is the trial call closing a circuit whose open timeout has elapsed
+	if check, ok := s.breakerCheck(); ok {
+		res.Checks["ledger_circuit_breaker"] = check
+	}
+	status := http.StatusOK
+	for _, check := range res.Checks {
+		if check != "ok" {
+			res.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
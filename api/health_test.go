@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unreachableLedger fails every GetAccount while down is set
+type unreachableLedger struct {
+	*ledger.Memory
+	down atomic.Bool
+}
+
+func (l *unreachableLedger) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	if l.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return l.Memory.GetAccount(ctx, address)
+}
+
+func TestReadyzClosesTheCircuit(t *testing.T) {
+	ctx := context.Background()
+	backend := &unreachableLedger{Memory: ledger.NewMemory()}
+	breaker := ledger.NewCircuitBreaker(1, time.Millisecond)
+	s := NewServer(ledger.NewResilient(backend, ledger.RetryOptions{MaxAttempts: 1}, breaker), Options{LedgerBreaker: breaker})
+	if err := s.InitializeInternalAccounts(ctx); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	h := s.NewRouter()
+
+	backend.down.Store(true)
+	status, res := do(t, h, http.MethodGet, "/readyz", nil)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with the ledger down: got %d %v", status, res)
+	}
+	if state, _ := breaker.State(); state != ledger.CircuitOpen {
+		t.Fatalf("circuit with the ledger down: got %s, want %s", state, ledger.CircuitOpen)
+	}
+
+	// the probe once the open timeout has elapsed is the trial closing the circuit, it is reported closed
+	backend.down.Store(false)
+	time.Sleep(5 * time.Millisecond)
+	status, res = do(t, h, http.MethodGet, "/readyz", nil)
+	if status != http.StatusOK || res["checks"].(map[string]interface{})["ledger_circuit_breaker"] != "ok" {
+		t.Errorf("readyz once the ledger is back: got %d %v, want %d with a closed circuit", status, res, http.StatusOK)
+	}
+}
+
+func TestLedgerUnavailable(t *testing.T) {
+	ctx := context.Background()
+	backend := &unreachableLedger{Memory: ledger.NewMemory()}
+	breaker := ledger.NewCircuitBreaker(1, time.Hour)
+	s := NewServer(ledger.NewResilient(backend, ledger.RetryOptions{MaxAttempts: 1}, breaker), Options{LedgerBreaker: breaker})
+	if err := s.InitializeInternalAccounts(ctx); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	h := s.NewRouter()
+
+	// the failure opens the circuit, the next request fails fast
+	backend.down.Store(true)
+	if status, res := do(t, h, http.MethodGet, "/cards/cards:a", nil); status == http.StatusOK {
+		t.Fatalf("getting a card with the ledger down: got %d %v", status, res)
+	}
+	status, res := do(t, h, http.MethodGet, "/cards/cards:a", nil)
+	if status != http.StatusServiceUnavailable || errorCode(res) != string(errorCodeLedgerUnavailable) {
+		t.Errorf("getting a card with the circuit open: got %d %v, want %d %s", status, res, http.StatusServiceUnavailable, errorCodeLedgerUnavailable)
+	}
+}
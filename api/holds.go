@@ -0,0 +1,476 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/google/uuid"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	voidReasonVoided  = "voided"
+	voidReasonExpired = "expired"
+)
+
+type AuthorizeCardRequest struct {
+	CardAddress *string `json:"card_address"`
+
+	// the amount authorized
+	Amount *int64 `json:"amount,string"`
+}
+
+type AuthorizeCardResponse struct {
+	// HoldId is the address of the account holding the authorized amount, it is captured or voided by id
+	HoldId string `json:"hold_id"`
+	// ExpiresAt is when the held amount is released back to the card unless it was captured
+	ExpiresAt   time.Time   `json:"expires_at"`
+	Transaction interface{} `json:"transaction"`
+}
+
+type CaptureCardRequest struct {
+	HoldId *string `json:"hold_id"`
+
+	// the amount captured, the whole held amount if unset. the rest is released back to the card
+	Amount *int64 `json:"amount,string,omitempty"`
+}
+
+type VoidCardRequest struct {
+	HoldId *string `json:"hold_id"`
+}
+
+type HoldTransactionResponse struct {
+	Transaction interface{} `json:"transaction"`
+}
+
+// hold is the amount authorized on a card, held in its own account until it is captured or released
+type hold struct {
+	id        string
+	card      string
+	merchant  string
+	asset     string
+	expiresAt time.Time
+	// held is what the hold account still holds, 0 once it was captured or released
+	held int64
+}
+
+// AuthorizeCard moves the authorized amount from the card to a new hold account, so it can't be spent
+// while the merchant settles the purchase
+func (s *Server) AuthorizeCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req AuthorizeCardRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode AuthorizeCard request: %s", err.Error()))
+		return
+	}
+	logger.Debug(ctx, "got AuthorizeCard request", "request", req)
+
+	if req.CardAddress == nil || req.Amount == nil {
+		writeError(w, errInvalidRequest("cardAddress and amount cannot be null"))
+		return
+	}
+	if err := validateAmount(*req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, previous, err := s.authorizedReplay(r, *req.CardAddress, authorizeCardTransaction, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if previous != nil {
+		s.writeAuthorization(w, r, previous)
+		return
+	}
+	account, err := s.ledger.GetAccount(ctx, *req.CardAddress)
+	if err != nil {
+		writeError(w, errLedger(err, "error getting ledger account"))
+		return
+	}
+	if account == nil || !strings.HasPrefix(*req.CardAddress, "cards:") {
+		writeError(w, errAccountNotFound(*req.CardAddress))
+		return
+	}
+	merchantId, ok := account.Metadata[merchantIdKey]
+	if !ok {
+		writeError(w, errInvalidRequest("no merchant id associated with account address: %s", *req.CardAddress))
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.holdExpiry)
+	if cardExpiresAt, ok, err := cardExpiry(account.Metadata); err != nil {
+		writeError(w, newError(http.StatusInternalServerError, errorCodeInternal, "invalid expiry on card %s: %s", *req.CardAddress, err.Error()))
+		return
+	} else if ok && !cardExpiresAt.After(now) {
+		writeError(w, newError(http.StatusBadRequest, errorCodeCardExpired, "card %s has expired", *req.CardAddress))
+		return
+	} else if ok && cardExpiresAt.Before(expiresAt) {
+		// a hold never outlives its card, what it still holds then goes back to the card for breakage
+		expiresAt = cardExpiresAt
+	}
+	asset := accountAsset(account.Metadata)
+	if err := validateBalance(account, asset, *req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	holdId := fmt.Sprintf("holds:%s", strings.Replace(uuid.NewString(), "-", "", -1))
+	// the transaction carries the metadata of the hold, see createdAccount
+	metadata := map[string]interface{}{
+		transactionTypeKey: authorizeCardTransaction,
+		holdIdKey:          holdId,
+		cardIdKey:          *req.CardAddress,
+		merchantIdKey:      merchantId,
+		assetKey:           asset,
+		expiresAtKey:       expiresAt.UTC().Format(time.RFC3339),
+	}
+	// see templates/authorize_card.num
+	script, err := templateScript(string(authorizeCardTransaction), map[string]interface{}{
+		"card":   *req.CardAddress,
+		"hold":   holdId,
+		"amount": ledger.Monetary{Asset: asset, Amount: *req.Amount},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	txn, replayed, err := s.createFromScript(ctx, key, metadata, script)
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	if replayed {
+		s.writeAuthorization(w, r, txn)
+		return
+	}
+	if err = s.addCreatedAccountMetadata(ctx, txn); err != nil {
+		writeError(w, errLedger(err, "error adding metadata to account %s", holdId))
+		return
+	}
+	s.writeAuthorization(w, r, txn)
+}
+
+// writeAuthorization answers with the hold created by txn, adding its metadata to the hold account first if
+// it is missing
+func (s *Server) writeAuthorization(w http.ResponseWriter, r *http.Request, txn *shared.Transaction) {
+	ctx := r.Context()
+	if err := s.reconcileAccount(detach(ctx), txn); err != nil {
+		writeError(w, errLedger(err, "error reconciling hold account"))
+		return
+	}
+	expiresAt, _ := time.Parse(time.RFC3339, metadataValue(txn.Metadata, expiresAtKey))
+	writeJSON(ctx, w, AuthorizeCardResponse{
+		HoldId:      metadataValue(txn.Metadata, holdIdKey),
+		ExpiresAt:   expiresAt,
+		Transaction: txn,
+	})
+}
+
+// CaptureCard moves all or part of a hold to the merchant of the card, the rest is released back to the card.
+// a hold is captured at most once, capturing it again returns the transaction of its capture.
+func (s *Server) CaptureCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req CaptureCardRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode CaptureCard request: %s", err.Error()))
+		return
+	}
+	if req.HoldId == nil {
+		writeError(w, errInvalidRequest("holdId cannot be null"))
+		return
+	}
+	if req.Amount != nil {
+		if err := validateAmount(*req.Amount); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	h, err := s.activeHold(ctx, r, *req.HoldId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h == nil {
+		s.writeHoldReleased(w, r, *req.HoldId, captureCardTransaction)
+		return
+	}
+	if !h.expiresAt.After(time.Now()) {
+		writeError(w, newError(http.StatusConflict, errorCodeHoldExpired, "hold %s expired at %s", h.id, h.expiresAt.Format(time.RFC3339)))
+		return
+	}
+	captured := h.held
+	if req.Amount != nil {
+		if *req.Amount > h.held {
+			writeError(w, newError(http.StatusBadRequest, errorCodeInvalidAmount, "cannot capture %d, hold %s holds %d", *req.Amount, h.id, h.held))
+			return
+		}
+		captured = *req.Amount
+	}
+
+	metadata := map[string]interface{}{
+		transactionTypeKey: captureCardTransaction,
+		holdIdKey:          h.id,
+		cardIdKey:          h.card,
+		merchantIdKey:      h.merchant,
+		purchaseIdKey:      fmt.Sprintf("purchase:%s", strings.Replace(uuid.NewString(), "-", "", -1)),
+		assetKey:           h.asset,
+	}
+	// see templates/capture_card.num
+	script, err := templateScript(string(captureCardTransaction), map[string]interface{}{
+		"hold":     h.id,
+		"card":     h.card,
+		"merchant": h.merchant,
+		"held":     ledger.Monetary{Asset: h.asset, Amount: h.held},
+		"captured": ledger.Monetary{Asset: h.asset, Amount: captured},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	txn, err := s.postScript(ctx, metadata, script, fmt.Sprintf("%s:%s", captureCardTransaction, h.id))
+	// the hold was captured concurrently, or emptied by a concurrent void or expiry
+	if errors.Is(err, ledger.ErrDuplicateReference) || errors.Is(err, ledger.ErrInsufficientFunds) {
+		s.writeHoldReleased(w, r, h.id, captureCardTransaction)
+		return
+	}
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	s.markHoldReleased(ctx, h.id, txn.Timestamp)
+	writeJSON(ctx, w, HoldTransactionResponse{Transaction: txn})
+}
+
+// VoidCard releases a hold back to the card. a hold is voided at most once, voiding it again returns the
+// transaction that released it.
+func (s *Server) VoidCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req VoidCardRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode VoidCard request: %s", err.Error()))
+		return
+	}
+	if req.HoldId == nil {
+		writeError(w, errInvalidRequest("holdId cannot be null"))
+		return
+	}
+	h, err := s.activeHold(ctx, r, *req.HoldId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h == nil {
+		s.writeHoldReleased(w, r, *req.HoldId, voidCardTransaction)
+		return
+	}
+	txn, err := s.releaseHold(ctx, *h, voidReasonVoided)
+	// the hold was voided or expired concurrently, or emptied by a concurrent capture
+	if errors.Is(err, ledger.ErrDuplicateReference) || errors.Is(err, ledger.ErrInsufficientFunds) {
+		s.writeHoldReleased(w, r, h.id, voidCardTransaction)
+		return
+	}
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	writeJSON(ctx, w, HoldTransactionResponse{Transaction: txn})
+}
+
+// activeHold returns the hold at address once the principal is checked to act for its merchant, nil if it
+// holds nothing anymore. it fails with hold_not_found unless an authorize_card transaction created it.
+func (s *Server) activeHold(ctx context.Context, r *http.Request, address string) (*hold, error) {
+	h, err := s.findHold(ctx, address)
+	if err != nil {
+		return nil, errLedger(err, "error finding hold")
+	}
+	if h == nil {
+		return nil, newError(http.StatusNotFound, errorCodeHoldNotFound, "no hold with id %s", address)
+	}
+	if err = s.authorizeAccount(ctx, r, h.merchant); err != nil {
+		return nil, err
+	}
+	if h.held <= 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// writeHoldReleased answers a capture or a void of a hold that holds nothing anymore with the transaction of
+// txnType that released it, or a hold_released error if the hold was released otherwise
+func (s *Server) writeHoldReleased(w http.ResponseWriter, r *http.Request, address string, txnType TransactionType) {
+	ctx := r.Context()
+	txn, err := s.ledger.GetTransactionByReference(ctx, fmt.Sprintf("%s:%s", txnType, address))
+	if err != nil {
+		writeError(w, errLedger(err, "error looking up hold transaction"))
+		return
+	}
+	if txn == nil {
+		writeError(w, newError(http.StatusConflict, errorCodeHoldReleased, "hold %s was already captured, voided or expired", address))
+		return
+	}
+	writeJSON(ctx, w, HoldTransactionResponse{Transaction: txn})
+}
+
+// releaseHold sends what h holds back to its card, see templates/void_card.num. it is posted with the
+// reference void_card:{hold}, so a hold voided and expired concurrently is only released once. the hold is
+// marked released once posted.
+func (s *Server) releaseHold(ctx context.Context, h hold, reason string) (*shared.Transaction, error) {
+	script, err := templateScript(string(voidCardTransaction), map[string]interface{}{
+		"hold": h.id,
+		"card": h.card,
+		"held": ledger.Monetary{Asset: h.asset, Amount: h.held},
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]interface{}{
+		transactionTypeKey: voidCardTransaction,
+		holdIdKey:          h.id,
+		cardIdKey:          h.card,
+		merchantIdKey:      h.merchant,
+		assetKey:           h.asset,
+		voidReasonKey:      reason,
+	}
+	txn, err := s.postScript(ctx, metadata, script, fmt.Sprintf("%s:%s", voidCardTransaction, h.id))
+	if err != nil {
+		return nil, err
+	}
+	s.markHoldReleased(ctx, h.id, txn.Timestamp)
+	return txn, nil
+}
+
+// markHoldReleased records in the released_at metadata of the hold account when it was captured, voided or
+// expired, so ExpireHolds skips it without reading it. the hold is released either way, a failure is only
+// logged and the next ExpireHolds run marks it.
+func (s *Server) markHoldReleased(ctx context.Context, address string, at time.Time) {
+	err := s.ledger.AddMetaDataToAccount(detach(ctx), address, map[string]interface{}{releasedAtKey: at.UTC().Format(time.RFC3339)})
+	if err != nil {
+		logger.Error(ctx, err, "error marking hold released", "hold_id", address)
+	}
+}
+
+// findHold reads the hold at address from the transaction that created it, nil if no authorization did
+func (s *Server) findHold(ctx context.Context, address string) (*hold, error) {
+	if !strings.HasPrefix(address, "holds:") {
+		return nil, nil
+	}
+	origin, err := s.findAuthorization(ctx, address)
+	if err != nil || origin == nil {
+		return nil, err
+	}
+	h := &hold{
+		id:       address,
+		card:     metadataValue(origin.Metadata, cardIdKey),
+		merchant: metadataValue(origin.Metadata, merchantIdKey),
+		asset:    metadataValue(origin.Metadata, assetKey),
+	}
+	if h.expiresAt, err = time.Parse(time.RFC3339, metadataValue(origin.Metadata, expiresAtKey)); err != nil {
+		return nil, fmt.Errorf("invalid expiry on hold %s: %w", address, err)
+	}
+	balances, err := s.ledger.GetAccount(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if balances != nil {
+		if balance, ok := balances.Balances[h.asset]; ok && balance != nil {
+			h.held = balance.Int64()
+		}
+	}
+	return h, nil
+}
+
+// findAuthorization returns the authorize_card transaction that created hold, nil if there is none
+func (s *Server) findAuthorization(ctx context.Context, hold string) (*shared.Transaction, error) {
+	authorizations, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{
+			transactionTypeKey: string(authorizeCardTransaction),
+			holdIdKey:          hold,
+		},
+	}, ledger.Page{PageSize: 1})
+	if err != nil || len(authorizations.Transactions) == 0 {
+		return nil, err
+	}
+	return &authorizations.Transactions[0], nil
+}
+
+// ScheduleHoldExpiry releases the holds past their expiry every interval until ctx is done
+func (s *Server) ScheduleHoldExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.ExpireHolds(ctx, now); err != nil {
+				logger.Error(ctx, err, "error releasing expired holds")
+			}
+		}
+	}
+}
+
+// ExpireHolds releases back to their card the holds that expired before now without being captured. only the
+// holds: accounts are listed, and those already released or whose expires_at metadata is still ahead are skipped
+// without reading them.
+func (s *Server) ExpireHolds(ctx context.Context, now time.Time) error {
+	accounts, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{AddressPrefix: "holds:"})
+	if err != nil {
+		return err
+	}
+	for _, acct := range accounts {
+		if metadataValue(acct.Metadata, releasedAtKey) != "" {
+			continue
+		}
+		// an account missing its metadata is read from its authorization
+		if expiresAt, err := time.Parse(time.RFC3339, metadataValue(acct.Metadata, expiresAtKey)); err == nil && expiresAt.After(now) {
+			continue
+		}
+		h, err := s.findHold(ctx, acct.Address)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			continue
+		}
+		if h.held <= 0 {
+			// released before holds were marked, or marking it failed
+			s.markHoldReleased(ctx, h.id, now)
+			continue
+		}
+		if h.expiresAt.After(now) {
+			continue
+		}
+		_, err = s.releaseHold(ctx, *h, voidReasonExpired)
+		// voided or captured meanwhile
+		if errors.Is(err, ledger.ErrDuplicateReference) || errors.Is(err, ledger.ErrInsufficientFunds) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info(ctx, "expired hold released",
+			"hold_id", h.id,
+			"card_id", h.card,
+			"expires_at", h.expiresAt,
+			"amount", h.held,
+			"asset", h.asset,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHoldsTestServer is newTestServer with holds lasting a week
+func newHoldsTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s, _ := newTestServer(t)
+	s.holdExpiry = 7 * 24 * time.Hour
+	return s, s.NewRouter()
+}
+
+// authorizeTestCard authorizes amount on card, returning the hold id and its expiry
+func authorizeTestCard(t *testing.T, h http.Handler, card string, amount string) (string, time.Time) {
+	t.Helper()
+	status, res := do(t, h, http.MethodPost, "/card/authorize", map[string]string{"card_address": card, "amount": amount})
+	if status != http.StatusOK {
+		t.Fatalf("authorizing card: got %d %v", status, res)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, res["expires_at"].(string))
+	if err != nil {
+		t.Fatalf("parsing expires_at: %v", err)
+	}
+	return res["hold_id"].(string), expiresAt
+}
+
+func TestAuthorizeCardExpiry(t *testing.T) {
+	ctx := context.Background()
+	s, h := newHoldsTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+
+	_, expiresAt := authorizeTestCard(t, h, card, "100")
+	if want := time.Now().Add(s.holdExpiry); expiresAt.Before(want.Add(-time.Minute)) || expiresAt.After(want) {
+		t.Errorf("expires_at of a hold: got %s, want about %s", expiresAt, want)
+	}
+
+	// a card expiring first caps the expiry of its holds
+	cardExpiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := s.ledger.AddMetaDataToAccount(ctx, card, map[string]interface{}{expiresAtKey: cardExpiresAt.Format(time.RFC3339)}); err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+	_, expiresAt = authorizeTestCard(t, h, card, "100")
+	if !expiresAt.Equal(cardExpiresAt) {
+		t.Errorf("expires_at of a hold on an expiring card: got %s, want %s", expiresAt, cardExpiresAt)
+	}
+
+	if err := s.ledger.AddMetaDataToAccount(ctx, card, map[string]interface{}{expiresAtKey: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}); err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+	status, res := do(t, h, http.MethodPost, "/card/authorize", map[string]string{"card_address": card, "amount": "100"})
+	if status != http.StatusBadRequest || errorCode(res) != string(errorCodeCardExpired) {
+		t.Errorf("authorizing an expired card: got %d %v, want %d %s", status, res, http.StatusBadRequest, errorCodeCardExpired)
+	}
+}
+
+func TestExpireHolds(t *testing.T) {
+	ctx := context.Background()
+	s, h := newHoldsTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+	expiring, expiresAt := authorizeTestCard(t, h, card, "300")
+	captured, _ := authorizeTestCard(t, h, card, "200")
+	if status, res := do(t, h, http.MethodPost, "/card/capture", map[string]string{"hold_id": captured}); status != http.StatusOK {
+		t.Fatalf("capturing hold: got %d %v", status, res)
+	}
+
+	if err := s.ExpireHolds(ctx, expiresAt.Add(-time.Minute)); err != nil {
+		t.Fatalf("ExpireHolds before the expiry: %v", err)
+	}
+	if got := balance(t, s, expiring, "USD/2"); got != 300 {
+		t.Fatalf("hold balance before its expiry: got %d, want 300", got)
+	}
+
+	if err := s.ExpireHolds(ctx, expiresAt.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireHolds: %v", err)
+	}
+	if got := balance(t, s, expiring, "USD/2"); got != 0 {
+		t.Errorf("hold balance after its expiry: got %d, want 0", got)
+	}
+	if got := balance(t, s, card, "USD/2"); got != 800 {
+		t.Errorf("card balance after the expiry: got %d, want 800", got)
+	}
+	txn, err := s.ledger.GetTransactionByReference(ctx, "void_card:"+expiring)
+	if err != nil || txn == nil || metadataValue(txn.Metadata, voidReasonKey) != voidReasonExpired {
+		t.Errorf("release of the expired hold: got %v, %v", txn, err)
+	}
+	// a second run finds nothing to release
+	if err := s.ExpireHolds(ctx, expiresAt.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireHolds again: %v", err)
+	}
+}
+
+// holdReadsLedger counts the hold accounts read
+type holdReadsLedger struct {
+	*metadataFailingLedger
+	reads atomic.Int64
+}
+
+func (l *holdReadsLedger) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	if strings.HasPrefix(address, "holds:") {
+		l.reads.Add(1)
+	}
+	return l.metadataFailingLedger.GetAccount(ctx, address)
+}
+
+func TestExpireHoldsSkipsReleased(t *testing.T) {
+	ctx := context.Background()
+	backend := &holdReadsLedger{metadataFailingLedger: &metadataFailingLedger{Memory: ledger.NewMemory()}}
+	s := NewServer(backend, Options{})
+	if err := s.InitializeInternalAccounts(ctx); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	s.holdExpiry = 7 * 24 * time.Hour
+	h := s.NewRouter()
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+	expiring, expiresAt := authorizeTestCard(t, h, card, "300")
+	captured, _ := authorizeTestCard(t, h, card, "200")
+	voided, _ := authorizeTestCard(t, h, card, "100")
+	if status, res := do(t, h, http.MethodPost, "/card/capture", map[string]string{"hold_id": captured}); status != http.StatusOK {
+		t.Fatalf("capturing hold: got %d %v", status, res)
+	}
+	// the void is posted but marking the hold fails
+	backend.failing.Store(true)
+	status, res := do(t, h, http.MethodPost, "/card/void", map[string]string{"hold_id": voided})
+	backend.failing.Store(false)
+	if status != http.StatusOK {
+		t.Fatalf("voiding hold: got %d %v", status, res)
+	}
+	releasedAt := func(hold string) string {
+		t.Helper()
+		account, err := s.ledger.GetAccount(ctx, hold)
+		if err != nil || account == nil {
+			t.Fatalf("getting hold %s: got %v, %v", hold, account, err)
+		}
+		return metadataValue(account.Metadata, releasedAtKey)
+	}
+	if releasedAt(captured) == "" {
+		t.Errorf("captured hold is not marked released")
+	}
+	if releasedAt(voided) != "" {
+		t.Fatalf("voided hold is marked released though marking it failed")
+	}
+
+	// the expired hold is released and marked, so is the voided one
+	if err := s.ExpireHolds(ctx, expiresAt.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireHolds: %v", err)
+	}
+	for _, hold := range []string{expiring, voided} {
+		if releasedAt(hold) == "" {
+			t.Errorf("hold %s is not marked released after ExpireHolds", hold)
+		}
+	}
+	if got := balance(t, s, card, "USD/2"); got != 800 {
+		t.Errorf("card balance: got %d, want 800", got)
+	}
+
+	// every hold is released, the next run reads none of them
+	backend.reads.Store(0)
+	if err := s.ExpireHolds(ctx, expiresAt.Add(time.Hour)); err != nil {
+		t.Fatalf("ExpireHolds again: %v", err)
+	}
+	if got := backend.reads.Load(); got != 0 {
+		t.Errorf("holds read by a run with every hold released: got %d, want 0", got)
+	}
+}
+
+func TestBreakageReleasesExpiredHolds(t *testing.T) {
+	ctx := context.Background()
+	s, h := newHoldsTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+	cardExpiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := s.ledger.AddMetaDataToAccount(ctx, card, map[string]interface{}{expiresAtKey: cardExpiresAt.Format(time.RFC3339)}); err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+	hold, _ := authorizeTestCard(t, h, card, "300")
+
+	// the hold expires with the card, what it held is recognized with the rest of the card
+	breakage, err := s.RecognizeBreakage(ctx, cardExpiresAt.Add(time.Minute), false)
+	if err != nil || len(breakage) != 1 || breakage[0].Amount != 1000 {
+		t.Fatalf("breakage: got %+v, %v, want 1000 recognized", breakage, err)
+	}
+	if got := balance(t, s, hold, "USD/2"); got != 0 {
+		t.Errorf("hold balance: got %d, want 0", got)
+	}
+	if got := balance(t, s, card, "USD/2"); got != 0 {
+		t.Errorf("card balance: got %d, want 0", got)
+	}
+}
+
+func TestCaptureAndVoidConcurrently(t *testing.T) {
+	s, h := newHoldsTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+	hold, _ := authorizeTestCard(t, h, card, "300")
+
+	paths := []string{"/card/capture", "/card/void", "/card/capture", "/card/void"}
+	results := make([]map[string]interface{}, len(paths))
+	codes := make([]int, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			codes[i], results[i] = do(t, h, http.MethodPost, path, map[string]string{"hold_id": hold})
+		}(i, path)
+	}
+	wg.Wait()
+
+	// the requests of the winning kind return its transaction, the others find the hold released
+	released := int64(-1)
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			txid := int64(results[i]["transaction"].(map[string]interface{})["txid"].(float64))
+			if released < 0 {
+				released = txid
+			} else if released != txid {
+				t.Errorf("%s: got transaction %d, want %d", paths[i], txid, released)
+			}
+		case http.StatusConflict:
+			if errorCode(results[i]) != string(errorCodeHoldReleased) {
+				t.Errorf("%s: got code %s, want %s", paths[i], errorCode(results[i]), errorCodeHoldReleased)
+			}
+		default:
+			t.Errorf("%s: got %d %v, want %d or %d", paths[i], code, results[i], http.StatusOK, http.StatusConflict)
+		}
+	}
+	if released < 0 {
+		t.Fatalf("no request released the hold: %v", codes)
+	}
+	if got := balance(t, s, hold, "USD/2"); got != 0 {
+		t.Errorf("hold balance: got %d, want 0", got)
+	}
+	if got := balance(t, s, card, "USD/2") + balance(t, s, merchant, "USD/2"); got != 1000 {
+		t.Errorf("card and merchant balances: got %d, want 1000", got)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"net/http"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKey identifies a mutating request. The key is stored as the reference of the transaction
+// it creates and the hash of the request is stored in its metadata, so a retry can be matched back
+// to the original transaction.
+type idempotencyKey struct {
+	reference string
+	hash      string
+}
+
+// newIdempotencyKey reads the Idempotency-Key header of r. req is the decoded request body, it is
+// hashed together with the transaction type so the same key cannot be replayed against another endpoint.
+// the key is scoped by the principal of r, so the keys of a merchant never collide with the ones of another
+// merchant and a reused key only ever reveals a transaction of the same principal.
+func newIdempotencyKey(r *http.Request, txnType TransactionType, req interface{}) (idempotencyKey, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return idempotencyKey{}, nil
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return idempotencyKey{}, err
+	}
+	sum := sha256.Sum256(append([]byte(txnType+":"), body...))
+	return idempotencyKey{
+		reference: fmt.Sprintf("%s:%s%s", txnType, idempotencyScope(principalFrom(r.Context())), key),
+		hash:      hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// idempotencyScope prefixes the idempotency keys of principal. operators, who may act on every account, share
+// their keys, merchants and cardholders are scoped by their account. without auth there is no principal and
+// the keys are not scoped.
+func idempotencyScope(principal *Principal) string {
+	switch {
+	case principal == nil:
+		return ""
+	case principal.Role == roleOperator:
+		return fmt.Sprintf("%s:", roleOperator)
+	default:
+		return fmt.Sprintf("%s:%s:", principal.Role, principal.Account)
+	}
+}
+
+// addTo records the request hash in the metadata of the transaction about to be created
+func (k idempotencyKey) addTo(metadata map[string]interface{}) {
+	if k.reference != "" {
+		metadata[idempotencyHashKey] = k.hash
+	}
+}
+
+// replay returns the transaction previously created with key, or nil if the key was never used.
+// it fails with an idempotency_key_reused error if the key was used for a request with a different body.
+func (s *Server) replay(ctx context.Context, key idempotencyKey) (*shared.Transaction, error) {
+	if key.reference == "" {
+		return nil, nil
+	}
+	txn, err := s.ledger.GetTransactionByReference(ctx, key.reference)
+	if err != nil || txn == nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%v", txn.Metadata[idempotencyHashKey]) != key.hash {
+		e := newError(http.StatusConflict, errorCodeIdempotencyKeyReused, "idempotency key was already used for a different request")
+		e.Details = map[string]interface{}{"txid": txn.Txid}
+		return nil, e
+	}
+	return txn, nil
+}
+
+// authorizedReplay checks that the principal of r may act on address, then returns the idempotency key of r along
+// with the transaction it already created, nil if the key is new. the principal is authorized before the replay,
+// which would otherwise return the transaction of another account.
+func (s *Server) authorizedReplay(r *http.Request, address string, txnType TransactionType, req interface{}) (idempotencyKey, *shared.Transaction, error) {
+	ctx := r.Context()
+	if err := s.authorizeAccount(ctx, r, address); err != nil {
+		return idempotencyKey{}, nil, err
+	}
+	key, err := newIdempotencyKey(r, txnType, req)
+	if err != nil {
+		return idempotencyKey{}, nil, errInvalidRequest("unable to read idempotency key: %s", err.Error())
+	}
+	txn, err := s.replay(ctx, key)
+	if err != nil {
+		return idempotencyKey{}, nil, errLedger(err, "error looking up idempotent request")
+	}
+	return key, txn, nil
+}
+
+// createFromScript posts the transaction made by script under key. if a concurrent request with the same key
+// won the race, the transaction it created is returned instead and replayed is true.
+func (s *Server) createFromScript(ctx context.Context, key idempotencyKey, metadata map[string]interface{}, script ledger.Script) (txn *shared.Transaction, replayed bool, err error) {
+	return s.createIdempotent(ctx, key, metadata, func(reference string) (*shared.Transaction, error) {
+		return s.postScript(ctx, metadata, script, reference)
+	})
+}
+
+func (s *Server) createIdempotent(ctx context.Context, key idempotencyKey, metadata map[string]interface{}, post func(reference string) (*shared.Transaction, error)) (txn *shared.Transaction, replayed bool, err error) {
+	key.addTo(metadata)
+	txn, err = post(key.reference)
+	if errors.Is(err, ledger.ErrDuplicateReference) {
+		txn, err = s.replay(ctx, key)
+		return txn, true, err
+	}
+	return txn, false, err
+}
@@ -2,69 +2,98 @@ package api
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"magic-ledger/ledger"
 	"magic-ledger/logger"
 )
 
-func InitializeInternalAccounts() {
-	ctx := context.Background()
-	assetsAccount, err := ledger.GetAccount(ctx, assetsAccountName)
+// internalAccounts is the metadata of every internal account, they are created on startup and checked by
+// the readiness probe
+var internalAccounts = []struct {
+	address  string
+	metadata map[string]interface{}
+}{
+	{
+		address: assetsAccountName,
+		metadata: map[string]interface{}{
+			balanceTypeKey:    balanceTypeDebit,
+			ledgerableTypeKey: ledgerableTypeInternal,
+		},
+	},
+	{
+		address: revenueAccountName,
+		metadata: map[string]interface{}{
+			balanceTypeKey:    balanceTypeCredit,
+			ledgerableTypeKey: ledgerableTypeInternal,
+		},
+	},
+	{
+		address: expensesAccountName,
+		metadata: map[string]interface{}{
+			balanceTypeKey:    balanceTypeDebit,
+			ledgerableTypeKey: ledgerableTypeInternal,
+		},
+	},
+}
+
+// InitializeInternalAccounts creates the internal accounts if they don't exist yet. it can be called again
+// after a failure, the accounts left without their metadata are completed.
+func (s *Server) InitializeInternalAccounts(ctx context.Context) error {
+	assetsAccount, err := s.ledger.GetAccount(ctx, assetsAccountName)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error getting internal assets account: %w", err)
 	}
 	if assetsAccount != nil && len(assetsAccount.Metadata) != 0 {
 		logger.Info(ctx, "internal accounts already created")
-		return
+		return nil
 	}
 	// initialize assets, revenue, expenses accounts. API does not provide a convenient way
 	// to create an account so we need to create a NOOP transaction
 	metadata := map[string]interface{}{
 		transactionTypeKey: createInternalAccountsTransaction,
 	}
-	postings := []ledger.TransactionPosting{
-		{
-			Src:    worldAccountName,
-			Dest:   assetsAccountName,
-			Amount: 0,
-		},
-		{
-			Src:    worldAccountName,
-			Dest:   revenueAccountName,
-			Amount: 0,
-		},
-		{
+	postings := make([]ledger.TransactionPosting, len(internalAccounts))
+	for i, account := range internalAccounts {
+		postings[i] = ledger.TransactionPosting{
 			Src:    worldAccountName,
-			Dest:   expensesAccountName,
+			Dest:   account.address,
+			Asset:  legacyAsset,
 			Amount: 0,
-		},
-	}
-	_, err = ledger.CreateTransactionWithPostings(ctx, metadata, postings)
-	if err != nil {
-		log.Fatal(err)
-	}
-	assetsMetadata := map[string]interface{}{
-		balanceTypeKey:    balanceTypeDebit,
-		ledgerableTypeKey: ledgerableTypeInternal,
-	}
-	if err = ledger.AddMetaDataToAccount(ctx, assetsAccountName, assetsMetadata); err != nil {
-		log.Fatal(err)
+		}
 	}
-
-	revenueMetadata := map[string]interface{}{
-		balanceTypeKey:    balanceTypeCredit,
-		ledgerableTypeKey: ledgerableTypeInternal,
+	// the fixed reference keeps concurrent or retried initializations from posting the noop transaction twice,
+	// the one that loses finds the accounts created and completes their metadata
+	_, err = s.postTransaction(ctx, metadata, postings, string(createInternalAccountsTransaction))
+	if err != nil && !errors.Is(err, ledger.ErrDuplicateReference) {
+		return fmt.Errorf("error creating internal accounts: %w", err)
 	}
-	if err = ledger.AddMetaDataToAccount(ctx, revenueAccountName, revenueMetadata); err != nil {
-		log.Fatal(err)
+	// the assets metadata is added last, it tells a later call that every account is complete
+	for i := len(internalAccounts) - 1; i >= 0; i-- {
+		account := internalAccounts[i]
+		if err = s.ledger.AddMetaDataToAccount(ctx, account.address, account.metadata); err != nil {
+			return fmt.Errorf("error adding metadata to internal account %s: %w", account.address, err)
+		}
 	}
+	logger.Info(ctx, "successfully created internal accounts")
+	return nil
+}
 
-	expensesMetadata := map[string]interface{}{
-		balanceTypeKey:    balanceTypeDebit,
-		ledgerableTypeKey: ledgerableTypeInternal,
+// checkInternalAccounts fails unless every internal account exists with its metadata
+func (s *Server) checkInternalAccounts(ctx context.Context) error {
+	for _, expected := range internalAccounts {
+		account, err := s.ledger.GetAccount(ctx, expected.address)
+		if err != nil {
+			return fmt.Errorf("error getting internal account %s: %w", expected.address, err)
+		}
+		if account == nil {
+			return fmt.Errorf("internal account %s does not exist", expected.address)
+		}
+		for key, value := range expected.metadata {
+			if actual := metadataValue(account.Metadata, key); actual != fmt.Sprintf("%v", value) {
+				return fmt.Errorf("internal account %s has %s %q, expected %q", expected.address, key, actual, value)
+			}
+		}
 	}
-	if err = ledger.AddMetaDataToAccount(ctx, expensesAccountName, expensesMetadata); err != nil {
-		log.Fatal(err)
-	}
-	logger.Info(ctx, "successfully created internal accounts")
+	return nil
 }
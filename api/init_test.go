@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"magic-ledger/ledger"
+	"testing"
+)
+
+func TestInitializeInternalAccountsAfterPartialRun(t *testing.T) {
+	ctx := context.Background()
+	backend := ledger.NewMemory()
+	s := NewServer(backend, Options{})
+	// a run stopped between the noop transaction and the metadata of the accounts
+	postings := []ledger.TransactionPosting{{Src: worldAccountName, Dest: assetsAccountName, Asset: legacyAsset}}
+	metadata := map[string]interface{}{transactionTypeKey: createInternalAccountsTransaction}
+	if _, err := backend.CreateTransactionWithPostings(ctx, metadata, postings, string(createInternalAccountsTransaction)); err != nil {
+		t.Fatalf("CreateTransactionWithPostings: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.InitializeInternalAccounts(ctx); err != nil {
+			t.Fatalf("InitializeInternalAccounts, call %d: %v", i, err)
+		}
+	}
+	if err := s.checkInternalAccounts(ctx); err != nil {
+		t.Errorf("checkInternalAccounts: %v", err)
+	}
+	page, err := backend.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{transactionTypeKey: string(createInternalAccountsTransaction)},
+	}, ledger.Page{PageSize: 10})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(page.Transactions) != 1 {
+		t.Errorf("create_internal_account transactions: got %d, want 1", len(page.Transactions))
+	}
+}
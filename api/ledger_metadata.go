@@ -2,61 +2,79 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"magic-ledger/ledger"
 	"magic-ledger/logger"
 	"net/http"
+	"strings"
 )
 
+// LedgerMetadataResponse reports every total per asset, amounts in different currencies are never summed together
 type LedgerMetadataResponse struct {
-	Debits   int64 `json:"debits"`
-	Credits  int64 `json:"credits"`
-	Expenses int64 `json:"expenses"`
-	Assets   int64 `json:"assets"`
-	Revenue  int64 `json:"revenue"`
+	Debits   map[string]int64 `json:"debits"`
+	Credits  map[string]int64 `json:"credits"`
+	Expenses map[string]int64 `json:"expenses"`
+	Assets   map[string]int64 `json:"assets"`
+	Revenue  map[string]int64 `json:"revenue"`
+	// CardLiability is the balance left on every card and held by its authorizations, what the cardholders can
+	// still spend
+	CardLiability map[string]int64 `json:"card_liability"`
 }
 
 // LedgerMetadata serves as a sanity check that debits = credits. Also returns retained earnings info
-func LedgerMetadata(w http.ResponseWriter, _ *http.Request) {
-	ctx := context.Background()
-	accounts, err := ledger.ListAccounts(ctx)
+func (s *Server) LedgerMetadata(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	res, err := s.ledgerTotals(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error listing ledger accounts: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	writeJSON(ctx, w, res)
+}
 
-	balances, err := ledger.ListBalances(ctx)
+// ledgerTotals sums the balances of every account of the ledger, it is shared by LedgerMetadata and the
+// ledger gauges of /metrics
+func (s *Server) ledgerTotals(ctx context.Context) (*LedgerMetadataResponse, error) {
+	accounts, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{})
 	if err != nil {
-		http.Error(w, "error listing ledger balances", http.StatusInternalServerError)
-		return
+		return nil, errLedger(err, "error listing ledger accounts")
+	}
+
+	balances, err := s.ledger.ListBalances(ctx)
+	if err != nil {
+		return nil, errLedger(err, "error listing ledger balances")
+	}
+	res := &LedgerMetadataResponse{
+		Debits:        make(map[string]int64),
+		Credits:       make(map[string]int64),
+		Expenses:      make(map[string]int64),
+		Assets:        make(map[string]int64),
+		Revenue:       make(map[string]int64),
+		CardLiability: make(map[string]int64),
 	}
-	var res LedgerMetadataResponse
-	debits := int64(0)
-	credits := int64(0)
 	for _, acct := range accounts {
-		acctBalance := balances[acct.Address]
-		if acct.Address == assetsAccountName {
-			res.Assets = acctBalance
-		} else if acct.Address == revenueAccountName {
-			res.Revenue = acctBalance
-		} else if acct.Address == expensesAccountName {
-			res.Expenses = acctBalance
+		if _, ok := acct.Metadata[balanceTypeKey]; !ok && acct.Address != worldAccountName {
+			logger.Warn(ctx, "account without balance_type left out of the debits and credits, run the repair command",
+				"address", acct.Address)
 		}
-		if balanceType, ok := acct.Metadata[balanceTypeKey]; ok {
-			if BalanceType(fmt.Sprintf("%v", balanceType)) == balanceTypeCredit {
-				credits += acctBalance
-			} else if BalanceType(fmt.Sprintf("%v", balanceType)) == balanceTypeDebit {
-				debits += acctBalance
+		for asset, acctBalance := range balances[acct.Address] {
+			if acct.Address == assetsAccountName {
+				res.Assets[asset] = acctBalance
+			} else if acct.Address == revenueAccountName {
+				res.Revenue[asset] = acctBalance
+			} else if acct.Address == expensesAccountName {
+				res.Expenses[asset] = acctBalance
+			} else if strings.HasPrefix(acct.Address, "cards:") || strings.HasPrefix(acct.Address, "holds:") {
+				res.CardLiability[asset] += acctBalance
+			}
+			if balanceType, ok := acct.Metadata[balanceTypeKey]; ok {
+				if BalanceType(fmt.Sprintf("%v", balanceType)) == balanceTypeCredit {
+					res.Credits[asset] += acctBalance
+				} else if BalanceType(fmt.Sprintf("%v", balanceType)) == balanceTypeDebit {
+					res.Debits[asset] += acctBalance
+				}
 			}
 		}
 	}
-	res.Credits = credits
-	res.Debits = debits
-	err = json.NewEncoder(w).Encode(res)
-	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
-	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	return res, nil
 }
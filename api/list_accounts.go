@@ -1,45 +1,65 @@
 package api
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"magic-ledger/ledger"
-	"magic-ledger/logger"
 	"net/http"
 )
 
 type ListAccountsResponse struct {
 	Accounts interface{} `json:"accounts"`
+	// Next is the cursor of the following page, omitted on the last page
+	Next string `json:"next,omitempty"`
 }
 
+// Account is a ledger account along with its balance in each asset it holds. Asset is the asset a card
+// or merchant is denominated in, it is empty for internal accounts which can hold every asset.
 type Account struct {
-	Address        string `json:"address"`
-	Name           string `json:"name"`
-	MerchantId     string `json:"merchant_id"`
-	Balance        int64  `json:"balance"`
-	BalanceType    string `json:"balance_type"`
-	LedgerableType string `json:"ledgerable_type"`
+	Address        string           `json:"address"`
+	Name           string           `json:"name"`
+	MerchantId     string           `json:"merchant_id"`
+	Asset          string           `json:"asset,omitempty"`
+	Balances       map[string]int64 `json:"balances"`
+	BalanceType    string           `json:"balance_type"`
+	LedgerableType string           `json:"ledgerable_type"`
 }
 
-func ListAccounts(w http.ResponseWriter, _ *http.Request) {
-	ctx := context.Background()
-	accounts, err := ledger.ListAccounts(ctx)
+func (s *Server) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	page, err := readPage(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error listing ledger accounts: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-
-	balances, err := ledger.ListBalances(ctx)
+	accounts, err := s.ledger.ListAccounts(ctx, ledger.AccountFilter{}, page)
 	if err != nil {
-		http.Error(w, "error listing ledger balances", http.StatusInternalServerError)
+		writeError(w, errLedger(err, "error listing ledger accounts"))
 		return
 	}
-	accountsWithBalances := make([]Account, len(accounts))
-	for i, acct := range accounts {
+
+	// only the balances of the page are read, without any address ListBalances would read the whole ledger
+	balances := make(map[string]map[string]int64)
+	if len(accounts.Accounts) > 0 {
+		addresses := make([]string, len(accounts.Accounts))
+		for i, acct := range accounts.Accounts {
+			addresses[i] = acct.Address
+		}
+		if balances, err = s.ledger.ListBalances(ctx, addresses...); err != nil {
+			writeError(w, errLedger(err, "error listing ledger balances"))
+			return
+		}
+	}
+	accountsWithBalances := make([]Account, len(accounts.Accounts))
+	for i, acct := range accounts.Accounts {
 		accountWithBalance := Account{
-			Address: acct.Address,
-			Balance: balances[acct.Address],
+			Address:  acct.Address,
+			Balances: balances[acct.Address],
+		}
+		if accountWithBalance.Balances == nil {
+			accountWithBalance.Balances = make(map[string]int64)
+		}
+		if LedgerableType(fmt.Sprintf("%v", acct.Metadata[ledgerableTypeKey])) == ledgerableTypeExternal {
+			accountWithBalance.Asset = accountAsset(acct.Metadata)
 		}
 		if name, ok := acct.Metadata[nameKey]; ok {
 			accountWithBalance.Name = fmt.Sprintf("%v", name)
@@ -56,14 +76,8 @@ func ListAccounts(w http.ResponseWriter, _ *http.Request) {
 		accountsWithBalances[i] = accountWithBalance
 	}
 
-	err = json.NewEncoder(w).Encode(
-		ListAccountsResponse{
-			Accounts: accountsWithBalances,
-		},
-	)
-	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
-	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(ctx, w, ListAccountsResponse{
+		Accounts: accountsWithBalances,
+		Next:     accounts.Next,
+	})
 }
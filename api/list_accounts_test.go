@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestListAccountsPages(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	purchaseTestCard(t, h, merchant, "1000")
+	purchaseTestCard(t, h, merchant, "500")
+
+	// every page carries the balances of its own accounts
+	seen := 0
+	path := "/accounts?page_size=2"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("GET /accounts never returned its last page")
+		}
+		status, res := do(t, h, http.MethodGet, path, nil)
+		if status != http.StatusOK {
+			t.Fatalf("listing accounts: got %d %v", status, res)
+		}
+		accounts := res["accounts"].([]interface{})
+		if len(accounts) > 2 {
+			t.Fatalf("got a page of %d accounts, want at most 2", len(accounts))
+		}
+		for _, account := range accounts {
+			account := account.(map[string]interface{})
+			address := account["address"].(string)
+			balances := account["balances"].(map[string]interface{})
+			if got, want := balances["USD/2"], float64(balance(t, s, address, "USD/2")); got != want && !(got == nil && want == 0) {
+				t.Errorf("balance of %s: got %v, want %v", address, got, want)
+			}
+			seen++
+		}
+		next, _ := res["next"].(string)
+		if next == "" {
+			break
+		}
+		path = "/accounts?cursor=" + url.QueryEscape(next)
+	}
+	// world, the internal accounts, the merchant and the two cards
+	if seen < 6 {
+		t.Errorf("listed %d accounts, want at least 6", seen)
+	}
+}
@@ -1,32 +1,97 @@
 package api
 
 import (
-	"context"
-	"encoding/json"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
 	"magic-ledger/ledger"
-	"magic-ledger/logger"
 	"net/http"
+	"time"
 )
 
 type ListTransactionsResponse struct {
 	Transactions interface{} `json:"transactions"`
+	// Next is the cursor of the following page, omitted on the last page
+	Next string `json:"next,omitempty"`
 }
 
-func ListTransactions(w http.ResponseWriter, _ *http.Request) {
-	ctx := context.Background()
-	transactions, err := ledger.ListTransactions(ctx)
+// ListTransactions lists the transactions matching the transaction_type, card_id, merchant_id, account,
+// start_time and end_time query parameters that are set. the history listed to a merchant leaves out its
+// merchant_fees transactions, see withoutFeeSchedules.
+func (s *Server) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	page, err := readPage(r)
 	if err != nil {
-		http.Error(w, "error listing ledger account", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(
-		ListTransactionsResponse{
-			Transactions: transactions,
-		},
-	)
+	filter, err := readTransactionFilter(r)
 	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
+		writeError(w, err)
+		return
+	}
+	if err = scopeTransactionFilter(r, filter.Metadata); err != nil {
+		writeError(w, err)
+		return
+	}
+	transactions, err := s.ledger.ListTransactions(ctx, filter, page)
+	if err != nil {
+		writeError(w, errLedger(err, "error listing ledger account"))
+		return
+	}
+	if principal := principalFrom(ctx); principal != nil && principal.Role == roleMerchant {
+		transactions.Transactions = withoutFeeSchedules(transactions.Transactions)
+	}
+	writeJSON(ctx, w, ListTransactionsResponse{
+		Transactions: transactions.Transactions,
+		Next:         transactions.Next,
+	})
+}
+
+// withoutFeeSchedules drops the merchant_fees transactions, they move no money and only record a fee schedule read
+// through GET /merchants/{address}/fees. a page may then hold fewer transactions than its size.
+func withoutFeeSchedules(transactions []shared.Transaction) []shared.Transaction {
+	kept := make([]shared.Transaction, 0, len(transactions))
+	for _, txn := range transactions {
+		if metadataValue(txn.Metadata, transactionTypeKey) != string(merchantFeesTransaction) {
+			kept = append(kept, txn)
+		}
+	}
+	return kept
+}
+
+func readTransactionFilter(r *http.Request) (ledger.TransactionFilter, error) {
+	query := r.URL.Query()
+	filter := ledger.TransactionFilter{
+		Account:  query.Get("account"),
+		Metadata: make(map[string]string),
+	}
+	for param, key := range map[string]string{
+		"transaction_type": transactionTypeKey,
+		"card_id":          cardIdKey,
+		"merchant_id":      merchantIdKey,
+	} {
+		if value := query.Get(param); value != "" {
+			filter.Metadata[key] = value
+		}
+	}
+	var err error
+	if filter.StartTime, err = readTime(r, "start_time"); err != nil {
+		return filter, err
+	}
+	if filter.EndTime, err = readTime(r, "end_time"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// readTime reads an optional RFC3339 query parameter
+func readTime(r *http.Request, param string) (*time.Time, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, errInvalidRequest("%s must be an RFC3339 timestamp: %s", param, err.Error())
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	return &t, nil
 }
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listTestTransactions returns the txids of every page of GET /transactions with query
+func listTestTransactions(t *testing.T, h http.Handler, query url.Values) []int64 {
+	t.Helper()
+	var txids []int64
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("GET /transactions?%s never returned its last page", query.Encode())
+		}
+		status, res := do(t, h, http.MethodGet, "/transactions?"+query.Encode(), nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET /transactions?%s: got %d %v", query.Encode(), status, res)
+		}
+		for _, txn := range res["transactions"].([]interface{}) {
+			txids = append(txids, int64(txn.(map[string]interface{})["txid"].(float64)))
+		}
+		next, _ := res["next"].(string)
+		if next == "" {
+			return txids
+		}
+		query = url.Values{"cursor": {next}}
+	}
+}
+
+func TestListTransactionsFilters(t *testing.T) {
+	_, h := newTestServer(t)
+	txid := func(res map[string]interface{}) int64 {
+		return int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+	}
+
+	status, res := do(t, h, http.MethodPost, "/merchant/create", map[string]string{"merchant_name": "coffee shop"})
+	if status != http.StatusOK {
+		t.Fatalf("creating merchant: got %d %v", status, res)
+	}
+	coffeeShop, createCoffeeShop := transactionMetadata(t, res)[merchantIdKey].(string), txid(res)
+	status, res = do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "alice", "merchant_id": coffeeShop, "amount": "1000"})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	alice, purchaseAlice := transactionMetadata(t, res)[cardIdKey].(string), txid(res)
+
+	// the transactions before and after start are told apart by their timestamps
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	status, res = do(t, h, http.MethodPost, "/merchant/create", map[string]string{"merchant_name": "bakery"})
+	if status != http.StatusOK {
+		t.Fatalf("creating merchant: got %d %v", status, res)
+	}
+	bakery, createBakery := transactionMetadata(t, res)[merchantIdKey].(string), txid(res)
+	status, res = do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "bob", "merchant_id": bakery, "amount": "500"})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	bob, purchaseBob := transactionMetadata(t, res)[cardIdKey].(string), txid(res)
+	if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": alice, "amount": "100"}); status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	spendAlice := txid(res)
+
+	all := listTestTransactions(t, h, url.Values{})
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []int64
+	}{
+		{"transaction_type", url.Values{"transaction_type": {"purchase_card"}}, []int64{purchaseBob, purchaseAlice}},
+		{"card_id", url.Values{"card_id": {alice}}, []int64{spendAlice, purchaseAlice}},
+		{"merchant_id", url.Values{"merchant_id": {bakery}}, []int64{purchaseBob, createBakery}},
+		{"account", url.Values{"account": {bob}}, []int64{purchaseBob}},
+		{"merchant_id and transaction_type", url.Values{"merchant_id": {coffeeShop}, "transaction_type": {"create_merchant"}}, []int64{createCoffeeShop}},
+		{"start_time", url.Values{"start_time": {start.Format(time.RFC3339Nano)}}, []int64{spendAlice, purchaseBob, createBakery}},
+		{"end_time", url.Values{"end_time": {start.Format(time.RFC3339Nano)}, "transaction_type": {"purchase_card"}}, []int64{purchaseAlice}},
+		{"start_time and card_id", url.Values{"start_time": {start.Format(time.RFC3339Nano)}, "card_id": {alice}}, []int64{spendAlice}},
+		{"no match", url.Values{"card_id": {"cards:missing"}}, nil},
+		// the pages, most recent first, add up to the whole list
+		{"page_size", url.Values{"page_size": {"2"}}, all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listTestTransactions(t, h, tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	status, res = do(t, h, http.MethodGet, "/transactions?page_size=2", nil)
+	if status != http.StatusOK || len(res["transactions"].([]interface{})) != 2 || res["next"] == nil {
+		t.Fatalf("first page of 2: got %d %v", status, res)
+	}
+}
+
+func TestListTransactionsInvalid(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, query := range []string{
+		"start_time=yesterday",
+		"end_time=2024-13-01T00:00:00Z",
+		"start_time=2024-01-01",
+		"page_size=0",
+		"page_size=ten",
+		"cursor=not-a-cursor",
+	} {
+		status, res := do(t, h, http.MethodGet, "/transactions?"+query, nil)
+		if status != http.StatusBadRequest || errorCode(res) != string(errorCodeInvalidRequest) {
+			t.Errorf("GET /transactions?%s: got %d %v, want %d %s", query, status, res, http.StatusBadRequest, errorCodeInvalidRequest)
+		}
+	}
+}
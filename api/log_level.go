@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"magic-ledger/logger"
+	"net/http"
+	"strings"
+)
+
+type LogLevelRequest struct {
+	// one of debug, info, warn or error
+	Level string `json:"level"`
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// GetLogLevel returns the minimum level logged
+func (s *Server) GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(r.Context(), w, LogLevelResponse{Level: strings.ToLower(logger.GetLevel().String())})
+}
+
+// SetLogLevel changes the minimum level logged until the next restart, ex. to debug a live issue
+func (s *Server) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	decoder := json.NewDecoder(r.Body)
+	var req LogLevelRequest
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, errInvalidRequest("unable to decode SetLogLevel request: %s", err.Error()))
+		return
+	}
+	level, err := logger.ParseLevel(req.Level)
+	if err != nil {
+		writeError(w, errInvalidRequest("%s", err.Error()))
+		return
+	}
+	previous := logger.GetLevel()
+	logger.SetLevel(level)
+	logger.Warn(ctx, "log level changed", "from", previous, "to", level)
+	writeJSON(ctx, w, LogLevelResponse{Level: strings.ToLower(level.String())})
+}
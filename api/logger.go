@@ -1,23 +1,57 @@
 package api
 
 import (
-	"log"
+	"magic-ledger/logger"
 	"net/http"
 	"time"
 )
 
+// responseRecorder remembers the status and the size of the response written through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	// a handler writing without calling WriteHeader first answers with a 200
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Logger writes one access log line per request, once it has been handled
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		r = r.WithContext(logger.WithRoute(r.Context(), name))
+		recorder := &responseRecorder{ResponseWriter: w}
 
-		inner.ServeHTTP(w, r)
+		inner.ServeHTTP(recorder, r)
 
-		log.Printf(
-			"%s %s %s %s",
-			r.Method,
-			r.RequestURI,
-			name,
-			time.Since(start),
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		logger.Info(
+			r.Context(),
+			"request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"status", recorder.status,
+			"size", recorder.size,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
 		)
 	})
 }
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"magic-ledger/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggerStatusAndSize(t *testing.T) {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	logger.SetFormat(logger.FormatJSON)
+	t.Cleanup(func() {
+		logger.SetOutput(os.Stderr)
+		logger.SetFormat(logger.FormatText)
+	})
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus float64
+		wantSize   float64
+	}{
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("created"))
+		}, http.StatusCreated, 7},
+		// writing without WriteHeader answers with a 200, every write is counted
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello "))
+			_, _ = w.Write([]byte("world"))
+		}, http.StatusOK, 11},
+		{"nothing written", func(w http.ResponseWriter, r *http.Request) {}, http.StatusOK, 0},
+		// only the first status is the one sent
+		{"status written twice", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			Logger(tt.handler, "Test").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test?a=1", nil))
+
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &line); err != nil {
+				t.Fatalf("decoding %q: %v", buf.String(), err)
+			}
+			if line["msg"] != "request handled" || line["route"] != "Test" || line["method"] != http.MethodPost ||
+				line["path"] != "/test" || line["query"] != "a=1" {
+				t.Errorf("access log line: got %v", line)
+			}
+			if line["status"] != tt.wantStatus || line["size"] != tt.wantSize {
+				t.Errorf("status and size: got %v and %v, want %v and %v", line["status"], line["size"], tt.wantStatus, tt.wantSize)
+			}
+		})
+	}
+}
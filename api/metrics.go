@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "magic_ledger_http_requests_total",
+		Help: "Requests handled, by route and status code.",
+	}, []string{"route", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "magic_ledger_http_request_duration_seconds",
+		Help:    "Latency of the requests handled, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	transactionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "magic_ledger_transactions_total",
+		Help: "Transactions posted to the ledger, by transaction type.",
+	}, []string{"transaction_type"})
+	cardLiability = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "magic_ledger_card_liability",
+		Help: "Balance left on every card, in the minor unit of the asset, as of the last refresh.",
+	}, []string{"asset"})
+	assetsBalance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "magic_ledger_assets",
+		Help: "Balance of the assets account, in the minor unit of the asset, as of the last refresh.",
+	}, []string{"asset"})
+	metricsHandler = promhttp.Handler()
+)
+
+// Instrument counts the requests handled by route and status code and records their latency
+func Instrument(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		inner.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requestsTotal.WithLabelValues(name, strconv.Itoa(recorder.status)).Inc()
+		requestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	})
+}
+
+// postTransaction posts a transaction to the ledger and counts it by its transaction_type metadata
+func (s *Server) postTransaction(ctx context.Context, metadata map[string]interface{}, postings []ledger.TransactionPosting, reference string) (*shared.Transaction, error) {
+	txn, err := s.ledger.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+	if err == nil {
+		transactionsTotal.WithLabelValues(fmt.Sprintf("%v", metadata[transactionTypeKey])).Inc()
+	}
+	return txn, err
+}
+
+// postScript posts the transaction made by script and counts it like postTransaction
+func (s *Server) postScript(ctx context.Context, metadata map[string]interface{}, script ledger.Script, reference string) (*shared.Transaction, error) {
+	txn, err := s.ledger.CreateTransactionFromScript(ctx, script, metadata, reference)
+	if err == nil {
+		transactionsTotal.WithLabelValues(fmt.Sprintf("%v", metadata[transactionTypeKey])).Inc()
+	}
+	return txn, err
+}
+
+// Metrics exposes the metrics in the Prometheus text format. it never reads the ledger, the ledger gauges are
+// refreshed by ScheduleMetrics.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// ScheduleMetrics refreshes the ledger gauges now then every interval until ctx is done
+func (s *Server) ScheduleMetrics(ctx context.Context, interval time.Duration) {
+	s.RefreshLedgerGauges(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.RefreshLedgerGauges(ctx)
+		}
+	}
+}
+
+// RefreshLedgerGauges computes the ledger gauges the way LedgerMetadata computes its totals, they are left out
+// of the scrapes until the next refresh when the ledger can't be read
+func (s *Server) RefreshLedgerGauges(ctx context.Context) {
+	totals, err := s.ledgerTotals(ctx)
+	cardLiability.Reset()
+	assetsBalance.Reset()
+	if err != nil {
+		logger.Error(ctx, err, "error computing ledger gauges")
+		return
+	}
+	setGauges(cardLiability, totals.CardLiability)
+	setGauges(assetsBalance, totals.Assets)
+}
+
+func setGauges(gauges *prometheus.GaugeVec, balances map[string]int64) {
+	for asset, balance := range balances {
+		gauges.WithLabelValues(asset).Set(float64(balance))
+	}
+}
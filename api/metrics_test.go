@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServesRefreshedGauges(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "2500")
+	s.RefreshLedgerGauges(context.Background())
+
+	// spent after the refresh, the scrape keeps reporting the refreshed gauges
+	status, res := do(t, h, http.MethodPost, "/card/spend", map[string]string{
+		"card_address": card,
+		"amount":       "500",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("spending card: got %d %v", status, res)
+	}
+
+	// only the operators may scrape when auth is enabled
+	s.auth = NewAuthenticator(testJWTSecret, []APIKey{
+		{Key: "scraper", Principal: Principal{Subject: "prometheus", Role: roleOperator}},
+		{Key: "merchant", Principal: Principal{Subject: "pos", Role: roleMerchant, Account: merchant}},
+	})
+	h = s.NewRouter()
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "merchant": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("scraping with key %q: got %d, want %d", key, rec.Code, want)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(apiKeyHeader, "scraper")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", rec.Code, http.StatusOK)
+	}
+	liability := balance(t, s, card, "USD/2") + 500
+	want := fmt.Sprintf(`magic_ledger_card_liability{asset="USD/2"} %d`, liability)
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("scrape without %s:\n%s", want, rec.Body.String())
+	}
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"magic-ledger/ledger"
+	"net/http"
+	"strconv"
+)
+
+// readPage reads the cursor and page_size query parameters of a list request
+func readPage(r *http.Request) (ledger.Page, error) {
+	query := r.URL.Query()
+	page := ledger.Page{
+		Cursor:   query.Get("cursor"),
+		PageSize: ledger.DefaultPageSize,
+	}
+	if pageSize := query.Get("page_size"); pageSize != "" {
+		n, err := strconv.ParseInt(pageSize, 10, 64)
+		if err != nil || n <= 0 || n > ledger.MaxPageSize {
+			return page, errInvalidRequest("page_size must be an integer between 1 and %d", ledger.MaxPageSize)
+		}
+		page.PageSize = n
+	}
+	return page, nil
+}
@@ -1,11 +1,8 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
 	"magic-ledger/ledger"
-	"magic-ledger/logger"
 	"net/http"
 )
 
@@ -20,60 +17,71 @@ type PayoutMerchantResponse struct {
 	Transaction interface{} `json:"transaction"`
 }
 
-func PayoutMerchant(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) PayoutMerchant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
 	decoder := json.NewDecoder(r.Body)
 	var req PayoutMerchantRequest
 	err := decoder.Decode(&req)
 	if err != nil {
-		http.Error(w, "unable to decode request", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("unable to decode request: %s", err.Error()))
 		return
 	}
 
 	if req.MerchantId == nil || req.Amount == nil {
-		http.Error(w, "merchantId and amount cannot be null", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("merchantId and amount cannot be null"))
 		return
 	}
-	account, err := ledger.GetAccount(ctx, *req.MerchantId)
+	if err := validateAmount(*req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, err := newIdempotencyKey(r, payoutMerchantTransaction, req)
 	if err != nil {
-		http.Error(w, "error getting ledger account", http.StatusInternalServerError)
+		writeError(w, errInvalidRequest("unable to read idempotency key: %s", err.Error()))
+		return
+	}
+	if txn, err := s.replay(ctx, key); err != nil {
+		writeError(w, errLedger(err, "error looking up idempotent request"))
+		return
+	} else if txn != nil {
+		writeJSON(ctx, w, PayoutMerchantResponse{Transaction: txn})
+		return
+	}
+	account, err := s.ledger.GetAccount(ctx, *req.MerchantId)
+	if err != nil {
+		writeError(w, errLedger(err, "error getting ledger account"))
 		return
 	}
 	if account == nil {
-		http.Error(w, fmt.Sprintf("no ledger account associated with address %s", *req.MerchantId), http.StatusBadRequest)
+		writeError(w, errAccountNotFound(*req.MerchantId))
 		return
 	}
 
+	asset := accountAsset(account.Metadata)
+	if err := validateBalance(account, asset, *req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
 	metadata := map[string]interface{}{
 		transactionTypeKey: payoutMerchantTransaction,
 		merchantIdKey:      *req.MerchantId,
+		assetKey:           asset,
 	}
-	postings := []ledger.TransactionPosting{
-		{
-			Src:    *req.MerchantId,
-			Dest:   worldAccountName,
-			Amount: *req.Amount,
-		},
-		{
-			Src:    assetsAccountName,
-			Dest:   worldAccountName,
-			Amount: *req.Amount,
-		},
-	}
-	txn, err := ledger.CreateTransactionWithPostings(ctx, metadata, postings)
+	// see templates/payout_merchant.num
+	script, err := templateScript(string(payoutMerchantTransaction), map[string]interface{}{
+		"merchant": *req.MerchantId,
+		"amount":   ledger.Monetary{Asset: asset, Amount: *req.Amount},
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error creating transaction: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(
-		PayoutMerchantResponse{
-			Transaction: txn,
-		},
-	)
+	txn, _, err := s.createFromScript(ctx, key, metadata, script)
 	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(ctx, w, PayoutMerchantResponse{Transaction: txn})
 }
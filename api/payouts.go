@@ -0,0 +1,568 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PayoutStatus string
+
+const (
+	// payoutPending is the status of a payout until the operator reports it sent
+	payoutPending PayoutStatus = "pending"
+	payoutSent    PayoutStatus = "sent"
+	payoutSettled PayoutStatus = "settled"
+	payoutFailed  PayoutStatus = "failed"
+)
+
+// Payout pays a merchant part or all of its balance. the amount leaves the merchant account for the payouts:
+// account of the payout when its batch is created, then leaves the ledger when the payout settles, or goes
+// back to the merchant when it fails.
+type Payout struct {
+	// Id is the address of the account holding the amount while the payout is pending or sent
+	Id         string       `json:"id"`
+	BatchId    string       `json:"batch_id"`
+	MerchantId string       `json:"merchant_id"`
+	Asset      string       `json:"asset"`
+	Amount     int64        `json:"amount"`
+	Status     PayoutStatus `json:"status"`
+}
+
+// PayoutBatch is a set of payouts created by a single transaction
+type PayoutBatch struct {
+	Id        string    `json:"id"`
+	Txid      int64     `json:"txid"`
+	CreatedAt time.Time `json:"created_at"`
+	Payouts   []Payout  `json:"payouts"`
+}
+
+type CreatePayoutBatchRequest struct {
+	// the merchants to pay, every merchant with at least MinAmount payable is paid its payable balance if empty
+	Payouts []PayoutRequest `json:"payouts,omitempty"`
+
+	MinAmount *int64 `json:"min_amount,string,omitempty"`
+}
+
+type PayoutRequest struct {
+	MerchantId *string `json:"merchant_id"`
+
+	// the amount to pay out, the payable balance of the merchant if unset
+	Amount *int64 `json:"amount,string,omitempty"`
+}
+
+type PayoutBatchResponse struct {
+	// Batch is null when no merchant had a balance to pay out
+	Batch *PayoutBatch `json:"batch"`
+}
+
+type ListPayoutBatchesResponse struct {
+	Batches []PayoutBatch `json:"batches"`
+	// Next is the cursor of the following page, omitted on the last page
+	Next string `json:"next,omitempty"`
+}
+
+type SetPayoutStatusRequest struct {
+	// one of sent, settled or failed
+	Status PayoutStatus `json:"status"`
+}
+
+type PayoutResponse struct {
+	Payout Payout `json:"payout"`
+}
+
+// CreatePayoutBatch creates a batch on demand, paying the merchants of the request or every merchant with a
+// payable balance
+func (s *Server) CreatePayoutBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req CreatePayoutBatchRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode CreatePayoutBatch request: %s", err.Error()))
+		return
+	}
+	minAmount := int64(1)
+	if req.MinAmount != nil {
+		if err := validateAmount(*req.MinAmount); err != nil {
+			writeError(w, err)
+			return
+		}
+		minAmount = *req.MinAmount
+	}
+	seen := make(map[string]bool, len(req.Payouts))
+	for _, p := range req.Payouts {
+		if p.MerchantId == nil {
+			writeError(w, errInvalidRequest("merchantId cannot be null"))
+			return
+		}
+		if seen[*p.MerchantId] {
+			writeError(w, errInvalidRequest("merchant %s is paid twice", *p.MerchantId))
+			return
+		}
+		seen[*p.MerchantId] = true
+		if p.Amount != nil {
+			if err := validateAmount(*p.Amount); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+	}
+
+	key, err := newIdempotencyKey(r, payoutBatchTransaction, req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to read idempotency key: %s", err.Error()))
+		return
+	}
+	if txn, err := s.replay(ctx, key); err != nil {
+		writeError(w, errLedger(err, "error looking up idempotent request"))
+		return
+	} else if txn != nil {
+		writeJSON(ctx, w, PayoutBatchResponse{Batch: payoutBatch(txn)})
+		return
+	}
+	batch, _, err := s.createPayoutBatch(ctx, key, req.Payouts, minAmount)
+	if err != nil {
+		writeError(w, errLedger(err, "error creating payout batch"))
+		return
+	}
+	writeJSON(ctx, w, PayoutBatchResponse{Batch: batch})
+}
+
+// ListPayoutBatches returns a page of the payout batches, most recent first
+func (s *Server) ListPayoutBatches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	page, err := readPage(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	transactions, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{transactionTypeKey: string(payoutBatchTransaction)},
+	}, page)
+	if err != nil {
+		writeError(w, errLedger(err, "error listing payout batches"))
+		return
+	}
+	batches := make([]PayoutBatch, 0, len(transactions.Transactions))
+	for i := range transactions.Transactions {
+		batches = append(batches, *payoutBatch(&transactions.Transactions[i]))
+	}
+	writeJSON(ctx, w, ListPayoutBatchesResponse{
+		Batches: batches,
+		Next:    transactions.Next,
+	})
+}
+
+// GetPayoutBatch returns a payout batch along with the status of its payouts
+func (s *Server) GetPayoutBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	transactions, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{
+			transactionTypeKey: string(payoutBatchTransaction),
+			batchIdKey:         id,
+		},
+	}, ledger.Page{PageSize: 1})
+	if err != nil {
+		writeError(w, errLedger(err, "error finding payout batch"))
+		return
+	}
+	if len(transactions.Transactions) == 0 {
+		writeError(w, newError(http.StatusNotFound, errorCodePayoutBatchNotFound, "no payout batch with id %s", id))
+		return
+	}
+	writeJSON(ctx, w, PayoutBatchResponse{Batch: payoutBatch(&transactions.Transactions[0])})
+}
+
+// SetPayoutStatus moves a payout forward: pending to sent, then to settled or failed. every step is recorded in
+// the metadata of the batch transaction, see payoutStatus. settling or failing a payout posts a transaction
+// guarded by the reference payout_completed:{id}, so concurrent or retried requests complete a payout once and
+// it can't be both settled and failed. setting the status a payout already has returns a 409.
+func (s *Server) SetPayoutStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	address := mux.Vars(r)["address"]
+
+	decoder := json.NewDecoder(r.Body)
+	var req SetPayoutStatusRequest
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, errInvalidRequest("unable to decode SetPayoutStatus request: %s", err.Error()))
+		return
+	}
+	if req.Status != payoutSent && req.Status != payoutSettled && req.Status != payoutFailed {
+		writeError(w, errInvalidRequest("status must be one of sent, settled or failed"))
+		return
+	}
+
+	payout, batch, err := s.findPayout(ctx, address)
+	if err != nil {
+		writeError(w, errLedger(err, "error finding payout"))
+		return
+	}
+	if payout == nil {
+		writeError(w, newError(http.StatusNotFound, errorCodePayoutNotFound, "no payout with id %s", address))
+		return
+	}
+	if !payoutTransitionAllowed(payout.Status, req.Status) {
+		writeError(w, errPayoutStatus(*payout, req.Status))
+		return
+	}
+
+	err = s.postPayoutStatus(ctx, batch.Txid, *payout, req.Status)
+	if errors.Is(err, ledger.ErrDuplicateReference) {
+		// a concurrent request completed the payout first, or recording it in the batch failed after the
+		// completion was posted. the batch is recorded from the completion before answering.
+		if payout.Status, err = s.recordPayoutCompletion(ctx, batch.Txid, payout.Id); err != nil {
+			writeError(w, errLedger(err, "error reading payout status"))
+			return
+		}
+		writeError(w, errPayoutStatus(*payout, req.Status))
+		return
+	}
+	if err != nil {
+		writeError(w, errLedger(err, "error posting %s payout", req.Status))
+		return
+	}
+	logger.Info(ctx, "payout status changed", "payout_id", address, "from", payout.Status, "to", req.Status)
+	payout.Status = req.Status
+	writeJSON(ctx, w, PayoutResponse{Payout: *payout})
+}
+
+// payoutTransitionAllowed is true when a payout can move from its status to next
+func payoutTransitionAllowed(status PayoutStatus, next PayoutStatus) bool {
+	switch status {
+	case payoutPending:
+		// a payout rejected before it was sent fails, its amount goes back to the merchant
+		return next == payoutSent || next == payoutFailed
+	case payoutSent:
+		return next == payoutSettled || next == payoutFailed
+	}
+	return false
+}
+
+func errPayoutStatus(payout Payout, next PayoutStatus) *Error {
+	e := newError(http.StatusConflict, errorCodeInvalidPayoutStatus, "payout %s is %s, it cannot become %s", payout.Id, payout.Status, next)
+	e.Details = map[string]interface{}{"status": payout.Status}
+	return e
+}
+
+// payoutSentKey is the metadata of the batch transaction recording when a payout was sent
+func payoutSentKey(payoutId string) string {
+	return fmt.Sprintf("payout_sent:%s", payoutId)
+}
+
+// payoutCompletedKey is the metadata of the batch transaction recording whether a payout settled or failed. it
+// is also the reference of the transaction completing the payout, settling and failing share it so only one of
+// them can be posted.
+func payoutCompletedKey(payoutId string) string {
+	return fmt.Sprintf("payout_completed:%s", payoutId)
+}
+
+// payoutStatus reads the status of a payout from the metadata of the batch transaction that created it. sending
+// and completing a payout are recorded under different keys, so a late write never moves a payout back.
+func payoutStatus(batch *shared.Transaction, payoutId string) PayoutStatus {
+	if completed := metadataValue(batch.Metadata, payoutCompletedKey(payoutId)); completed != "" {
+		return PayoutStatus(completed)
+	}
+	if metadataValue(batch.Metadata, payoutSentKey(payoutId)) != "" {
+		return payoutSent
+	}
+	return payoutPending
+}
+
+// postPayoutStatus records payout moving to status in the batch transaction batchTxid. sending a payout moves no
+// money, only the record is written. a settled payout leaves the ledger and a failed one goes back to the merchant,
+// see templates/payout_settled.num and templates/payout_failed.num, the record is written once that is posted.
+func (s *Server) postPayoutStatus(ctx context.Context, batchTxid int64, payout Payout, status PayoutStatus) error {
+	if status == payoutSent {
+		return s.ledger.AddMetaDataToTransaction(ctx, batchTxid, map[string]interface{}{
+			payoutSentKey(payout.Id): time.Now().UTC().Format(time.RFC3339Nano),
+		})
+	}
+
+	txnType := payoutSettledTransaction
+	vars := map[string]interface{}{
+		"payout": payout.Id,
+		"amount": ledger.Monetary{Asset: payout.Asset, Amount: payout.Amount},
+	}
+	if status == payoutFailed {
+		txnType = payoutFailedTransaction
+		vars["merchant"] = payout.MerchantId
+	}
+	script, err := templateScript(string(txnType), vars)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]interface{}{
+		transactionTypeKey: txnType,
+		payoutIdKey:        payout.Id,
+		batchIdKey:         payout.BatchId,
+		merchantIdKey:      payout.MerchantId,
+		assetKey:           payout.Asset,
+	}
+	if _, err = s.postScript(ctx, metadata, script, payoutCompletedKey(payout.Id)); err != nil {
+		return err
+	}
+	// the money moved, the record is written even if the request is canceled meanwhile. when writing it fails,
+	// retrying the request writes it from the posted transaction.
+	return s.ledger.AddMetaDataToTransaction(detach(ctx), batchTxid, map[string]interface{}{
+		payoutCompletedKey(payout.Id): status,
+	})
+}
+
+// recordPayoutCompletion records in the batch transaction batchTxid how the payout was completed, read from the
+// transaction posted under its reference, and returns its status
+func (s *Server) recordPayoutCompletion(ctx context.Context, batchTxid int64, payoutId string) (PayoutStatus, error) {
+	completion, err := s.ledger.GetTransactionByReference(ctx, payoutCompletedKey(payoutId))
+	if err != nil {
+		return "", err
+	}
+	if completion == nil {
+		return "", fmt.Errorf("no transaction with reference %s", payoutCompletedKey(payoutId))
+	}
+	status := payoutSettled
+	if TransactionType(metadataValue(completion.Metadata, transactionTypeKey)) == payoutFailedTransaction {
+		status = payoutFailed
+	}
+	err = s.ledger.AddMetaDataToTransaction(ctx, batchTxid, map[string]interface{}{
+		payoutCompletedKey(payoutId): status,
+	})
+	return status, err
+}
+
+// SchedulePayouts creates a payout batch every interval until ctx is done, paying every merchant with at
+// least minAmount payable. the batch of a run is keyed by its interval, so replicas ticking within the same
+// interval, or a run retried after it failed, create it once.
+func (s *Server) SchedulePayouts(ctx context.Context, interval time.Duration, minAmount int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			batch, replayed, err := s.createPayoutBatch(ctx, scheduledPayoutsKey(now, interval, minAmount), nil, minAmount)
+			if err != nil {
+				logger.Error(ctx, err, "error creating payout batch")
+				continue
+			}
+			if batch == nil {
+				logger.Info(ctx, "no merchant to pay out")
+				continue
+			}
+			if replayed {
+				// created by another replica, or by this one before it restarted
+				logger.Debug(ctx, "payout batch already created", "batch_id", batch.Id, "payouts", len(batch.Payouts))
+				continue
+			}
+			logger.Info(ctx, "payout batch created", "batch_id", batch.Id, "payouts", len(batch.Payouts))
+		}
+	}
+}
+
+// scheduledPayoutsKey is the idempotency key of the scheduled batch of the interval now falls in
+func scheduledPayoutsKey(now time.Time, interval time.Duration, minAmount int64) idempotencyKey {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:scheduled:%d", payoutBatchTransaction, minAmount)))
+	return idempotencyKey{
+		reference: fmt.Sprintf("%s:scheduled:%s", payoutBatchTransaction, now.UTC().Truncate(interval).Format(time.RFC3339)),
+		hash:      hex.EncodeToString(sum[:]),
+	}
+}
+
+// payableBalances returns what every merchant can be paid out, keyed by merchant address: the balance of its
+// merchant account. it is already net of holds, an authorized amount stays in its holds: account until it is
+// captured to the merchant. it is also net of the payouts pending or sent, a batch moves their amount out of the
+// merchant account when it is created.
+func (s *Server) payableBalances(ctx context.Context) (map[string]Payout, error) {
+	accounts, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{AddressPrefix: "merchant:"})
+	if err != nil {
+		return nil, err
+	}
+	merchants := make([]string, 0, len(accounts))
+	for _, acct := range accounts {
+		if strings.HasPrefix(acct.Address, "merchant:") && metadataValue(acct.Metadata, balanceTypeKey) != "" {
+			merchants = append(merchants, acct.Address)
+		}
+	}
+	payables := make(map[string]Payout)
+	if len(merchants) == 0 {
+		return payables, nil
+	}
+	balances, err := s.ledger.ListBalances(ctx, merchants...)
+	if err != nil {
+		return nil, err
+	}
+	for _, acct := range accounts {
+		if !strings.HasPrefix(acct.Address, "merchant:") || metadataValue(acct.Metadata, balanceTypeKey) == "" {
+			continue
+		}
+		asset := accountAsset(acct.Metadata)
+		payables[acct.Address] = Payout{
+			MerchantId: acct.Address,
+			Asset:      asset,
+			Amount:     balances[acct.Address][asset],
+		}
+	}
+	return payables, nil
+}
+
+// createPayoutBatch moves the amount of every payout out of its merchant account in a single transaction, see
+// templates/payout_batch.num, so the batch is created whole or not at all. requested selects the merchants and amounts, every merchant with
+// at least minAmount payable is paid its payable balance when it is empty. the batch is nil when there
+// is nothing to pay, replayed is true when key had already created it.
+func (s *Server) createPayoutBatch(ctx context.Context, key idempotencyKey, requested []PayoutRequest, minAmount int64) (batch *PayoutBatch, replayed bool, err error) {
+	payables, err := s.payableBalances(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var payouts []Payout
+	if len(requested) > 0 {
+		for _, p := range requested {
+			payable, ok := payables[*p.MerchantId]
+			if !ok {
+				return nil, false, errAccountNotFound(*p.MerchantId)
+			}
+			if p.Amount != nil {
+				if *p.Amount > payable.Amount {
+					e := newError(http.StatusBadRequest, errorCodeInsufficientFunds, "merchant %s has %d %s payable, cannot pay out %d",
+						payable.MerchantId, payable.Amount, payable.Asset, *p.Amount)
+					e.Details = map[string]interface{}{"address": payable.MerchantId, "asset": payable.Asset, "available": payable.Amount, "requested": *p.Amount}
+					return nil, false, e
+				}
+				payable.Amount = *p.Amount
+			}
+			if payable.Amount <= 0 {
+				return nil, false, errInvalidRequest("merchant %s has no payable balance", payable.MerchantId)
+			}
+			payouts = append(payouts, payable)
+		}
+	} else {
+		for _, payable := range payables {
+			if payable.Amount >= minAmount {
+				payouts = append(payouts, payable)
+			}
+		}
+		sort.Slice(payouts, func(i, j int) bool {
+			return payouts[i].MerchantId < payouts[j].MerchantId
+		})
+	}
+	if len(payouts) == 0 {
+		return nil, false, nil
+	}
+
+	batchId := strings.Replace(uuid.NewString(), "-", "", -1)
+	// the transaction carries the batch id, the metadata of the payout accounts derives from it, see payoutMetadata
+	metadata := map[string]interface{}{
+		transactionTypeKey: payoutBatchTransaction,
+		batchIdKey:         batchId,
+	}
+	vars := make([]map[string]interface{}, len(payouts))
+	for i, p := range payouts {
+		vars[i] = map[string]interface{}{
+			"merchant": p.MerchantId,
+			"payout":   fmt.Sprintf("payouts:%s", strings.Replace(uuid.NewString(), "-", "", -1)),
+			"amount":   ledger.Monetary{Asset: p.Asset, Amount: p.Amount},
+		}
+	}
+	script, err := repeatedTemplateScript(string(payoutBatchTransaction), vars)
+	if err != nil {
+		return nil, false, err
+	}
+	txn, replayed, err := s.createFromScript(ctx, key, metadata, script)
+	if err != nil {
+		return nil, false, err
+	}
+	if !replayed {
+		// a batch creates several accounts, their metadata is added as in addCreatedAccountMetadata
+		for _, p := range batchPayouts(txn) {
+			if err = s.ledger.AddMetaDataToAccount(detach(ctx), p.Id, payoutMetadata(p)); err != nil {
+				return nil, false, fmt.Errorf("error adding metadata to account %s: %w", p.Id, err)
+			}
+		}
+	}
+	return payoutBatch(txn), replayed, nil
+}
+
+// batchPayouts returns the payouts created by a payout_batch transaction along with their status
+func batchPayouts(txn *shared.Transaction) []Payout {
+	payouts := make([]Payout, 0, len(txn.Postings))
+	for _, p := range txn.Postings {
+		if !strings.HasPrefix(p.Destination, "payouts:") {
+			continue
+		}
+		payouts = append(payouts, Payout{
+			Id:         p.Destination,
+			BatchId:    metadataValue(txn.Metadata, batchIdKey),
+			MerchantId: p.Source,
+			Asset:      p.Asset,
+			Amount:     p.Amount.Int64(),
+			Status:     payoutStatus(txn, p.Destination),
+		})
+	}
+	return payouts
+}
+
+// payoutMetadata is the metadata of the account of a payout. its status is recorded in its batch transaction, see
+// payoutStatus.
+func payoutMetadata(p Payout) map[string]interface{} {
+	return map[string]interface{}{
+		balanceTypeKey:    balanceTypeCredit,
+		ledgerableTypeKey: ledgerableTypeExternal,
+		batchIdKey:        p.BatchId,
+		merchantIdKey:     p.MerchantId,
+		assetKey:          p.Asset,
+	}
+}
+
+// payoutBatch returns the batch created by txn
+func payoutBatch(txn *shared.Transaction) *PayoutBatch {
+	return &PayoutBatch{
+		Id:        metadataValue(txn.Metadata, batchIdKey),
+		Txid:      txn.Txid,
+		CreatedAt: txn.Timestamp,
+		Payouts:   batchPayouts(txn),
+	}
+}
+
+// findPayout returns the payout at address along with the batch transaction that created it, nil if no batch
+// created it
+func (s *Server) findPayout(ctx context.Context, address string) (*Payout, *shared.Transaction, error) {
+	if !strings.HasPrefix(address, "payouts:") {
+		return nil, nil, nil
+	}
+	origin, err := s.findPayoutBatch(ctx, address)
+	if err != nil || origin == nil {
+		return nil, nil, err
+	}
+	for _, p := range batchPayouts(origin) {
+		if p.Id == address {
+			return &p, origin, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// findPayoutBatch returns the payout_batch transaction that created payout, nil if there is none
+func (s *Server) findPayoutBatch(ctx context.Context, payout string) (*shared.Transaction, error) {
+	batches, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Account:  payout,
+		Metadata: map[string]string{transactionTypeKey: string(payoutBatchTransaction)},
+	}, ledger.Page{PageSize: 1})
+	if err != nil || len(batches.Transactions) == 0 {
+		return nil, err
+	}
+	return &batches.Transactions[0], nil
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"context"
+	"magic-ledger/ledger"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPayout spends amount at a new merchant and pays it out in a new batch, returning the payout id
+func newTestPayout(t *testing.T, h http.Handler, amount string) (merchant string, payout string) {
+	t.Helper()
+	merchant = createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "10000")
+	status, res := do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": card, "amount": amount})
+	if status != http.StatusOK {
+		t.Fatalf("spending card: got %d %v", status, res)
+	}
+	status, res = do(t, h, http.MethodPost, "/payouts/batches", map[string]interface{}{
+		"payouts": []map[string]string{{"merchant_id": merchant}},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("creating payout batch: got %d %v", status, res)
+	}
+	payouts := res["batch"].(map[string]interface{})["payouts"].([]interface{})
+	return merchant, payouts[0].(map[string]interface{})["id"].(string)
+}
+
+// testPayoutStatus reads the status of payout from its batch
+func testPayoutStatus(t *testing.T, s *Server, payout string) PayoutStatus {
+	t.Helper()
+	p, _, err := s.findPayout(context.Background(), payout)
+	if err != nil || p == nil {
+		t.Fatalf("findPayout %s: got %v, %v", payout, p, err)
+	}
+	return p.Status
+}
+
+func TestSetPayoutStatus(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant, payout := newTestPayout(t, h, "500")
+
+	steps := []struct {
+		status     PayoutStatus
+		wantStatus int
+		// wantPayout is the status of the payout after the step
+		wantPayout PayoutStatus
+	}{
+		{payoutSettled, http.StatusConflict, payoutPending},
+		{payoutSent, http.StatusOK, payoutSent},
+		{payoutSent, http.StatusConflict, payoutSent},
+		{payoutSettled, http.StatusOK, payoutSettled},
+		{payoutSettled, http.StatusConflict, payoutSettled},
+		{payoutFailed, http.StatusConflict, payoutSettled},
+		{payoutSent, http.StatusConflict, payoutSettled},
+	}
+	for i, step := range steps {
+		status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": step.status})
+		if status != step.wantStatus {
+			t.Fatalf("step %d, %s: got %d %v, want %d", i, step.status, status, res, step.wantStatus)
+		}
+		if status == http.StatusConflict && errorCode(res) != string(errorCodeInvalidPayoutStatus) {
+			t.Errorf("step %d, %s: got code %s, want %s", i, step.status, errorCode(res), errorCodeInvalidPayoutStatus)
+		}
+		if got := testPayoutStatus(t, s, payout); got != step.wantPayout {
+			t.Errorf("step %d, %s: payout is %s, want %s", i, step.status, got, step.wantPayout)
+		}
+	}
+	if got := balance(t, s, payout, "USD/2"); got != 0 {
+		t.Errorf("settled payout balance: got %d, want 0", got)
+	}
+	if got := balance(t, s, merchant, "USD/2"); got != 0 {
+		t.Errorf("merchant balance: got %d, want 0", got)
+	}
+}
+
+func TestFailPendingPayout(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant, payout := newTestPayout(t, h, "500")
+	if got := balance(t, s, merchant, "USD/2"); got != 0 {
+		t.Fatalf("merchant balance with the payout pending: got %d, want 0", got)
+	}
+
+	// the payout is rejected before it is sent, its amount goes back to the merchant
+	status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": payoutFailed})
+	if status != http.StatusOK {
+		t.Fatalf("failing a pending payout: got %d %v", status, res)
+	}
+	if got := testPayoutStatus(t, s, payout); got != payoutFailed {
+		t.Errorf("payout: got %s, want %s", got, payoutFailed)
+	}
+	if got := balance(t, s, payout, "USD/2"); got != 0 {
+		t.Errorf("failed payout balance: got %d, want 0", got)
+	}
+	if got := balance(t, s, merchant, "USD/2"); got != 500 {
+		t.Errorf("merchant balance: got %d, want 500", got)
+	}
+	for _, next := range []PayoutStatus{payoutSent, payoutSettled, payoutFailed} {
+		status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": next})
+		if status != http.StatusConflict || errorCode(res) != string(errorCodeInvalidPayoutStatus) {
+			t.Errorf("%s after failing: got %d %v, want %d", next, status, res, http.StatusConflict)
+		}
+	}
+}
+
+func TestSetPayoutStatusConcurrently(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant, payout := newTestPayout(t, h, "500")
+	if status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": payoutSent}); status != http.StatusOK {
+		t.Fatalf("sending payout: got %d %v", status, res)
+	}
+
+	statuses := []PayoutStatus{payoutSettled, payoutFailed, payoutSettled, payoutFailed}
+	codes := make([]int, len(statuses))
+	var wg sync.WaitGroup
+	for i, status := range statuses {
+		wg.Add(1)
+		go func(i int, status PayoutStatus) {
+			defer wg.Done()
+			codes[i], _ = do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": status})
+		}(i, status)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		} else if code != http.StatusConflict {
+			t.Errorf("got %d, want %d or %d", code, http.StatusOK, http.StatusConflict)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("requests moving the payout: got %d, want 1 (%v)", succeeded, codes)
+	}
+
+	// the amount either left the ledger or went back to the merchant, never both
+	final := testPayoutStatus(t, s, payout)
+	want := int64(0)
+	if final == payoutFailed {
+		want = 500
+	}
+	if got := balance(t, s, merchant, "USD/2"); got != want {
+		t.Errorf("merchant balance after the payout %s: got %d, want %d", final, got, want)
+	}
+}
+
+func TestListPayoutBatchesStatus(t *testing.T) {
+	_, h := newTestServer(t)
+	_, sent := newTestPayout(t, h, "500")
+	_, failed := newTestPayout(t, h, "300")
+	_, pending := newTestPayout(t, h, "200")
+	for _, step := range []struct {
+		payout string
+		status PayoutStatus
+	}{
+		{sent, payoutSent},
+		{failed, payoutSent},
+		{failed, payoutFailed},
+	} {
+		if status, res := do(t, h, http.MethodPut, "/payouts/"+step.payout+"/status", map[string]interface{}{"status": step.status}); status != http.StatusOK {
+			t.Fatalf("%s payout %s: got %d %v", step.status, step.payout, status, res)
+		}
+	}
+
+	status, res := do(t, h, http.MethodGet, "/payouts/batches", nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing payout batches: got %d %v", status, res)
+	}
+	got := make(map[string]interface{})
+	for _, batch := range res["batches"].([]interface{}) {
+		for _, p := range batch.(map[string]interface{})["payouts"].([]interface{}) {
+			p := p.(map[string]interface{})
+			got[p["id"].(string)] = p["status"]
+		}
+	}
+	want := map[string]interface{}{sent: string(payoutSent), failed: string(payoutFailed), pending: string(payoutPending)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("status of the payouts: got %v, want %v", got, want)
+	}
+}
+
+func TestSetPayoutStatusRecordsCompletion(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant, payout := newTestPayout(t, h, "500")
+	if status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": payoutSent}); status != http.StatusOK {
+		t.Fatalf("sending payout: got %d %v", status, res)
+	}
+	// the payout failed but the batch was not told, as when the process stops right after posting
+	ctx := context.Background()
+	p, _, err := s.findPayout(ctx, payout)
+	if err != nil || p == nil {
+		t.Fatalf("findPayout: got %v, %v", p, err)
+	}
+	script, err := templateScript(string(payoutFailedTransaction), map[string]interface{}{
+		"payout":   p.Id,
+		"merchant": p.MerchantId,
+		"amount":   ledger.Monetary{Asset: p.Asset, Amount: p.Amount},
+	})
+	if err != nil {
+		t.Fatalf("templateScript: %v", err)
+	}
+	if _, err = s.ledger.CreateTransactionFromScript(ctx, script, map[string]interface{}{transactionTypeKey: payoutFailedTransaction}, payoutCompletedKey(payout)); err != nil {
+		t.Fatalf("posting the failed payout: %v", err)
+	}
+	if got := testPayoutStatus(t, s, payout); got != payoutSent {
+		t.Fatalf("payout before it is recorded: got %s, want %s", got, payoutSent)
+	}
+
+	// settling it finds the failure, records it and refuses
+	status, res := do(t, h, http.MethodPut, "/payouts/"+payout+"/status", map[string]interface{}{"status": payoutSettled})
+	details, _ := res["error"].(map[string]interface{})["details"].(map[string]interface{})
+	if status != http.StatusConflict || details["status"] != string(payoutFailed) {
+		t.Fatalf("settling a failed payout: got %d %v, want %d with status failed", status, res, http.StatusConflict)
+	}
+	if got := testPayoutStatus(t, s, payout); got != payoutFailed {
+		t.Errorf("payout once recorded: got %s, want %s", got, payoutFailed)
+	}
+	if got := balance(t, s, merchant, "USD/2"); got != 500 {
+		t.Errorf("merchant balance: got %d, want 500", got)
+	}
+}
+
+func TestScheduledPayoutsKey(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "10000")
+	spend := func() {
+		if status, res := do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": card, "amount": "100"}); status != http.StatusOK {
+			t.Fatalf("spending card: got %d %v", status, res)
+		}
+	}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	spend()
+	first, replayed, err := s.createPayoutBatch(ctx, scheduledPayoutsKey(now, 24*time.Hour, 1), nil, 1)
+	if err != nil || first == nil || replayed {
+		t.Fatalf("createPayoutBatch: got %v, %v, %v", first, replayed, err)
+	}
+	// another replica ticking later the same day finds the batch of the day
+	spend()
+	again, replayed, err := s.createPayoutBatch(ctx, scheduledPayoutsKey(now.Add(5*time.Hour), 24*time.Hour, 1), nil, 1)
+	if err != nil || again == nil || again.Id != first.Id || !replayed {
+		t.Fatalf("createPayoutBatch within the interval: got %v, %v, %v, want batch %s replayed", again, replayed, err, first.Id)
+	}
+	next, replayed, err := s.createPayoutBatch(ctx, scheduledPayoutsKey(now.Add(24*time.Hour), 24*time.Hour, 1), nil, 1)
+	if err != nil || next == nil || next.Id == first.Id || replayed {
+		t.Fatalf("createPayoutBatch the next interval: got %v, %v, %v, want a new batch", next, replayed, err)
+	}
+	if len(next.Payouts) != 1 || next.Payouts[0].Amount != 100 {
+		t.Errorf("payouts of the next batch: got %v, want 100 paid out", next.Payouts)
+	}
+}
@@ -1,15 +1,14 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
-	"log"
 	"magic-ledger/ledger"
 	"magic-ledger/logger"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type PurchaseCardRequest struct {
@@ -20,115 +19,149 @@ type PurchaseCardRequest struct {
 	// the amount purchased
 	Amount *int64 `json:"amount,string,omitempty"`
 
-	// amount of purchase that is revenue
+	// amount of purchase that is revenue, computed from the fee schedule of the merchant when it has one
 	RevenueTake *int64 `json:"revenue_take,string,omitempty"`
 
-	// amount of purchase that is expensed (ex. cc fees)
+	// amount of purchase that is expensed (ex. cc fees), computed from the fee schedule of the merchant when it has one
 	Expenses *int64 `json:"expenses,string,omitempty"`
+
+	// when the card expires, the remaining balance is then recognized as breakage. cards never expire if unset
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 type PurchaseCardResponse struct {
 	Transaction interface{} `json:"transaction"`
 }
 
-func PurchaseCard(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	logger.Info(ctx, "received request to purchase card")
+func (s *Server) PurchaseCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger.Debug(ctx, "received request to purchase card")
 	decoder := json.NewDecoder(r.Body)
 	var req PurchaseCardRequest
 	err := decoder.Decode(&req)
 	if err != nil {
-		logger.Error(ctx, err, "error decoding request")
-		http.Error(w, "unable to decode PurchaseCard request", http.StatusBadRequest)
+		logger.Warn(ctx, "error decoding request", "error", err)
+		writeError(w, errInvalidRequest("unable to decode PurchaseCard request: %s", err.Error()))
 		return
 	}
-	logger.Info(ctx, "got PurchaseCard request %v", req)
+	logger.Debug(ctx, "got PurchaseCard request", "request", req)
 	if req.UserName == nil || req.MerchantId == nil || req.Amount == nil {
-		logger.Error(ctx, nil, "none of userName, merchantId, or amount can be null")
-		http.Error(w, "none of userName, merchantId, or amount can be null", http.StatusBadRequest)
+		logger.Warn(ctx, "none of userName, merchantId, or amount can be null")
+		writeError(w, errInvalidRequest("none of userName, merchantId, or amount can be null"))
+		return
+	}
+	if err := validateAmount(*req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+	revenueTake, expenses := int64(0), int64(0)
+	if req.RevenueTake != nil {
+		revenueTake = *req.RevenueTake
+	}
+	if req.Expenses != nil {
+		expenses = *req.Expenses
+	}
+	if revenueTake < 0 || expenses < 0 {
+		writeError(w, newError(http.StatusBadRequest, errorCodeInvalidAmount, "revenueTake and expenses cannot be negative"))
+		return
+	}
+	if revenueTake+expenses > *req.Amount {
+		writeError(w, newError(http.StatusBadRequest, errorCodeInvalidAmount,
+			"revenueTake + expenses (%d) cannot exceed amount (%d)", revenueTake+expenses, *req.Amount))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, errInvalidRequest("expiresAt must be in the future"))
+		return
+	}
+
+	key, previous, err := s.authorizedReplay(r, *req.MerchantId, purchaseCardTransaction, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if previous != nil {
+		if err = s.reconcileAccount(detach(ctx), previous); err != nil {
+			writeError(w, errLedger(err, "error reconciling card account"))
+			return
+		}
+		writeJSON(ctx, w, PurchaseCardResponse{Transaction: previous})
 		return
 	}
 
 	// check if the provided merchant id corresponds to an existing account
-	merchantAccount, err := ledger.GetAccount(ctx, *req.MerchantId)
+	merchantAccount, err := s.ledger.GetAccount(ctx, *req.MerchantId)
 	if err != nil {
 		logger.Error(ctx, err, "error getting merchant ledger account")
-		http.Error(w, fmt.Sprintf("error getting merchant ledger account: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, errLedger(err, "error getting merchant ledger account"))
 		return
 	}
 	if merchantAccount == nil || merchantAccount.Metadata[balanceTypeKey] == nil {
-		log.Print("merchant account nil")
-		http.Error(w, fmt.Sprintf("no ledger account associated with address %s", *req.MerchantId), http.StatusBadRequest)
+		logger.Warn(ctx, "merchant account nil", "merchant_id", *req.MerchantId)
+		writeError(w, errAccountNotFound(*req.MerchantId))
 		return
 	}
 
+	// cards are denominated in the currency of their merchant
+	asset := accountAsset(merchantAccount.Metadata)
+	schedule, _, err := s.feeSchedule(ctx, *req.MerchantId, 0)
+	if err != nil {
+		writeError(w, errLedger(err, "error reading the fee schedule of merchant %s", *req.MerchantId))
+		return
+	}
+	if schedule != nil {
+		if req.RevenueTake != nil || req.Expenses != nil {
+			writeError(w, errInvalidRequest("merchant %s has a fee schedule, revenue_take and expenses are computed from it", *req.MerchantId))
+			return
+		}
+		if revenueTake, expenses, err = schedule.fees(*req.Amount); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
 	cardId := fmt.Sprintf("cards:%s", strings.Replace(uuid.NewString(), "-", "", -1))
+	// the transaction carries the metadata of the card, see createdAccount
 	metadata := map[string]interface{}{
 		transactionTypeKey: purchaseCardTransaction,
 		cardIdKey:          cardId,
-		nameKey:            req.UserName,
-		merchantIdKey:      req.MerchantId,
-	}
-	cardCreditAmount := *req.Amount
-	if req.RevenueTake != nil && *req.RevenueTake != 0 {
-		cardCreditAmount = *req.Amount - *req.RevenueTake
-	}
-	assetDebitAmount := *req.Amount
-	if req.Expenses != nil && *req.Expenses != 0 {
-		assetDebitAmount = *req.Amount - *req.Expenses
-	}
-	postings := []ledger.TransactionPosting{
-		{
-			Src:    worldAccountName,
-			Dest:   cardId,
-			Amount: cardCreditAmount,
-		},
-		{
-			Src:    worldAccountName,
-			Dest:   assetsAccountName,
-			Amount: assetDebitAmount,
-		},
-	}
-	if req.RevenueTake != nil && *req.RevenueTake != 0 {
-		postings = append(postings, ledger.TransactionPosting{
-			Src:    worldAccountName,
-			Dest:   revenueAccountName,
-			Amount: *req.RevenueTake,
-		})
-	}
-	if req.Expenses != nil && *req.Expenses != 0 {
-		postings = append(postings, ledger.TransactionPosting{
-			Src:    worldAccountName,
-			Dest:   expensesAccountName,
-			Amount: *req.Expenses,
-		})
-	}
-	txn, err := ledger.CreateTransactionWithPostings(ctx, metadata, postings)
+		nameKey:            *req.UserName,
+		merchantIdKey:      *req.MerchantId,
+		assetKey:           asset,
+	}
+	if schedule != nil {
+		metadata[feeScheduleVersionKey] = schedule.Version
+	}
+	if req.ExpiresAt != nil {
+		metadata[expiresAtKey] = req.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	// see templates/purchase_card.num
+	script, err := templateScript(string(purchaseCardTransaction), map[string]interface{}{
+		"card":         cardId,
+		"amount":       ledger.Monetary{Asset: asset, Amount: *req.Amount},
+		"revenue_take": ledger.Monetary{Asset: asset, Amount: revenueTake},
+		"expenses":     ledger.Monetary{Asset: asset, Amount: expenses},
+	})
 	if err != nil {
-		http.Error(w, "error creating transaction", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-
-	// add metadata to the account we just created
-	accountMetadata := map[string]interface{}{
-		nameKey:           *req.UserName,
-		merchantIdKey:     *req.MerchantId,
-		balanceTypeKey:    balanceTypeCredit,
-		ledgerableTypeKey: ledgerableTypeExternal,
-	}
-	err = ledger.AddMetaDataToAccount(ctx, cardId, accountMetadata)
+	txn, replayed, err := s.createFromScript(ctx, key, metadata, script)
 	if err != nil {
-		http.Error(w, "error adding metadata to account", http.StatusBadRequest)
+		writeError(w, errLedger(err, "error creating transaction"))
 		return
 	}
-	err = json.NewEncoder(w).Encode(
-		PurchaseCardResponse{
-			Transaction: txn,
-		},
-	)
-	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
+	if replayed {
+		if err = s.reconcileAccount(detach(ctx), txn); err != nil {
+			writeError(w, errLedger(err, "error reconciling card account"))
+			return
+		}
+		writeJSON(ctx, w, PurchaseCardResponse{Transaction: txn})
+		return
+	}
+
+	if err = s.addCreatedAccountMetadata(ctx, txn); err != nil {
+		writeError(w, errLedger(err, "error adding metadata to account %s", cardId))
+		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(ctx, w, PurchaseCardResponse{Transaction: txn})
 }
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPurchaseCard(t *testing.T) {
+	s, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+		wantCode   ErrorCode
+		// wantCard, wantRevenue and wantExpenses are the balances credited by a successful purchase
+		wantCard     int64
+		wantRevenue  int64
+		wantExpenses int64
+	}{
+		{
+			name:       "purchase",
+			body:       map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "1000"},
+			wantStatus: http.StatusOK,
+			wantCard:   1000,
+		},
+		{
+			name: "purchase with fees",
+			body: map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "1000",
+				"revenue_take": "100", "expenses": "30"},
+			wantStatus:   http.StatusOK,
+			wantCard:     900,
+			wantRevenue:  100,
+			wantExpenses: 30,
+		},
+		{
+			name:       "malformed body",
+			body:       `{"user_name": `,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidRequest,
+		},
+		{
+			name:       "missing amount",
+			body:       map[string]string{"user_name": "alice", "merchant_id": merchantId},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidRequest,
+		},
+		{
+			name:       "zero amount",
+			body:       map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "0"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidAmount,
+		},
+		{
+			name:       "negative fee",
+			body:       map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "1000", "expenses": "-1"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidAmount,
+		},
+		{
+			name: "fees above the amount",
+			body: map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "100",
+				"revenue_take": "60", "expenses": "50"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidAmount,
+		},
+		{
+			name: "expiry in the past",
+			body: map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "100",
+				"expires_at": time.Now().Add(-time.Hour).Format(time.RFC3339)},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidRequest,
+		},
+		{
+			name:       "unknown merchant",
+			body:       map[string]string{"user_name": "alice", "merchant_id": "merchant:missing", "amount": "100"},
+			wantStatus: http.StatusNotFound,
+			wantCode:   errorCodeAccountNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revenue, expenses := balance(t, s, revenueAccountName, "USD/2"), balance(t, s, expensesAccountName, "USD/2")
+			status, res := do(t, h, http.MethodPost, "/card/purchase", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("status: got %d, want %d: %v", status, tt.wantStatus, res)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(res); code != string(tt.wantCode) {
+					t.Fatalf("error code: got %q, want %q", code, tt.wantCode)
+				}
+				return
+			}
+
+			metadata := transactionMetadata(t, res)
+			cardId, _ := metadata[cardIdKey].(string)
+			if metadata[transactionTypeKey] != string(purchaseCardTransaction) || metadata[merchantIdKey] != merchantId {
+				t.Errorf("transaction metadata: got %v", metadata)
+			}
+			if got := balance(t, s, cardId, "USD/2"); got != tt.wantCard {
+				t.Errorf("card balance: got %d, want %d", got, tt.wantCard)
+			}
+			if got := balance(t, s, revenueAccountName, "USD/2") - revenue; got != tt.wantRevenue {
+				t.Errorf("revenue: got %d, want %d", got, tt.wantRevenue)
+			}
+			if got := balance(t, s, expensesAccountName, "USD/2") - expenses; got != tt.wantExpenses {
+				t.Errorf("expenses: got %d, want %d", got, tt.wantExpenses)
+			}
+			// the card is issued with the metadata of the transaction
+			status, res = do(t, h, http.MethodGet, "/cards/"+cardId, nil)
+			if status != http.StatusOK {
+				t.Errorf("GET /cards/%s: got %d %v", cardId, status, res)
+			}
+		})
+	}
+}
+
+func TestPurchaseCardIdempotency(t *testing.T) {
+	_, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	body := map[string]string{"user_name": "alice", "merchant_id": merchantId, "amount": "1000"}
+
+	status, first := do(t, h, http.MethodPost, "/card/purchase", body, idempotencyKeyHeader, "purchase-1")
+	if status != http.StatusOK {
+		t.Fatalf("first request: got %d %v", status, first)
+	}
+	status, replayed := do(t, h, http.MethodPost, "/card/purchase", body, idempotencyKeyHeader, "purchase-1")
+	if status != http.StatusOK {
+		t.Fatalf("replayed request: got %d %v", status, replayed)
+	}
+	if transactionMetadata(t, first)[cardIdKey] != transactionMetadata(t, replayed)[cardIdKey] {
+		t.Errorf("the replayed request issued another card: %v and %v", first, replayed)
+	}
+
+	body["amount"] = "2000"
+	status, res := do(t, h, http.MethodPost, "/card/purchase", body, idempotencyKeyHeader, "purchase-1")
+	if status != http.StatusConflict || errorCode(res) != string(errorCodeIdempotencyKeyReused) {
+		t.Errorf("reusing the key for another request: got %d %v", status, res)
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"strings"
+)
+
+// createdAccount returns the card, merchant or hold account created by txn, along with the metadata the account
+// must carry. the metadata is derived from the metadata of txn alone, so it can be replayed whenever adding
+// it after the transaction failed. ok is false when txn doesn't create an account.
+func createdAccount(txn *shared.Transaction) (address string, metadata map[string]interface{}, ok bool) {
+	var addressKey string
+	var keys []string
+	switch TransactionType(metadataValue(txn.Metadata, transactionTypeKey)) {
+	case purchaseCardTransaction:
+		addressKey = cardIdKey
+		keys = []string{nameKey, merchantIdKey, assetKey, expiresAtKey}
+	case createMerchantTransaction:
+		addressKey = merchantIdKey
+		keys = []string{nameKey, assetKey}
+	case authorizeCardTransaction:
+		addressKey = holdIdKey
+		keys = []string{cardIdKey, merchantIdKey, assetKey, expiresAtKey}
+	default:
+		return "", nil, false
+	}
+	address = metadataValue(txn.Metadata, addressKey)
+	if address == "" {
+		return "", nil, false
+	}
+	metadata = map[string]interface{}{
+		balanceTypeKey:    balanceTypeCredit,
+		ledgerableTypeKey: ledgerableTypeExternal,
+	}
+	for _, key := range keys {
+		// transactions posted before the metadata was recorded on them may miss some keys
+		if value := metadataValue(txn.Metadata, key); value != "" {
+			metadata[key] = value
+		}
+	}
+	return address, metadata, true
+}
+
+// addCreatedAccountMetadata adds its metadata to the account created by txn, even if the request is canceled
+// meanwhile as the account already exists. when adding it fails, retrying the request or the repair command adds
+// it from the transaction, see reconcileAccount and RepairAccounts.
+func (s *Server) addCreatedAccountMetadata(ctx context.Context, txn *shared.Transaction) error {
+	address, metadata, ok := createdAccount(txn)
+	if !ok {
+		return nil
+	}
+	return s.ledger.AddMetaDataToAccount(detach(ctx), address, metadata)
+}
+
+// reconcileAccount adds its metadata to the account created by txn if the account is missing it, which
+// happens when the process stopped or the ledger failed between the transaction and the metadata
+func (s *Server) reconcileAccount(ctx context.Context, txn *shared.Transaction) error {
+	address, metadata, ok := createdAccount(txn)
+	if !ok {
+		return nil
+	}
+	account, err := s.ledger.GetAccount(ctx, address)
+	if err != nil {
+		return err
+	}
+	if account != nil && metadataValue(account.Metadata, balanceTypeKey) != "" {
+		return nil
+	}
+	logger.Warn(ctx, "adding the missing metadata of account", "address", address, "txid", txn.Txid)
+	return s.ledger.AddMetaDataToAccount(ctx, address, metadata)
+}
+
+// AccountRepair is an account found without its metadata, Error is set when it couldn't be repaired
+type AccountRepair struct {
+	Address  string                 `json:"address"`
+	Txid     int64                  `json:"txid,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// RepairAccounts finds the card, merchant, hold and payout accounts missing their metadata and adds it back from the
+// transaction that created them. When dryRun is set nothing is written, the returned repairs are what
+// would have been.
+func (s *Server) RepairAccounts(ctx context.Context, dryRun bool) ([]AccountRepair, error) {
+	accounts, err := ledger.ListAllAccounts(ctx, s.ledger, ledger.AccountFilter{})
+	if err != nil {
+		return nil, err
+	}
+	repairs := make([]AccountRepair, 0)
+	for _, acct := range accounts {
+		if metadataValue(acct.Metadata, balanceTypeKey) != "" {
+			continue
+		}
+		var origin *shared.Transaction
+		switch {
+		case strings.HasPrefix(acct.Address, "cards:"):
+			origin, err = s.findPurchase(ctx, acct.Address)
+		case strings.HasPrefix(acct.Address, "merchant:"):
+			origin, err = s.findMerchantCreation(ctx, acct.Address)
+		case strings.HasPrefix(acct.Address, "holds:"):
+			origin, err = s.findAuthorization(ctx, acct.Address)
+		case strings.HasPrefix(acct.Address, "payouts:"):
+			origin, err = s.findPayoutBatch(ctx, acct.Address)
+		default:
+			continue
+		}
+		repair := AccountRepair{Address: acct.Address}
+		if err != nil {
+			repair.Error = fmt.Sprintf("error finding the transaction that created the account: %s", err.Error())
+			repairs = append(repairs, repair)
+			continue
+		}
+		if origin == nil {
+			repair.Error = "no transaction created the account"
+			repairs = append(repairs, repair)
+			continue
+		}
+		_, repair.Metadata, _ = createdAccount(origin)
+		for _, p := range batchPayouts(origin) {
+			if p.Id == acct.Address {
+				repair.Metadata = payoutMetadata(p)
+			}
+		}
+		repair.Txid = origin.Txid
+		if !dryRun {
+			if err = s.ledger.AddMetaDataToAccount(ctx, acct.Address, repair.Metadata); err != nil {
+				repair.Error = fmt.Sprintf("error adding metadata: %s", err.Error())
+			}
+		}
+		repairs = append(repairs, repair)
+	}
+	return repairs, nil
+}
+
+// findMerchantCreation returns the create_merchant transaction that created merchant, nil if there is none
+func (s *Server) findMerchantCreation(ctx context.Context, merchant string) (*shared.Transaction, error) {
+	creations, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{
+			transactionTypeKey: string(createMerchantTransaction),
+			merchantIdKey:      merchant,
+		},
+	}, ledger.Page{PageSize: 1})
+	if err != nil || len(creations.Transactions) == 0 {
+		return nil, err
+	}
+	return &creations.Transactions[0], nil
+}
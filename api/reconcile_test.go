@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"magic-ledger/ledger"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// metadataFailingLedger fails every AddMetaDataToAccount while failing is set, the transactions are still posted
+type metadataFailingLedger struct {
+	*ledger.Memory
+	failing atomic.Bool
+}
+
+func (l *metadataFailingLedger) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	if l.failing.Load() {
+		return errors.New("connection reset")
+	}
+	return l.Memory.AddMetaDataToAccount(ctx, address, metadata)
+}
+
+func TestRepairAccounts(t *testing.T) {
+	ctx := context.Background()
+	backend := &metadataFailingLedger{Memory: ledger.NewMemory()}
+	s := NewServer(backend, Options{})
+	if err := s.InitializeInternalAccounts(ctx); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	h := s.NewRouter()
+	merchant := createTestMerchant(t, h)
+
+	// the card is issued but the metadata write fails, the card has no balance_type
+	backend.failing.Store(true)
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{"user_name": "alice", "merchant_id": merchant, "amount": "1000"})
+	if status != http.StatusInternalServerError {
+		t.Fatalf("purchasing card with the metadata write failing: got %d %v", status, res)
+	}
+	backend.failing.Store(false)
+	cards, err := s.ledger.ListAccounts(ctx, ledger.AccountFilter{AddressPrefix: "cards:"}, ledger.Page{PageSize: 10})
+	if err != nil || len(cards.Accounts) != 1 {
+		t.Fatalf("listing cards: got %v %v", cards, err)
+	}
+	card := cards.Accounts[0].Address
+	if got := metadataValue(cards.Accounts[0].Metadata, balanceTypeKey); got != "" {
+		t.Fatalf("balance_type of the card before the repair: got %q, want none", got)
+	}
+
+	// the card is left out of the credits, the ledger doesn't balance
+	totals, err := s.ledgerTotals(ctx)
+	if err != nil {
+		t.Fatalf("ledgerTotals: %v", err)
+	}
+	if totals.Debits["USD/2"] != 1000 || totals.Credits["USD/2"] != 0 {
+		t.Errorf("debits and credits before the repair: got %d and %d, want 1000 and 0", totals.Debits["USD/2"], totals.Credits["USD/2"])
+	}
+
+	// a dry run reports the repair without writing it
+	repairs, err := s.RepairAccounts(ctx, true)
+	if err != nil {
+		t.Fatalf("RepairAccounts dry run: %v", err)
+	}
+	if len(repairs) != 1 || repairs[0].Address != card || repairs[0].Error != "" || metadataValue(repairs[0].Metadata, balanceTypeKey) != string(balanceTypeCredit) {
+		t.Fatalf("dry run repairs: got %+v", repairs)
+	}
+	if account, _ := s.ledger.GetAccount(ctx, card); metadataValue(account.Metadata, balanceTypeKey) != "" {
+		t.Errorf("metadata of the card after a dry run: got %v, want none", account.Metadata)
+	}
+
+	repairs, err = s.RepairAccounts(ctx, false)
+	if err != nil {
+		t.Fatalf("RepairAccounts: %v", err)
+	}
+	if len(repairs) != 1 || repairs[0].Address != card || repairs[0].Error != "" || repairs[0].Txid == 0 {
+		t.Fatalf("repairs: got %+v", repairs)
+	}
+	account, err := s.ledger.GetAccount(ctx, card)
+	if err != nil {
+		t.Fatalf("getting card: %v", err)
+	}
+	for key, want := range map[string]string{
+		nameKey:           "alice",
+		merchantIdKey:     merchant,
+		assetKey:          "USD/2",
+		balanceTypeKey:    string(balanceTypeCredit),
+		ledgerableTypeKey: string(ledgerableTypeExternal),
+	} {
+		if got := metadataValue(account.Metadata, key); got != want {
+			t.Errorf("metadata %s of the repaired card: got %q, want %q", key, got, want)
+		}
+	}
+
+	// the card is back in the credits
+	if totals, err = s.ledgerTotals(ctx); err != nil {
+		t.Fatalf("ledgerTotals: %v", err)
+	}
+	if totals.Debits["USD/2"] != 1000 || totals.Credits["USD/2"] != 1000 {
+		t.Errorf("debits and credits after the repair: got %d and %d, want 1000 and 1000", totals.Debits["USD/2"], totals.Credits["USD/2"])
+	}
+
+	// nothing is left to repair
+	if repairs, err = s.RepairAccounts(ctx, false); err != nil || len(repairs) != 0 {
+		t.Errorf("repairing again: got %+v %v, want none", repairs, err)
+	}
+}
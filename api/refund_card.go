@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"net/http"
+)
+
+type RefundCardRequest struct {
+	CardAddress *string `json:"card_address"`
+}
+
+type RefundCardResponse struct {
+	Transaction interface{} `json:"transaction"`
+}
+
+// RefundCard returns the remaining balance of a card to world. The assets, revenue and expenses postings
+// of the purchase that funded the card are unwound in proportion to the share of the card being refunded.
+func (s *Server) RefundCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	decoder := json.NewDecoder(r.Body)
+	var req RefundCardRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode RefundCard request: %s", err.Error()))
+		return
+	}
+	logger.Debug(ctx, "got RefundCard request", "request", req)
+
+	if req.CardAddress == nil {
+		writeError(w, errInvalidRequest("cardAddress cannot be null"))
+		return
+	}
+
+	key, previous, err := s.authorizedReplay(r, *req.CardAddress, refundCardTransaction, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if previous != nil {
+		writeJSON(ctx, w, RefundCardResponse{Transaction: previous})
+		return
+	}
+	account, err := s.ledger.GetAccount(ctx, *req.CardAddress)
+	if err != nil {
+		writeError(w, errLedger(err, "error getting ledger account"))
+		return
+	}
+	if account == nil {
+		writeError(w, errAccountNotFound(*req.CardAddress))
+		return
+	}
+	asset := accountAsset(account.Metadata)
+	remaining := int64(0)
+	if balance, ok := account.Balances[asset]; ok && balance != nil {
+		remaining = balance.Int64()
+	}
+	if remaining <= 0 {
+		writeError(w, errInvalidRequest("card %s has no remaining balance to refund", *req.CardAddress))
+		return
+	}
+
+	purchase, err := s.findPurchase(ctx, *req.CardAddress)
+	if err != nil {
+		writeError(w, errLedger(err, "error finding card purchase"))
+		return
+	}
+	if purchase == nil {
+		writeError(w, errInvalidRequest("no purchase transaction associated with card %s", *req.CardAddress))
+		return
+	}
+
+	metadata := map[string]interface{}{
+		transactionTypeKey: refundCardTransaction,
+		cardIdKey:          *req.CardAddress,
+		merchantIdKey:      account.Metadata[merchantIdKey],
+		nameKey:            account.Metadata[nameKey],
+		purchaseTxidKey:    purchase.Txid,
+		assetKey:           asset,
+	}
+	script, err := templateScript(string(refundCardTransaction), refundVars(*req.CardAddress, asset, remaining, purchase))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	txn, _, err := s.createFromScript(ctx, key, metadata, script)
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	writeJSON(ctx, w, RefundCardResponse{Transaction: txn})
+}
+
+// findPurchase returns the purchase_card transaction that created card, nil if there is none
+func (s *Server) findPurchase(ctx context.Context, card string) (*shared.Transaction, error) {
+	purchases, err := s.ledger.ListTransactions(ctx, ledger.TransactionFilter{
+		Metadata: map[string]string{
+			transactionTypeKey: string(purchaseCardTransaction),
+			cardIdKey:          card,
+		},
+	}, ledger.Page{PageSize: 1})
+	if err != nil || len(purchases.Transactions) == 0 {
+		return nil, err
+	}
+	return &purchases.Transactions[0], nil
+}
+
+// refundVars are the variables of templates/refund_card.num: remaining goes back to world from the card, along
+// with the same fraction of the revenue and expenses taken by purchase. revenue and expenses are rounded down and
+// assets absorbs the remainder, which keeps debits equal to credits.
+func refundVars(card string, asset string, remaining int64, purchase *shared.Transaction) map[string]interface{} {
+	var cardCredit, revenue, expenses int64
+	for _, p := range purchase.Postings {
+		if p.Asset != asset {
+			continue
+		}
+		switch p.Destination {
+		case card:
+			cardCredit += p.Amount.Int64()
+		case revenueAccountName:
+			revenue += p.Amount.Int64()
+		case expensesAccountName:
+			expenses += p.Amount.Int64()
+		}
+	}
+	revenueRefund, expensesRefund := int64(0), int64(0)
+	if cardCredit > 0 {
+		revenueRefund = revenue * remaining / cardCredit
+		expensesRefund = expenses * remaining / cardCredit
+	}
+	return map[string]interface{}{
+		"card":      card,
+		"remaining": ledger.Monetary{Asset: asset, Amount: remaining},
+		"assets":    ledger.Monetary{Asset: asset, Amount: remaining + revenueRefund - expensesRefund},
+		"revenue":   ledger.Monetary{Asset: asset, Amount: revenueRefund},
+		"expenses":  ledger.Monetary{Asset: asset, Amount: expensesRefund},
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefundCard(t *testing.T) {
+	tests := []struct {
+		name        string
+		revenueTake string
+		expenses    string
+		spend       string
+		// balances left once the card is refunded
+		wantAssets   int64
+		wantRevenue  int64
+		wantExpenses int64
+	}{
+		// no fees, the whole card goes back through the assets
+		{"no fees", "0", "0", "0", 0, 0, 0},
+		// a third is spent: 100 * 600 / 900 = 66.67 and 35 * 600 / 900 = 23.33 are refunded as 66 and 23, the
+		// assets refund 600 + 66 - 23 = 643 of their 965
+		{"partly spent", "100", "35", "300", 322, 34, 12},
+		// nothing is spent, every fee is refunded
+		{"unspent", "100", "35", "0", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, h := newTestServer(t)
+			merchant := createTestMerchant(t, h)
+			status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{
+				"user_name":    "alice",
+				"merchant_id":  merchant,
+				"amount":       "1000",
+				"revenue_take": tt.revenueTake,
+				"expenses":     tt.expenses,
+			})
+			if status != http.StatusOK {
+				t.Fatalf("purchasing card: got %d %v", status, res)
+			}
+			card := transactionMetadata(t, res)[cardIdKey].(string)
+			if tt.spend != "0" {
+				if status, res = do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": card, "amount": tt.spend}); status != http.StatusOK {
+					t.Fatalf("spending: got %d %v", status, res)
+				}
+			}
+
+			status, res = do(t, h, http.MethodPost, "/card/refund", map[string]string{"card_address": card})
+			if status != http.StatusOK {
+				t.Fatalf("refunding: got %d %v", status, res)
+			}
+			if got := transactionMetadata(t, res)[transactionTypeKey]; got != string(refundCardTransaction) {
+				t.Errorf("transaction_type: got %v, want %s", got, refundCardTransaction)
+			}
+			if got := balance(t, s, card, "USD/2"); got != 0 {
+				t.Errorf("card balance: got %d, want 0", got)
+			}
+			if got := balance(t, s, assetsAccountName, "USD/2"); got != tt.wantAssets {
+				t.Errorf("assets balance: got %d, want %d", got, tt.wantAssets)
+			}
+			if got := balance(t, s, revenueAccountName, "USD/2"); got != tt.wantRevenue {
+				t.Errorf("revenue balance: got %d, want %d", got, tt.wantRevenue)
+			}
+			if got := balance(t, s, expensesAccountName, "USD/2"); got != tt.wantExpenses {
+				t.Errorf("expenses balance: got %d, want %d", got, tt.wantExpenses)
+			}
+
+			// the card is empty, there is nothing left to refund
+			status, res = do(t, h, http.MethodPost, "/card/refund", map[string]string{"card_address": card})
+			if status != http.StatusBadRequest {
+				t.Errorf("refunding again: got %d %v, want %d", status, res, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestRefundCardNotFound(t *testing.T) {
+	_, h := newTestServer(t)
+	status, res := do(t, h, http.MethodPost, "/card/refund", map[string]string{"card_address": "card:missing"})
+	if status != http.StatusNotFound || errorCode(res) != string(errorCodeAccountNotFound) {
+		t.Errorf("refunding a missing card: got %d %v", status, res)
+	}
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"magic-ledger/logger"
+	"net/http"
+)
+
+// writeJSON renders v as the JSON body of a successful response
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(ctx, err, "error encoding response")
+	}
+}
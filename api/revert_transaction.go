@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
+	"net/http"
+	"strconv"
+)
+
+type RevertTransactionResponse struct {
+	Transaction interface{} `json:"transaction"`
+}
+
+// revertibleTransactions are the transaction types RevertTransaction reverts. the other types are posted and
+// read back by their own handlers, ex. a hold or a payout, which a reversal would leave out of step with the
+// balances
+var revertibleTransactions = map[TransactionType]bool{
+	purchaseCardTransaction: true,
+	spendCardTransaction:    true,
+}
+
+// RevertTransaction posts a reversal transaction that sends every posting of the original transaction
+// back from its destination to its source, see templates/revert_purchase_card.num and revert_spend_card.num. The reversal is posted with the reference reversal:{txid}
+// so the ledger itself guarantees a transaction is never reverted twice, the original is then tagged
+// with the txid of its reversal.
+func (s *Server) RevertTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	txid, err := strconv.ParseInt(mux.Vars(r)["txid"], 10, 64)
+	if err != nil {
+		writeError(w, errInvalidRequest("txid must be an integer"))
+		return
+	}
+	original, err := s.ledger.GetTransaction(ctx, txid)
+	if err != nil {
+		writeError(w, errLedger(err, "error getting transaction"))
+		return
+	}
+	if original == nil {
+		writeError(w, newError(http.StatusNotFound, errorCodeTransactionNotFound, "no transaction with txid %d", txid))
+		return
+	}
+	if txnType := metadataValue(original.Metadata, transactionTypeKey); !revertibleTransactions[TransactionType(txnType)] {
+		writeError(w, newError(http.StatusBadRequest, errorCodeNotRevertible,
+			"transaction %d is a %s transaction, only %s and %s transactions can be reverted", txid, txnType, purchaseCardTransaction, spendCardTransaction))
+		return
+	}
+	if revertedBy, ok := original.Metadata[revertedByKey]; ok {
+		writeError(w, errAlreadyReverted(txid, revertedBy))
+		return
+	}
+
+	metadata := map[string]interface{}{
+		transactionTypeKey: reversalTransaction,
+		revertedTxidKey:    txid,
+	}
+	for _, key := range []string{cardIdKey, merchantIdKey} {
+		if value, ok := original.Metadata[key]; ok {
+			metadata[key] = value
+		}
+	}
+	txnType := TransactionType(metadataValue(original.Metadata, transactionTypeKey))
+	vars, err := reversalVars(original, txnType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	script, err := templateScript(reversalTemplate(txnType), vars)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	reference := fmt.Sprintf("%s:%d", reversalTransaction, txid)
+	txn, err := s.postScript(ctx, metadata, script, reference)
+	if errors.Is(err, ledger.ErrDuplicateReference) {
+		// the reversal was posted but the original may not have been tagged yet, it is tagged now
+		reversal, err := s.ledger.GetTransactionByReference(ctx, reference)
+		if err != nil || reversal == nil {
+			writeError(w, newError(http.StatusConflict, errorCodeAlreadyReverted, "transaction %d has already been reverted", txid))
+			return
+		}
+		if err = s.ledger.AddMetaDataToTransaction(detach(ctx), txid, map[string]interface{}{revertedByKey: reversal.Txid}); err != nil {
+			writeError(w, errLedger(err, "error tagging reverted transaction %d", txid))
+			return
+		}
+		writeError(w, errAlreadyReverted(txid, reversal.Txid))
+		return
+	}
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	// the reversal is posted, the original is tagged even if the request is canceled meanwhile. when tagging
+	// fails, reverting it again tags it.
+	if err = s.ledger.AddMetaDataToTransaction(detach(ctx), txid, map[string]interface{}{revertedByKey: txn.Txid}); err != nil {
+		writeError(w, errLedger(err, "error tagging reverted transaction %d", txid))
+		return
+	}
+	writeJSON(ctx, w, RevertTransactionResponse{
+		Transaction: txn,
+	})
+}
+
+// reversalTemplate is the name of the template reverting a transaction of txnType
+func reversalTemplate(txnType TransactionType) string {
+	return fmt.Sprintf("revert_%s", txnType)
+}
+
+// reversalVars are the variables of the template reverting original: the amount every posting of original moved
+// between two accounts, named after the variable sending it back. a posting the template doesn't send back fails
+// the reversal rather than being left out of it.
+func reversalVars(original *shared.Transaction, txnType TransactionType) (map[string]interface{}, error) {
+	card := metadataValue(original.Metadata, cardIdKey)
+	merchant := metadataValue(original.Metadata, merchantIdKey)
+	vars := map[string]interface{}{"card": card}
+	var amounts map[[2]string]string
+	switch txnType {
+	case purchaseCardTransaction:
+		amounts = map[[2]string]string{
+			{worldAccountName, revenueAccountName}:  "revenue",
+			{worldAccountName, card}:                "card_amount",
+			{worldAccountName, expensesAccountName}: "expenses",
+			{worldAccountName, assetsAccountName}:   "assets",
+		}
+	case spendCardTransaction:
+		amounts = map[[2]string]string{{card, merchant}: "amount"}
+		vars["merchant"] = merchant
+	}
+	asset := ""
+	moved := make(map[string]int64, len(amounts))
+	for _, p := range original.Postings {
+		name, ok := amounts[[2]string{p.Source, p.Destination}]
+		if !ok || (asset != "" && p.Asset != asset) {
+			return nil, newError(http.StatusBadRequest, errorCodeNotRevertible, "transaction %d moves %s %s from %s to %s, which a reversal doesn't send back",
+				original.Txid, p.Amount, p.Asset, p.Source, p.Destination)
+		}
+		asset = p.Asset
+		moved[name] += p.Amount.Int64()
+	}
+	for _, name := range amounts {
+		vars[name] = ledger.Monetary{Asset: asset, Amount: moved[name]}
+	}
+	return vars, nil
+}
+
+func errAlreadyReverted(txid int64, revertedBy interface{}) *Error {
+	e := newError(http.StatusConflict, errorCodeAlreadyReverted, "transaction %d has already been reverted", txid)
+	e.Details = map[string]interface{}{revertedByKey: revertedBy}
+	return e
+}
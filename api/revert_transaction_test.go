@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRevertTransaction(t *testing.T) {
+	s, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	cardId := purchaseTestCard(t, h, merchantId, "1000")
+	status, res := do(t, h, http.MethodPost, "/card/spend", map[string]string{"card_address": cardId, "amount": "400"})
+	if status != http.StatusOK {
+		t.Fatalf("spending: got %d %v", status, res)
+	}
+	spend := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+	path := fmt.Sprintf("/transactions/%d/revert", spend)
+
+	status, res = do(t, h, http.MethodPost, path, nil)
+	if status != http.StatusOK {
+		t.Fatalf("reverting: got %d %v", status, res)
+	}
+	metadata := transactionMetadata(t, res)
+	if metadata[transactionTypeKey] != string(reversalTransaction) || metadata[revertedTxidKey] != float64(spend) {
+		t.Errorf("reversal metadata: got %v", metadata)
+	}
+	reversal := res["transaction"].(map[string]interface{})["txid"].(float64)
+	if got := balance(t, s, cardId, "USD/2"); got != 1000 {
+		t.Errorf("card balance after the reversal: got %d, want 1000", got)
+	}
+	original, err := s.ledger.GetTransaction(context.Background(), spend)
+	if err != nil {
+		t.Fatalf("GetTransaction: %v", err)
+	}
+	if got := fmt.Sprint(original.Metadata[revertedByKey]); got != fmt.Sprint(reversal) {
+		t.Errorf("reverted_by of the original: got %s, want %v", got, reversal)
+	}
+
+	status, res = do(t, h, http.MethodPost, path, nil)
+	details, _ := res["error"].(map[string]interface{})["details"].(map[string]interface{})
+	if status != http.StatusConflict || errorCode(res) != string(errorCodeAlreadyReverted) || details[revertedByKey] != reversal {
+		t.Errorf("reverting again: got %d %v", status, res)
+	}
+	if status, res = do(t, h, http.MethodPost, "/transactions/9999/revert", nil); status != http.StatusNotFound {
+		t.Errorf("reverting a missing transaction: got %d %v", status, res)
+	}
+
+	// a reversal, like every transaction posted by another handler, can't be reverted
+	status, res = do(t, h, http.MethodPost, fmt.Sprintf("/transactions/%d/revert", int64(reversal)), nil)
+	if status != http.StatusBadRequest || errorCode(res) != string(errorCodeNotRevertible) {
+		t.Errorf("reverting a reversal: got %d %v", status, res)
+	}
+}
+
+func TestRevertNotRevertible(t *testing.T) {
+	_, h := newHoldsTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	cardId := purchaseTestCard(t, h, merchantId, "1000")
+	status, res := do(t, h, http.MethodPost, "/card/authorize", map[string]string{"card_address": cardId, "amount": "100"})
+	if status != http.StatusOK {
+		t.Fatalf("authorizing: got %d %v", status, res)
+	}
+	authorization := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+
+	status, res = do(t, h, http.MethodPost, fmt.Sprintf("/transactions/%d/revert", authorization), nil)
+	if status != http.StatusBadRequest || errorCode(res) != string(errorCodeNotRevertible) {
+		t.Errorf("reverting an authorization: got %d %v", status, res)
+	}
+}
+
+func TestRevertPurchase(t *testing.T) {
+	s, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{
+		"user_name":    "alice",
+		"merchant_id":  merchantId,
+		"amount":       "1000",
+		"revenue_take": "100",
+		"expenses":     "30",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	cardId := transactionMetadata(t, res)[cardIdKey].(string)
+	purchase := int64(res["transaction"].(map[string]interface{})["txid"].(float64))
+
+	status, res = do(t, h, http.MethodPost, fmt.Sprintf("/transactions/%d/revert", purchase), nil)
+	if status != http.StatusOK {
+		t.Fatalf("reverting: got %d %v", status, res)
+	}
+	// every amount the purchase sent from world goes back, in reverse order
+	want := []string{
+		"assets -> world 970",
+		"expenses -> world 30",
+		cardId + " -> world 900",
+		"revenue -> world 100",
+	}
+	postings := res["transaction"].(map[string]interface{})["postings"].([]interface{})
+	if len(postings) != len(want) {
+		t.Fatalf("postings of the reversal: got %v, want %v", postings, want)
+	}
+	for i, p := range postings {
+		p := p.(map[string]interface{})
+		if got := fmt.Sprintf("%s -> %s %v", p["source"], p["destination"], p["amount"]); got != want[i] {
+			t.Errorf("posting %d: got %s, want %s", i, got, want[i])
+		}
+	}
+	for _, address := range []string{cardId, assetsAccountName, revenueAccountName, expensesAccountName} {
+		if got := balance(t, s, address, "USD/2"); got != 0 {
+			t.Errorf("%s balance after the reversal: got %d, want 0", address, got)
+		}
+	}
+}
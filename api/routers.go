@@ -2,24 +2,79 @@ package api
 
 import (
 	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
 	"net/http"
+	"time"
 )
 
+// Server holds the dependencies shared by every handler
+type Server struct {
+	ledger ledger.Backend
+	// auth is nil when authentication is disabled
+	auth *Authenticator
+	// requestTimeout bounds the routes without a timeout of their own, 0 means no timeout
+	requestTimeout time.Duration
+	// longRequestTimeout bounds the routes that walk every account of the ledger
+	longRequestTimeout time.Duration
+	// ledgerBreaker is nil when the ledger calls aren't guarded by a circuit breaker
+	ledgerBreaker *ledger.CircuitBreaker
+	// holdExpiry is how long an authorization holds the funds of a card before they are released
+	holdExpiry time.Duration
+}
+
+type Options struct {
+	// Auth authenticates every request, authentication is disabled when it is nil
+	Auth *Authenticator
+	// RequestTimeout bounds the routes without a timeout of their own, 0 means no timeout
+	RequestTimeout time.Duration
+	// LongRequestTimeout bounds the routes that walk every account of the ledger, they get RequestTimeout when it is 0
+	LongRequestTimeout time.Duration
+	// LedgerBreaker guards the calls made to the ledger, its state is reported by /readyz
+	LedgerBreaker *ledger.CircuitBreaker
+	// HoldExpiry is how long an authorization holds the funds of a card before they are released
+	HoldExpiry time.Duration
+}
+
+// NewServer returns a Server posting to backend
+func NewServer(backend ledger.Backend, opts Options) *Server {
+	return &Server{
+		ledger:             backend,
+		auth:               opts.Auth,
+		requestTimeout:     opts.RequestTimeout,
+		longRequestTimeout: opts.LongRequestTimeout,
+		ledgerBreaker:      opts.LedgerBreaker,
+		holdExpiry:         opts.HoldExpiry,
+	}
+}
+
 type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	// Roles may call the route, merchants and cardholders are further limited to their own accounts. the
+	// route is public when it is nil
+	Roles []Role
+	// Timeout bounds the handling of a request, the server's request timeout applies when it is 0
+	Timeout time.Duration
 }
 
 type Routes []Route
 
-func NewRouter() *mux.Router {
+func (s *Server) NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+	for _, route := range s.routes() {
+		timeout := route.Timeout
+		if timeout == 0 {
+			timeout = s.requestTimeout
+		}
 		var handler http.Handler
 		handler = route.HandlerFunc
+		handler = Timeout(handler, timeout)
+		handler = Authorize(handler, s.auth, route.Roles)
+		handler = Instrument(handler, route.Name)
 		handler = Logger(handler, route.Name)
+		handler = RequestID(handler)
 
 		router.
 			Methods(route.Method).
@@ -31,47 +86,232 @@ func NewRouter() *mux.Router {
 	return router
 }
 
-var routes = Routes{
-	Route{
-		"PurchaseCard",
-		http.MethodPost,
-		"/card/purchase",
-		PurchaseCard,
-	},
-	Route{
-		"SpendCard",
-		http.MethodPost,
-		"/card/spend",
-		SpendCard,
-	},
-	Route{
-		"CreateMerchant",
-		http.MethodPost,
-		"/merchant/create",
-		CreateMerchant,
-	},
-	Route{
-		"PayoutMerchant",
-		http.MethodPost,
-		"/merchant/payout",
-		PayoutMerchant,
-	},
-	Route{
-		"ListAccounts",
-		http.MethodGet,
-		"/accounts",
-		ListAccounts,
-	},
-	Route{
-		"ListTransactions",
-		http.MethodGet,
-		"/transactions",
-		ListTransactions,
-	},
-	Route{
-		"LedgerMetadata",
-		http.MethodGet,
-		"/ledger",
-		LedgerMetadata,
-	},
+func (s *Server) routes() Routes {
+	return Routes{
+		Route{
+			"PurchaseCard",
+			http.MethodPost,
+			"/card/purchase",
+			s.PurchaseCard,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"SpendCard",
+			http.MethodPost,
+			"/card/spend",
+			s.SpendCard,
+			[]Role{roleOperator, roleMerchant, roleCardholder},
+			0,
+		},
+		Route{
+			"AuthorizeCard",
+			http.MethodPost,
+			"/card/authorize",
+			s.AuthorizeCard,
+			[]Role{roleOperator, roleMerchant, roleCardholder},
+			0,
+		},
+		Route{
+			"CaptureCard",
+			http.MethodPost,
+			"/card/capture",
+			s.CaptureCard,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"VoidCard",
+			http.MethodPost,
+			"/card/void",
+			s.VoidCard,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"RefundCard",
+			http.MethodPost,
+			"/card/refund",
+			s.RefundCard,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"Breakage",
+			http.MethodPost,
+			"/card/breakage",
+			s.Breakage,
+			[]Role{roleOperator},
+			s.longRequestTimeout,
+		},
+		Route{
+			"GetCard",
+			http.MethodGet,
+			"/cards/{address}",
+			s.GetCard,
+			[]Role{roleOperator, roleMerchant, roleCardholder},
+			0,
+		},
+		Route{
+			"CreateMerchant",
+			http.MethodPost,
+			"/merchant/create",
+			s.CreateMerchant,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"PayoutMerchant",
+			http.MethodPost,
+			"/merchant/payout",
+			s.PayoutMerchant,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"GetMerchant",
+			http.MethodGet,
+			"/merchants/{address}",
+			s.GetMerchant,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"GetMerchantFees",
+			http.MethodGet,
+			"/merchants/{address}/fees",
+			s.GetMerchantFees,
+			[]Role{roleOperator, roleMerchant},
+			0,
+		},
+		Route{
+			"SetMerchantFees",
+			http.MethodPut,
+			"/merchants/{address}/fees",
+			s.SetMerchantFees,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"ListAccounts",
+			http.MethodGet,
+			"/accounts",
+			s.ListAccounts,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"ListTransactions",
+			http.MethodGet,
+			"/transactions",
+			s.ListTransactions,
+			[]Role{roleOperator, roleMerchant, roleCardholder},
+			0,
+		},
+		Route{
+			"RevertTransaction",
+			http.MethodPost,
+			"/transactions/{txid}/revert",
+			s.RevertTransaction,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"LedgerMetadata",
+			http.MethodGet,
+			"/ledger",
+			s.LedgerMetadata,
+			[]Role{roleOperator},
+			s.longRequestTimeout,
+		},
+		Route{
+			"ListPayoutBatches",
+			http.MethodGet,
+			"/payouts/batches",
+			s.ListPayoutBatches,
+			[]Role{roleOperator},
+			s.longRequestTimeout,
+		},
+		Route{
+			"CreatePayoutBatch",
+			http.MethodPost,
+			"/payouts/batches",
+			s.CreatePayoutBatch,
+			[]Role{roleOperator},
+			s.longRequestTimeout,
+		},
+		Route{
+			"GetPayoutBatch",
+			http.MethodGet,
+			"/payouts/batches/{id}",
+			s.GetPayoutBatch,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"SetPayoutStatus",
+			http.MethodPut,
+			"/payouts/{address}/status",
+			s.SetPayoutStatus,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"ListTemplates",
+			http.MethodGet,
+			"/templates",
+			s.ListTemplates,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"RunTemplate",
+			http.MethodPost,
+			"/templates/{name}",
+			s.RunTemplate,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"Healthz",
+			http.MethodGet,
+			"/healthz",
+			s.Healthz,
+			nil,
+			readinessTimeout,
+		},
+		Route{
+			"Readyz",
+			http.MethodGet,
+			"/readyz",
+			s.Readyz,
+			nil,
+			readinessTimeout,
+		},
+		Route{
+			"Metrics",
+			http.MethodGet,
+			"/metrics",
+			s.Metrics,
+			// the gauges expose the balances of the ledger
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"GetLogLevel",
+			http.MethodGet,
+			"/log/level",
+			s.GetLogLevel,
+			[]Role{roleOperator},
+			0,
+		},
+		Route{
+			"SetLogLevel",
+			http.MethodPut,
+			"/log/level",
+			s.SetLogLevel,
+			[]Role{roleOperator},
+			0,
+		},
+	}
 }
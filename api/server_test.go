@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"magic-ledger/ledger"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestServer returns a server on an in-memory ledger with its internal accounts created, along with its router
+func newTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s := NewServer(ledger.NewMemory(), Options{})
+	if err := s.InitializeInternalAccounts(context.Background()); err != nil {
+		t.Fatalf("InitializeInternalAccounts: %v", err)
+	}
+	return s, s.NewRouter()
+}
+
+// do sends body, encoded to json unless it is a string, and decodes the json response into a map
+func do(t *testing.T, h http.Handler, method string, path string, body interface{}, headers ...string) (int, map[string]interface{}) {
+	t.Helper()
+	var encoded []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		encoded = []byte(b)
+	default:
+		var err error
+		if encoded, err = json.Marshal(b); err != nil {
+			t.Fatalf("encoding request: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var res map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: decoding response %q: %v", method, path, rec.Body.String(), err)
+	}
+	return rec.Code, res
+}
+
+// transactionMetadata returns the metadata of the transaction of a successful response
+func transactionMetadata(t *testing.T, res map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	txn, ok := res["transaction"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no transaction in response %v", res)
+	}
+	metadata, _ := txn["metadata"].(map[string]interface{})
+	return metadata
+}
+
+// errorCode returns the code of an error response
+func errorCode(res map[string]interface{}) string {
+	e, _ := res["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func createTestMerchant(t *testing.T, h http.Handler) string {
+	t.Helper()
+	status, res := do(t, h, http.MethodPost, "/merchant/create", map[string]string{"merchant_name": "coffee shop"})
+	if status != http.StatusOK {
+		t.Fatalf("creating merchant: got %d %v", status, res)
+	}
+	return transactionMetadata(t, res)[merchantIdKey].(string)
+}
+
+func purchaseTestCard(t *testing.T, h http.Handler, merchantId string, amount string) string {
+	t.Helper()
+	status, res := do(t, h, http.MethodPost, "/card/purchase", map[string]string{
+		"user_name":   "alice",
+		"merchant_id": merchantId,
+		"amount":      amount,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("purchasing card: got %d %v", status, res)
+	}
+	return transactionMetadata(t, res)[cardIdKey].(string)
+}
+
+func balance(t *testing.T, s *Server, address string, asset string) int64 {
+	t.Helper()
+	account, err := s.ledger.GetAccount(context.Background(), address)
+	if err != nil {
+		t.Fatalf("GetAccount %s: %v", address, err)
+	}
+	if account == nil || account.Balances[asset] == nil {
+		return 0
+	}
+	return account.Balances[asset].Int64()
+}
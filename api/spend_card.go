@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
@@ -9,6 +8,7 @@ import (
 	"magic-ledger/logger"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type SpendCardRequest struct {
@@ -22,42 +22,68 @@ type SpendCardResponse struct {
 	Transaction interface{} `json:"transaction"`
 }
 
-func SpendCard(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) SpendCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
 	decoder := json.NewDecoder(r.Body)
 	var req SpendCardRequest
 	err := decoder.Decode(&req)
 	if err != nil {
-		http.Error(w, "unable to decode SpendCard request", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("unable to decode SpendCard request: %s", err.Error()))
 		return
 	}
-	logger.Info(ctx, "got SpendCard request %v", req)
+	logger.Debug(ctx, "got SpendCard request", "request", req)
 
 	if req.CardAddress == nil || req.Amount == nil {
-		http.Error(w, "cardAddress and amount cannot be null", http.StatusBadRequest)
+		writeError(w, errInvalidRequest("cardAddress and amount cannot be null"))
 		return
 	}
-	account, err := ledger.GetAccount(ctx, *req.CardAddress)
+	if err := validateAmount(*req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, previous, err := s.authorizedReplay(r, *req.CardAddress, spendCardTransaction, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if previous != nil {
+		writeJSON(ctx, w, SpendCardResponse{Transaction: previous})
+		return
+	}
+	account, err := s.ledger.GetAccount(ctx, *req.CardAddress)
 	if err != nil {
-		http.Error(w, "error getting ledger account", http.StatusInternalServerError)
+		writeError(w, errLedger(err, "error getting ledger account"))
 		return
 	}
 	if account == nil {
-		http.Error(w, fmt.Sprintf("no ledger account associated with address %s", *req.CardAddress), http.StatusBadRequest)
+		writeError(w, errAccountNotFound(*req.CardAddress))
 		return
 	}
 	merchantId, ok := account.Metadata[merchantIdKey]
 	if !ok {
-		http.Error(w, fmt.Sprintf("no merchant id associated with account address: %s", *req.CardAddress), http.StatusBadRequest)
+		writeError(w, errInvalidRequest("no merchant id associated with account address: %s", *req.CardAddress))
+		return
+	}
+	if expired, err := cardExpired(account.Metadata, time.Now()); err != nil {
+		writeError(w, newError(http.StatusInternalServerError, errorCodeInternal, "invalid expiry on card %s: %s", *req.CardAddress, err.Error()))
+		return
+	} else if expired {
+		writeError(w, newError(http.StatusBadRequest, errorCodeCardExpired, "card %s has expired", *req.CardAddress))
 		return
 	}
 	userName, ok := account.Metadata[nameKey]
 	if !ok {
-		http.Error(w, fmt.Sprintf("no user id associated with account address: %s", *req.CardAddress), http.StatusBadRequest)
+		writeError(w, errInvalidRequest("no user id associated with account address: %s", *req.CardAddress))
 		return
 	}
 	purchaseId := fmt.Sprintf("purchase:%s", strings.Replace(uuid.NewString(), "-", "", -1))
+	asset := accountAsset(account.Metadata)
+	if err := validateBalance(account, asset, *req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	metadata := map[string]interface{}{
 		transactionTypeKey: spendCardTransaction,
@@ -65,27 +91,22 @@ func SpendCard(w http.ResponseWriter, r *http.Request) {
 		nameKey:            userName,
 		merchantIdKey:      merchantId,
 		purchaseIdKey:      purchaseId,
+		assetKey:           asset,
 	}
-	postings := []ledger.TransactionPosting{
-		{
-			Src:    *req.CardAddress,
-			Dest:   fmt.Sprintf("%v", merchantId),
-			Amount: *req.Amount,
-		},
-	}
-	txn, err := ledger.CreateTransactionWithPostings(ctx, metadata, postings)
+	// see templates/spend_card.num
+	script, err := templateScript(string(spendCardTransaction), map[string]interface{}{
+		"card":     *req.CardAddress,
+		"merchant": fmt.Sprintf("%v", merchantId),
+		"amount":   ledger.Monetary{Asset: asset, Amount: *req.Amount},
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error creating transaction: %s", err.Error()), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(
-		SpendCardResponse{
-			Transaction: txn,
-		},
-	)
+	txn, _, err := s.createFromScript(ctx, key, metadata, script)
 	if err != nil {
-		logger.Error(ctx, err, "error encoding response")
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(ctx, w, SpendCardResponse{Transaction: txn})
 }
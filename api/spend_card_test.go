@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSpendCard(t *testing.T) {
+	s, h := newTestServer(t)
+	merchantId := createTestMerchant(t, h)
+	cardId := purchaseTestCard(t, h, merchantId, "1000")
+	expiredCardId := purchaseTestCard(t, h, merchantId, "1000")
+	err := s.ledger.AddMetaDataToAccount(context.Background(), expiredCardId, map[string]interface{}{
+		expiresAtKey: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("expiring card: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+		wantCode   ErrorCode
+		// wantBalance is the balance of the card after the request
+		wantBalance int64
+	}{
+		{
+			name:        "spend",
+			body:        map[string]string{"card_address": cardId, "amount": "300"},
+			wantStatus:  http.StatusOK,
+			wantBalance: 700,
+		},
+		{
+			name:        "spend the balance",
+			body:        map[string]string{"card_address": cardId, "amount": "700"},
+			wantStatus:  http.StatusOK,
+			wantBalance: 0,
+		},
+		{
+			name:       "insufficient funds",
+			body:       map[string]string{"card_address": cardId, "amount": "1"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInsufficientFunds,
+		},
+		{
+			name:       "missing card",
+			body:       map[string]string{"amount": "1"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidRequest,
+		},
+		{
+			name:       "negative amount",
+			body:       map[string]string{"card_address": cardId, "amount": "-5"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidAmount,
+		},
+		{
+			name:       "amount not a string",
+			body:       `{"card_address": "` + cardId + `", "amount": 5}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeInvalidRequest,
+		},
+		{
+			name:       "unknown card",
+			body:       map[string]string{"card_address": "cards:missing", "amount": "1"},
+			wantStatus: http.StatusNotFound,
+			wantCode:   errorCodeAccountNotFound,
+		},
+		{
+			name:       "expired card",
+			body:       map[string]string{"card_address": expiredCardId, "amount": "1"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeCardExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := do(t, h, http.MethodPost, "/card/spend", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("status: got %d, want %d: %v", status, tt.wantStatus, res)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(res); code != string(tt.wantCode) {
+					t.Fatalf("error code: got %q, want %q", code, tt.wantCode)
+				}
+				return
+			}
+			metadata := transactionMetadata(t, res)
+			if metadata[transactionTypeKey] != string(spendCardTransaction) || metadata[cardIdKey] != cardId ||
+				metadata[merchantIdKey] != merchantId {
+				t.Errorf("transaction metadata: got %v", metadata)
+			}
+			if got := balance(t, s, cardId, "USD/2"); got != tt.wantBalance {
+				t.Errorf("card balance: got %d, want %d", got, tt.wantBalance)
+			}
+		})
+	}
+	if got := balance(t, s, merchantId, "USD/2"); got != 1000 {
+		t.Errorf("merchant balance: got %d, want 1000", got)
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
+	"magic-ledger/templates"
+	"net/http"
+)
+
+// templateScript binds vars to the template called name, the handlers posting a transaction through its
+// template only fail here on a programming error
+func templateScript(name string, vars map[string]interface{}) (ledger.Script, error) {
+	t, ok := templates.Get(name)
+	if !ok {
+		return ledger.Script{}, newError(http.StatusInternalServerError, errorCodeInternal, "no template %s", name)
+	}
+	script, err := t.Script(vars)
+	if err != nil {
+		return ledger.Script{}, newError(http.StatusInternalServerError, errorCodeInternal, "%s", err.Error())
+	}
+	return script, nil
+}
+
+// repeatedTemplateScript binds every element of vars to a copy of the template called name, see
+// templates.Template.Repeat
+func repeatedTemplateScript(name string, vars []map[string]interface{}) (ledger.Script, error) {
+	t, ok := templates.Get(name)
+	if !ok {
+		return ledger.Script{}, newError(http.StatusInternalServerError, errorCodeInternal, "no template %s", name)
+	}
+	script, err := t.Repeat(vars)
+	if err != nil {
+		return ledger.Script{}, newError(http.StatusInternalServerError, errorCodeInternal, "%s", err.Error())
+	}
+	return script, nil
+}
+
+// handledTemplates maps the templates posted by a handler to its endpoint. the handlers check the accounts and
+// the amounts before binding them, RunTemplate refuses these templates so the checks can't be bypassed. the
+// other templates, ex. promotional_credit, have no handler and are run by RunTemplate.
+var handledTemplates = map[string]string{
+	string(purchaseCardTransaction):           "POST /card/purchase",
+	string(spendCardTransaction):              "POST /card/spend",
+	string(refundCardTransaction):             "POST /card/refund",
+	string(authorizeCardTransaction):          "POST /card/authorize",
+	string(captureCardTransaction):            "POST /card/capture",
+	string(voidCardTransaction):               "POST /card/void",
+	string(breakageTransaction):               "POST /card/breakage",
+	string(createMerchantTransaction):         "POST /merchant/create",
+	string(payoutMerchantTransaction):         "POST /merchant/payout",
+	string(merchantFeesTransaction):           "PUT /merchants/{address}/fees",
+	string(payoutBatchTransaction):            "POST /payouts/batches",
+	string(payoutSettledTransaction):          "PUT /payouts/{address}/status",
+	string(payoutFailedTransaction):           "PUT /payouts/{address}/status",
+	reversalTemplate(purchaseCardTransaction): "POST /transactions/{txid}/revert",
+	reversalTemplate(spendCardTransaction):    "POST /transactions/{txid}/revert",
+}
+
+// reservedMetadataKeys are read back by the handlers, ex. to find the purchase of a card or the reversal of a
+// transaction, a transaction posted by RunTemplate can't carry them
+var reservedMetadataKeys = []string{
+	cardIdKey, nameKey, merchantIdKey, balanceTypeKey, ledgerableTypeKey, purchaseIdKey, transactionTypeKey,
+	idempotencyHashKey, revertedTxidKey, revertedByKey, purchaseTxidKey, expiresAtKey, assetKey, feeScheduleKey,
+	feeScheduleVersionKey, batchIdKey, payoutIdKey, holdIdKey, voidReasonKey,
+}
+
+type TemplateResponse struct {
+	templates.Template
+	// Endpoint posts the template, it can't be run through POST /templates/{name} when it is set
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+type ListTemplatesResponse struct {
+	Templates []TemplateResponse `json:"templates"`
+}
+
+// ListTemplates returns the Numscript template of every transaction type along with its variables
+func (s *Server) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	all := templates.All()
+	res := ListTemplatesResponse{Templates: make([]TemplateResponse, len(all))}
+	for i, t := range all {
+		res.Templates[i] = TemplateResponse{Template: t, Endpoint: handledTemplates[t.Name]}
+	}
+	writeJSON(r.Context(), w, res)
+}
+
+type RunTemplateRequest struct {
+	// Vars holds an address for every account variable and {"asset": ..., "amount": ...} for every
+	// monetary variable of the template
+	Vars map[string]json.RawMessage `json:"vars"`
+
+	// Metadata is added to the transaction, its transaction_type is the name of the template
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type RunTemplateResponse struct {
+	Transaction interface{} `json:"transaction"`
+}
+
+// RunTemplate posts a transaction from the template named in the path, so a new transaction type only
+// needs its template, ex. promotional_credit. the templates of the built in transaction types are refused,
+// their handlers must check the accounts involved.
+func (s *Server) RunTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+	t, ok := templates.Get(name)
+	if !ok {
+		writeError(w, newError(http.StatusNotFound, errorCodeTemplateNotFound, "no template named %s", name))
+		return
+	}
+	if endpoint, ok := handledTemplates[name]; ok {
+		err := newError(http.StatusBadRequest, errorCodeTemplateHandled, "template %s is posted through %s", name, endpoint)
+		err.Details = map[string]interface{}{"endpoint": endpoint}
+		writeError(w, err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var req RunTemplateRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to decode RunTemplate request: %s", err.Error()))
+		return
+	}
+	logger.Debug(ctx, "got RunTemplate request", "template", name, "request", req)
+	for _, key := range reservedMetadataKeys {
+		if _, ok := req.Metadata[key]; ok {
+			writeError(w, errInvalidRequest("metadata %s is reserved", key))
+			return
+		}
+	}
+	vars := make(map[string]interface{}, len(req.Vars))
+	for _, v := range t.Vars {
+		raw, ok := req.Vars[v.Name]
+		if !ok {
+			continue
+		}
+		var value interface{}
+		switch v.Type {
+		case ledger.ScriptVarAccount:
+			var address string
+			err = json.Unmarshal(raw, &address)
+			value = address
+		case ledger.ScriptVarMonetary:
+			var monetary ledger.Monetary
+			err = json.Unmarshal(raw, &monetary)
+			if err == nil && monetary.Amount < 0 {
+				err = errors.New("amount cannot be negative")
+			}
+			value = monetary
+		}
+		if err != nil {
+			writeError(w, errInvalidRequest("invalid %s variable %s: %s", v.Type, v.Name, err.Error()))
+			return
+		}
+		vars[v.Name] = value
+	}
+	for name := range req.Vars {
+		if _, ok := vars[name]; !ok {
+			writeError(w, errInvalidRequest("template %s has no variable %s", t.Name, name))
+			return
+		}
+	}
+	script, err := t.Script(vars)
+	if err != nil {
+		writeError(w, errInvalidRequest("%s", err.Error()))
+		return
+	}
+	for _, v := range t.Vars {
+		if v.Type != ledger.ScriptVarAccount {
+			continue
+		}
+		if err = s.templateAccount(ctx, vars[v.Name].(string)); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	// the keys of a template don't collide with the keys of the handler posting the same transaction type
+	key, err := newIdempotencyKey(r, TransactionType("template:"+t.Name), req)
+	if err != nil {
+		writeError(w, errInvalidRequest("unable to read idempotency key: %s", err.Error()))
+		return
+	}
+	if txn, err := s.replay(ctx, key); err != nil {
+		writeError(w, errLedger(err, "error looking up idempotent request"))
+		return
+	} else if txn != nil {
+		writeJSON(ctx, w, RunTemplateResponse{Transaction: txn})
+		return
+	}
+	metadata := make(map[string]interface{}, len(req.Metadata)+1)
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+	metadata[transactionTypeKey] = t.Name
+	txn, _, err := s.createFromScript(ctx, key, metadata, script)
+	if err != nil {
+		writeError(w, errLedger(err, "error creating transaction"))
+		return
+	}
+	writeJSON(ctx, w, RunTemplateResponse{Transaction: txn})
+}
+
+// templateAccount checks that the account variable of a template without a handler names an existing card. any
+// other address, ex. a typo, would be created by the transaction without the metadata every endpoint reads.
+func (s *Server) templateAccount(ctx context.Context, address string) error {
+	account, err := s.ledger.GetAccount(ctx, address)
+	if err != nil {
+		return errLedger(err, "error getting ledger account")
+	}
+	if account == nil || metadataValue(account.Metadata, balanceTypeKey) == "" || metadataValue(account.Metadata, merchantIdKey) == "" {
+		return errAccountNotFound(address)
+	}
+	return nil
+}
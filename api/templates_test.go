@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"magic-ledger/templates"
+	"net/http"
+	"testing"
+)
+
+func TestRunTemplate(t *testing.T) {
+	s, h := newTestServer(t)
+	merchant := createTestMerchant(t, h)
+	card := purchaseTestCard(t, h, merchant, "1000")
+	purchased := balance(t, s, card, "USD/2")
+	vars := map[string]interface{}{
+		"card":   card,
+		"amount": map[string]interface{}{"asset": "USD/2", "amount": 100},
+	}
+
+	// every template of the built in transaction types is posted by its endpoint
+	for name := range handledTemplates {
+		if _, ok := templates.Get(name); !ok {
+			t.Errorf("%s: no template", name)
+		}
+		status, res := do(t, h, http.MethodPost, "/templates/"+name, map[string]interface{}{"vars": vars})
+		if status != http.StatusBadRequest || errorCode(res) != string(errorCodeTemplateHandled) {
+			t.Errorf("%s: got %d %v, want %d %s", name, status, res, http.StatusBadRequest, errorCodeTemplateHandled)
+		}
+	}
+
+	// promotional_credit has no endpoint of its own, its template is all it takes
+	tests := []struct {
+		name       string
+		body       map[string]interface{}
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{"reserved metadata", map[string]interface{}{"vars": vars, "metadata": map[string]string{cardIdKey: card}}, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"unknown variable", map[string]interface{}{"vars": map[string]interface{}{"other": card}}, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"missing variable", map[string]interface{}{"vars": map[string]interface{}{"card": card}}, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"unknown card", map[string]interface{}{"vars": map[string]interface{}{"card": "cards:missing", "amount": vars["amount"]}}, http.StatusNotFound, errorCodeAccountNotFound},
+		{"not a card", map[string]interface{}{"vars": map[string]interface{}{"card": merchant, "amount": vars["amount"]}}, http.StatusNotFound, errorCodeAccountNotFound},
+		{"posted", map[string]interface{}{"vars": vars, "metadata": map[string]string{"note": "manual"}}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := do(t, h, http.MethodPost, "/templates/promotional_credit", tt.body)
+			if status != tt.wantStatus || errorCode(res) != string(tt.wantCode) {
+				t.Fatalf("got %d %v, want %d %s", status, res, tt.wantStatus, tt.wantCode)
+			}
+			if status == http.StatusOK && transactionMetadata(t, res)[transactionTypeKey] != "promotional_credit" {
+				t.Errorf("transaction_type: got %v, want promotional_credit", transactionMetadata(t, res)[transactionTypeKey])
+			}
+		})
+	}
+	if got := balance(t, s, card, "USD/2"); got != purchased+100 {
+		t.Errorf("card balance: got %d, want %d", got, purchased+100)
+	}
+	if account, err := s.ledger.GetAccount(context.Background(), "cards:missing"); err != nil || account != nil {
+		t.Errorf("unknown card after the template was refused: got %v, %v, want no account", account, err)
+	}
+
+	status, res := do(t, h, http.MethodGet, "/templates", nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing templates: got %d %v", status, res)
+	}
+	for _, listed := range res["templates"].([]interface{}) {
+		listed := listed.(map[string]interface{})
+		if endpoint, _ := listed["endpoint"].(string); endpoint != handledTemplates[listed["name"].(string)] {
+			t.Errorf("endpoint of %s: got %q, want %q", listed["name"], endpoint, handledTemplates[listed["name"].(string)])
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"net/http"
+)
+
+// validateAmount fails with invalid_amount unless amount is strictly positive
+func validateAmount(amount int64) error {
+	if amount <= 0 {
+		e := newError(http.StatusBadRequest, errorCodeInvalidAmount, "amount must be positive, got %d", amount)
+		e.Details = map[string]interface{}{"amount": amount}
+		return e
+	}
+	return nil
+}
+
+// validateBalance fails with insufficient_funds if account holds less than amount of asset
+func validateBalance(account *shared.AccountWithVolumesAndBalances, asset string, amount int64) error {
+	available := int64(0)
+	if balance, ok := account.Balances[asset]; ok && balance != nil {
+		available = balance.Int64()
+	}
+	if amount > available {
+		e := newError(http.StatusBadRequest, errorCodeInsufficientFunds,
+			"account %s has %d %s available, cannot move %d", account.Address, available, asset, amount)
+		e.Details = map[string]interface{}{
+			"address":   account.Address,
+			"asset":     asset,
+			"available": available,
+			"requested": amount,
+		}
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"magic-ledger/logger"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes the environment variable of every setting. the variable of a setting is its yaml
+// path in upper case joined by underscores, ex. MAGIC_LEDGER_FORMANCE_CLIENT_SECRET for formance.client_secret
+const EnvPrefix = "MAGIC_LEDGER"
+
+type Config struct {
+	// ListenAddr is the address the api listens on
+	ListenAddr string         `yaml:"listen_addr"`
+	TLS        TLSConfig      `yaml:"tls"`
+	Ledger     LedgerConfig   `yaml:"ledger"`
+	Formance   FormanceConfig `yaml:"formance"`
+	SQL        SQLConfig      `yaml:"sql"`
+	Timeouts   TimeoutsConfig `yaml:"timeouts"`
+	Features   FeaturesConfig `yaml:"features"`
+	Auth       AuthConfig     `yaml:"auth"`
+	Log        LogConfig      `yaml:"log"`
+	Metrics    MetricsConfig  `yaml:"metrics"`
+}
+
+type LedgerConfig struct {
+	// Backend is one of formance, memory or sql
+	Backend string `yaml:"backend"`
+	// Name is the formance ledger the accounts and transactions live in
+	Name string `yaml:"name"`
+}
+
+type FormanceConfig struct {
+	URL string `yaml:"url"`
+	// ClientID enables oauth2 client credentials, without it ClientSecret is sent as a static bearer token
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// TokenURL is where the client credentials are exchanged for an access token, it defaults to the
+	// oauth endpoint of URL
+	TokenURL string `yaml:"token_url"`
+	// Retry retries the calls that fail for a reason other than the request, reads always and writes only
+	// when they carry an idempotency reference
+	Retry RetryConfig `yaml:"retry"`
+	// CircuitBreaker fails the calls fast while formance keeps failing
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+type RetryConfig struct {
+	// MaxAttempts counts the first call, 1 disables retries
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialInterval is the wait before the first retry, it doubles with every retry up to MaxInterval
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of failures in a row that opens the circuit, 0 disables the breaker
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout is how long the calls fail fast before one is tried again
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+type SQLConfig struct {
+	// Driver is sqlite, the embedded driver, or postgres
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+type TimeoutsConfig struct {
+	// Ledger bounds every request made to formance, 0 means no timeout
+	Ledger time.Duration `yaml:"ledger"`
+	// Request bounds the handling of an api request, 0 means no timeout. the routes walking every account
+	// are bounded by LongRequest instead.
+	Request     time.Duration `yaml:"request"`
+	LongRequest time.Duration `yaml:"long_request"`
+	// ReadHeader, Read, Write and Idle are the timeouts of the http server, 0 means no timeout. Write bounds
+	// the handling of a request along with the writing of its response, it must outlast the route timeouts.
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+	// Shutdown is how long the in-flight requests are given to complete on SIGTERM, 0 waits for them all
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// TLSConfig serves https from CertFile and KeyFile when both are set, plain http otherwise
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error, it can be changed at runtime through PUT /log/level
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+}
+
+type MetricsConfig struct {
+	// Interval is how often the ledger gauges of /metrics are computed from the balances of the ledger
+	Interval time.Duration `yaml:"interval"`
+}
+
+type FeaturesConfig struct {
+	Breakage BreakageConfig `yaml:"breakage"`
+	Payouts  PayoutsConfig  `yaml:"payouts"`
+	Holds    HoldsConfig    `yaml:"holds"`
+}
+
+type BreakageConfig struct {
+	// Enabled runs the breakage job every Interval
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// DryRun logs the breakage that would be recognized without posting it
+	DryRun bool `yaml:"dry_run"`
+}
+
+type PayoutsConfig struct {
+	// Enabled creates a payout batch every Interval
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MinAmount leaves the merchants with a smaller payable balance out of the scheduled batches
+	MinAmount int64 `yaml:"min_amount"`
+}
+
+type HoldsConfig struct {
+	// Expiry is how long an authorization holds the funds of a card, they are released to the card afterwards
+	Expiry time.Duration `yaml:"expiry"`
+	// Interval is how often the expired holds are released
+	Interval time.Duration `yaml:"interval"`
+}
+
+type AuthConfig struct {
+	// Enabled requires every request to authenticate with an api key or a jwt. it is on by default, turning it
+	// off hands every request the operator role
+	Enabled bool `yaml:"enabled"`
+	// JWTSecret verifies the HS256 signature of bearer tokens, tokens are rejected when it is empty
+	JWTSecret string         `yaml:"jwt_secret"`
+	APIKeys   []APIKeyConfig `yaml:"api_keys"`
+}
+
+// APIKeyConfig grants Role to the requests sent with Key in the X-API-Key header
+type APIKeyConfig struct {
+	Key string `yaml:"key"`
+	// Role is one of operator, merchant or cardholder
+	Role string `yaml:"role"`
+	// Account is the merchant address of a merchant, or the card address of a cardholder
+	Account string `yaml:"account"`
+}
+
+// Default is the configuration used for every setting that is neither in the file nor in the environment
+func Default() Config {
+	return Config{
+		ListenAddr: ":8080",
+		Ledger: LedgerConfig{
+			Backend: "formance",
+			Name:    "gift-card-ledger",
+		},
+		Formance: FormanceConfig{
+			Retry: RetryConfig{
+				MaxAttempts:     3,
+				InitialInterval: 100 * time.Millisecond,
+				MaxInterval:     2 * time.Second,
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				FailureThreshold: 5,
+				OpenTimeout:      30 * time.Second,
+			},
+		},
+		SQL: SQLConfig{
+			Driver: "sqlite",
+			DSN:    "file:magic-ledger.db",
+		},
+		Timeouts: TimeoutsConfig{
+			Ledger:      10 * time.Second,
+			Request:     30 * time.Second,
+			LongRequest: 5 * time.Minute,
+			ReadHeader:  10 * time.Second,
+			Read:        30 * time.Second,
+			Write:       6 * time.Minute, // outlasts the long requests
+			Idle:        2 * time.Minute,
+			Shutdown:    30 * time.Second,
+		},
+		Features: FeaturesConfig{
+			Breakage: BreakageConfig{
+				Interval: time.Hour,
+			},
+			Payouts: PayoutsConfig{
+				Interval:  24 * time.Hour,
+				MinAmount: 1,
+			},
+			Holds: HoldsConfig{
+				Expiry:   7 * 24 * time.Hour,
+				Interval: time.Hour,
+			},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Metrics: MetricsConfig{
+			Interval: time.Minute,
+		},
+		Auth: AuthConfig{
+			Enabled: true,
+		},
+	}
+}
+
+// Load reads the yaml file at path on top of Default, then applies the environment overrides. path may be
+// empty to configure the app from the environment alone. the result is not validated, see Validate.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		defer f.Close()
+		// a misspelled setting would otherwise silently keep its default
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), EnvPrefix); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate returns a *ValidationError listing every setting that is missing or invalid
+func (c Config) Validate() error {
+	var problems []string
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen_addr is required")
+	}
+	switch c.Ledger.Backend {
+	case "formance":
+		if c.Ledger.Name == "" {
+			problems = append(problems, "ledger.name is required by the formance backend")
+		}
+		problems = append(problems, validateURL("formance.url", c.Formance.URL, true)...)
+		problems = append(problems, validateURL("formance.token_url", c.Formance.TokenURL, false)...)
+		if c.Formance.ClientSecret == "" {
+			problems = append(problems, "formance.client_secret is required by the formance backend")
+		}
+		if c.Formance.Retry.MaxAttempts < 1 {
+			problems = append(problems, "formance.retry.max_attempts must be at least 1")
+		}
+		if c.Formance.Retry.InitialInterval < 0 || c.Formance.Retry.MaxInterval < c.Formance.Retry.InitialInterval {
+			problems = append(problems, "formance.retry.initial_interval cannot be negative nor longer than formance.retry.max_interval")
+		}
+		if c.Formance.CircuitBreaker.FailureThreshold < 0 {
+			problems = append(problems, "formance.circuit_breaker.failure_threshold cannot be negative")
+		}
+		if c.Formance.CircuitBreaker.FailureThreshold > 0 && c.Formance.CircuitBreaker.OpenTimeout <= 0 {
+			problems = append(problems, "formance.circuit_breaker.open_timeout must be positive when the breaker is enabled")
+		}
+	case "memory":
+	case "sql":
+		if c.SQL.Driver != "sqlite" && c.SQL.Driver != "postgres" {
+			problems = append(problems, fmt.Sprintf("sql.driver must be sqlite or postgres, got %q", c.SQL.Driver))
+		}
+		if c.SQL.DSN == "" {
+			problems = append(problems, "sql.dsn is required by the sql backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("ledger.backend must be one of formance, memory or sql, got %q", c.Ledger.Backend))
+	}
+	if c.Timeouts.Ledger < 0 {
+		problems = append(problems, "timeouts.ledger cannot be negative")
+	}
+	if c.Timeouts.Request < 0 {
+		problems = append(problems, "timeouts.request cannot be negative")
+	}
+	serverTimeouts := []struct {
+		setting string
+		timeout time.Duration
+	}{
+		{"timeouts.read_header", c.Timeouts.ReadHeader},
+		{"timeouts.read", c.Timeouts.Read},
+		{"timeouts.write", c.Timeouts.Write},
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+	}
+	for _, t := range serverTimeouts {
+		if t.timeout < 0 {
+			problems = append(problems, fmt.Sprintf("%s cannot be negative", t.setting))
+		}
+	}
+	if c.Timeouts.LongRequest <= 0 {
+		problems = append(problems, "timeouts.long_request must be positive")
+	}
+	// the server cuts off any response still being handled after the write timeout
+	longest := c.Timeouts.Request
+	if c.Timeouts.LongRequest > longest {
+		longest = c.Timeouts.LongRequest
+	}
+	if c.Timeouts.Write > 0 && (c.Timeouts.Request == 0 || c.Timeouts.Write <= longest) {
+		problems = append(problems, "timeouts.write must be longer than timeouts.request and timeouts.long_request, the responses couldn't be written otherwise")
+	}
+	problems = append(problems, c.TLS.validate()...)
+	if c.Features.Breakage.Enabled && c.Features.Breakage.Interval <= 0 {
+		problems = append(problems, "features.breakage.interval must be positive when the breakage job is enabled")
+	}
+	if c.Features.Payouts.Enabled && c.Features.Payouts.Interval <= 0 {
+		problems = append(problems, "features.payouts.interval must be positive when scheduled payouts are enabled")
+	}
+	if c.Features.Payouts.MinAmount < 1 {
+		problems = append(problems, "features.payouts.min_amount must be positive")
+	}
+	if c.Features.Holds.Expiry <= 0 {
+		problems = append(problems, "features.holds.expiry must be positive")
+	}
+	if c.Features.Holds.Interval <= 0 {
+		problems = append(problems, "features.holds.interval must be positive")
+	}
+	problems = append(problems, c.Auth.validate()...)
+	if _, err := logger.ParseLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %s", err.Error()))
+	}
+	if _, err := logger.ParseFormat(c.Log.Format); err != nil {
+		problems = append(problems, fmt.Sprintf("log.format: %s", err.Error()))
+	}
+	if c.Metrics.Interval <= 0 {
+		problems = append(problems, "metrics.interval must be positive")
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (a AuthConfig) validate() []string {
+	if !a.Enabled {
+		return nil
+	}
+	var problems []string
+	if a.JWTSecret == "" && len(a.APIKeys) == 0 {
+		problems = append(problems, "auth.jwt_secret or auth.api_keys is required when auth is enabled, set auth.enabled to false to run without auth")
+	}
+	keys := make(map[string]bool, len(a.APIKeys))
+	for i, k := range a.APIKeys {
+		switch {
+		case k.Key == "":
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d].key is required", i))
+		case keys[k.Key]:
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d].key is used by another api key", i))
+		}
+		keys[k.Key] = true
+		switch k.Role {
+		case "operator":
+		case "merchant", "cardholder":
+			if k.Account == "" {
+				problems = append(problems, fmt.Sprintf("auth.api_keys[%d].account is required for the %s role", i, k.Role))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d].role must be one of operator, merchant or cardholder, got %q", i, k.Role))
+		}
+	}
+	return problems
+}
+
+func (t TLSConfig) validate() []string {
+	if t.CertFile == "" && t.KeyFile == "" {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return []string{"tls.cert_file and tls.key_file must be set together"}
+	}
+	var problems []string
+	if _, err := os.Stat(t.CertFile); err != nil {
+		problems = append(problems, fmt.Sprintf("tls.cert_file: %s", err.Error()))
+	}
+	if _, err := os.Stat(t.KeyFile); err != nil {
+		problems = append(problems, fmt.Sprintf("tls.key_file: %s", err.Error()))
+	}
+	return problems
+}
+
+func validateURL(setting string, value string, required bool) []string {
+	if value == "" {
+		if required {
+			return []string{fmt.Sprintf("%s is required by the formance backend", setting)}
+		}
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return []string{fmt.Sprintf("%s must be an absolute url, got %q", setting, value)}
+	}
+	return nil
+}
+
+// applyEnv overrides every field of v with the environment variable named after its yaml path
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		name := prefix + "_" + strings.ToUpper(tag)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		// lists, like the api keys, can only be set in the file
+		if field.Kind() == reflect.Slice {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the default configuration on the memory backend, which needs no other setting than the
+// credentials of the auth
+func validConfig() Config {
+	cfg := Default()
+	cfg.Ledger.Backend = "memory"
+	cfg.Auth.JWTSecret = "secret"
+	return cfg
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     time.Duration
+		longRequest time.Duration
+		write       time.Duration
+		wantProblem string
+	}{
+		{"defaults", 30 * time.Second, 5 * time.Minute, 6 * time.Minute, ""},
+		{"no write timeout", 30 * time.Second, 5 * time.Minute, 0, ""},
+		{"write shorter than the long requests", 30 * time.Second, 5 * time.Minute, time.Minute, "timeouts.write"},
+		{"write shorter than the requests", 10 * time.Minute, 5 * time.Minute, 6 * time.Minute, "timeouts.write"},
+		{"requests without timeout", 0, 5 * time.Minute, 6 * time.Minute, "timeouts.write"},
+		{"long requests without timeout", 30 * time.Second, 0, 6 * time.Minute, "timeouts.long_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Timeouts.Request = tt.request
+			cfg.Timeouts.LongRequest = tt.longRequest
+			cfg.Timeouts.Write = tt.write
+			err := cfg.Validate()
+			if tt.wantProblem == "" {
+				if err != nil {
+					t.Fatalf("got %v, want a valid config", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), tt.wantProblem) {
+				t.Fatalf("got %v, want a problem with %s", err, tt.wantProblem)
+			}
+		})
+	}
+}
+
+func TestValidateSQLDriver(t *testing.T) {
+	for driver, valid := range map[string]bool{"sqlite": true, "postgres": true, "mysql": false, "": false} {
+		cfg := validConfig()
+		cfg.Ledger.Backend = "sql"
+		cfg.SQL.Driver = driver
+		if err := cfg.Validate(); (err == nil) != valid {
+			t.Errorf("sql.driver %q: got %v, want valid %t", driver, err, valid)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	// auth is on by default, it needs credentials unless it is turned off
+	cfg := validConfig()
+	cfg.Auth.JWTSecret = ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "auth.jwt_secret") {
+		t.Errorf("default auth without credentials: got %v, want a problem with auth.jwt_secret", err)
+	}
+	cfg.Auth.Enabled = false
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("auth turned off: got %v, want a valid config", err)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	t.Setenv(EnvPrefix+"_LEDGER_BACKEND", "memory")
+	t.Setenv(EnvPrefix+"_AUTH_JWT_SECRET", "secret")
+	path, err := filepath.Abs("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("example config: %v", err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if !cfg.Auth.Enabled {
+		t.Errorf("the example config turns auth off")
+	}
+	if len(cfg.Auth.APIKeys) != 0 {
+		t.Errorf("the example config ships %d api keys, want none", len(cfg.Auth.APIKeys))
+	}
+}
@@ -0,0 +1,338 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// backendTests are the cases every Backend kept by this package passes, the memory and sql tests run them
+var backendTests = []struct {
+	name string
+	test func(t *testing.T, b Backend)
+}{
+	{"balances", testBalances},
+	{"pagination", testPagination},
+	{"duplicate reference", testDuplicateReference},
+	{"concurrent reference", testConcurrentReference},
+	{"account metadata", testAccountMetadata},
+	{"transaction metadata", testTransactionMetadata},
+}
+
+// testBackend runs backendTests, each on a new empty backend
+func testBackend(t *testing.T, newBackend func(t *testing.T) Backend) {
+	for _, tt := range backendTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newBackend(t))
+		})
+	}
+}
+
+func post(t *testing.T, backend Backend, reference string, postings ...TransactionPosting) {
+	t.Helper()
+	_, err := backend.CreateTransactionWithPostings(context.Background(), map[string]interface{}{"transaction_type": "test"}, postings, reference)
+	if err != nil {
+		t.Fatalf("CreateTransactionWithPostings: %v", err)
+	}
+}
+
+func testBalances(t *testing.T, b Backend) {
+	ctx := context.Background()
+	post(t, b, "", TransactionPosting{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 100})
+	post(t, b, "",
+		TransactionPosting{Src: "card:a", Dest: "merchant:m", Asset: "USD/2", Amount: 30},
+		TransactionPosting{Src: "card:a", Dest: "revenue", Asset: "USD/2", Amount: 5},
+	)
+
+	_, err := b.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{
+		{Src: "card:a", Dest: "merchant:m", Asset: "USD/2", Amount: 1000},
+	}, "")
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overdrawing a card: got %v, want %v", err, ErrInsufficientFunds)
+	}
+	// the first posting is covered, the second is not: neither is applied
+	_, err = b.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{
+		{Src: "card:a", Dest: "merchant:m", Asset: "USD/2", Amount: 60},
+		{Src: "card:a", Dest: "revenue", Asset: "USD/2", Amount: 10},
+	}, "")
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overdrawing a card across postings: got %v, want %v", err, ErrInsufficientFunds)
+	}
+
+	balances, err := b.ListBalances(ctx)
+	if err != nil {
+		t.Fatalf("ListBalances: %v", err)
+	}
+	want := map[string]map[string]int64{
+		WorldAccount: {"USD/2": -100},
+		"card:a":     {"USD/2": 65},
+		"merchant:m": {"USD/2": 30},
+		"revenue":    {"USD/2": 5},
+	}
+	if !reflect.DeepEqual(balances, want) {
+		t.Fatalf("ListBalances: got %v, want %v", balances, want)
+	}
+	balances, err = b.ListBalances(ctx, "card:a", "revenue", "card:missing")
+	if err != nil {
+		t.Fatalf("ListBalances of some accounts: %v", err)
+	}
+	want = map[string]map[string]int64{
+		"card:a":  {"USD/2": 65},
+		"revenue": {"USD/2": 5},
+	}
+	if !reflect.DeepEqual(balances, want) {
+		t.Fatalf("ListBalances of some accounts: got %v, want %v", balances, want)
+	}
+
+	account, err := b.GetAccount(ctx, "card:a")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if got := account.Balances["USD/2"].Int64(); got != 65 {
+		t.Errorf("balance of card:a: got %d, want 65", got)
+	}
+	if in, out := account.Volumes["USD/2"]["input"].Int64(), account.Volumes["USD/2"]["output"].Int64(); in != 100 || out != 35 {
+		t.Errorf("volumes of card:a: got input %d output %d, want 100 and 35", in, out)
+	}
+	if account, err = b.GetAccount(ctx, "card:missing"); err != nil || account != nil {
+		t.Errorf("GetAccount of a missing account: got %v, %v, want nil", account, err)
+	}
+
+	txn, err := b.GetTransaction(ctx, 1)
+	if err != nil || txn == nil {
+		t.Fatalf("GetTransaction: got %v, %v", txn, err)
+	}
+	if len(txn.Postings) != 2 || txn.Postings[1].Destination != "revenue" || txn.Postings[1].Amount.Int64() != 5 {
+		t.Errorf("postings of txid 1: got %+v", txn.Postings)
+	}
+	if got := txn.Metadata["transaction_type"]; got != "test" {
+		t.Errorf("metadata of txid 1: got transaction_type %v, want test", got)
+	}
+}
+
+func testPagination(t *testing.T, b Backend) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		post(t, b, "", TransactionPosting{Src: WorldAccount, Dest: fmt.Sprintf("card:%d", i), Asset: "USD/2", Amount: 1})
+	}
+
+	post(t, b, "", TransactionPosting{Src: WorldAccount, Dest: "cards_other", Asset: "USD/2", Amount: 1})
+
+	accountTests := []struct {
+		filter AccountFilter
+		want   []string
+	}{
+		{AccountFilter{}, []string{"card:0", "card:1", "card:2", "card:3", "card:4", "cards_other", WorldAccount}},
+		// the prefix is matched as is, the filter of the first page is kept by the cursors
+		{AccountFilter{AddressPrefix: "card:"}, []string{"card:0", "card:1", "card:2", "card:3", "card:4"}},
+		{AccountFilter{AddressPrefix: "card_"}, nil},
+	}
+	for _, tt := range accountTests {
+		var addresses []string
+		page := Page{PageSize: 2}
+		for pages := 0; ; pages++ {
+			if pages > 4 {
+				t.Fatalf("ListAccounts never returned its last page")
+			}
+			res, err := b.ListAccounts(ctx, tt.filter, page)
+			if err != nil {
+				t.Fatalf("ListAccounts: %v", err)
+			}
+			if len(res.Accounts) > 2 {
+				t.Fatalf("ListAccounts: got a page of %d accounts, want at most 2", len(res.Accounts))
+			}
+			for _, account := range res.Accounts {
+				addresses = append(addresses, account.Address)
+			}
+			if res.Next == "" {
+				break
+			}
+			page = Page{Cursor: res.Next}
+		}
+		if !reflect.DeepEqual(addresses, tt.want) {
+			t.Fatalf("ListAccounts %+v: got %v, want %v", tt.filter, addresses, tt.want)
+		}
+	}
+
+	var txids []int64
+	page := Page{PageSize: 2}
+	filter := TransactionFilter{Metadata: map[string]string{"transaction_type": "test"}}
+	for {
+		res, err := b.ListTransactions(ctx, filter, page)
+		if err != nil {
+			t.Fatalf("ListTransactions: %v", err)
+		}
+		for _, txn := range res.Transactions {
+			txids = append(txids, txn.Txid)
+		}
+		if res.Next == "" {
+			break
+		}
+		// the filter is carried by the cursor, the filter passed with it is ignored
+		filter = TransactionFilter{Account: "card:missing"}
+		page = Page{Cursor: res.Next}
+	}
+	if want := []int64{5, 4, 3, 2, 1, 0}; !reflect.DeepEqual(txids, want) {
+		t.Fatalf("ListTransactions: got %v, want %v", txids, want)
+	}
+
+	res, err := b.ListTransactions(ctx, TransactionFilter{Account: "card:3"}, Page{})
+	if err != nil {
+		t.Fatalf("ListTransactions of card:3: %v", err)
+	}
+	if len(res.Transactions) != 1 || res.Transactions[0].Txid != 3 || res.Next != "" {
+		t.Errorf("ListTransactions of card:3: got %+v", res)
+	}
+
+	if _, err = b.ListAccounts(ctx, AccountFilter{}, Page{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("ListAccounts with an invalid cursor: got %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func testDuplicateReference(t *testing.T, b Backend) {
+	ctx := context.Background()
+	posting := TransactionPosting{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 10}
+	post(t, b, "purchase_card:1", posting)
+
+	_, err := b.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{posting}, "purchase_card:1")
+	if !errors.Is(err, ErrDuplicateReference) {
+		t.Fatalf("reposting a reference: got %v, want %v", err, ErrDuplicateReference)
+	}
+	txn, err := b.GetTransactionByReference(ctx, "purchase_card:1")
+	if err != nil || txn == nil || txn.Txid != 0 {
+		t.Fatalf("GetTransactionByReference: got %+v, %v, want txid 0", txn, err)
+	}
+	account, err := b.GetAccount(ctx, "card:a")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if got := account.Balances["USD/2"].Int64(); got != 10 {
+		t.Errorf("balance after a duplicate: got %d, want 10", got)
+	}
+
+	// the rejected transaction doesn't use up a txid
+	txn, err = b.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{posting}, "purchase_card:2")
+	if err != nil || txn.Txid != 1 {
+		t.Fatalf("posting after a duplicate: got %+v, %v, want txid 1", txn, err)
+	}
+}
+
+func testConcurrentReference(t *testing.T, b Backend) {
+	ctx := context.Background()
+	const writers = 8
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = b.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{
+				{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 10},
+			}, "purchase_card:1")
+		}(i)
+	}
+	wg.Wait()
+
+	posted := 0
+	for _, err := range errs {
+		if err == nil {
+			posted++
+		} else if !errors.Is(err, ErrDuplicateReference) {
+			t.Errorf("concurrent writer: got %v, want nil or %v", err, ErrDuplicateReference)
+		}
+	}
+	if posted != 1 {
+		t.Fatalf("concurrent writers: %d posted the reference, want 1", posted)
+	}
+}
+
+func testAccountMetadata(t *testing.T, b Backend) {
+	ctx := context.Background()
+	post(t, b, "", TransactionPosting{Src: WorldAccount, Dest: "card:b", Asset: "USD/2", Amount: 1})
+
+	metadata := map[string]interface{}{
+		"balance_type": "credit",
+		"expires_at":   "2030-01-01T00:00:00Z",
+		"count":        float64(3),
+		"fee_schedule": map[string]interface{}{"version": float64(1)},
+	}
+	if err := b.AddMetaDataToAccount(ctx, "card:a", metadata); err != nil {
+		t.Fatalf("AddMetaDataToAccount: %v", err)
+	}
+	if err := b.AddMetaDataToAccount(ctx, "card:a", map[string]interface{}{"count": float64(4)}); err != nil {
+		t.Fatalf("AddMetaDataToAccount: %v", err)
+	}
+	metadata["count"] = float64(4)
+
+	account, err := b.GetAccount(ctx, "card:a")
+	if err != nil || account == nil {
+		t.Fatalf("GetAccount: got %v, %v", account, err)
+	}
+	if !reflect.DeepEqual(account.Metadata, metadata) {
+		t.Errorf("GetAccount metadata: got %v, want %v", account.Metadata, metadata)
+	}
+
+	res, err := b.ListAccounts(ctx, AccountFilter{}, Page{})
+	if err != nil {
+		t.Fatalf("ListAccounts: %v", err)
+	}
+	got := make(map[string]map[string]interface{})
+	for _, account := range res.Accounts {
+		got[account.Address] = account.Metadata
+	}
+	want := map[string]map[string]interface{}{
+		"card:a":     metadata,
+		"card:b":     {},
+		WorldAccount: {},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAccounts metadata: got %v, want %v", got, want)
+	}
+
+	// a string matches as is, any other value by its json text
+	filterTests := []struct {
+		metadata map[string]string
+		want     []string
+	}{
+		{map[string]string{"balance_type": "credit"}, []string{"card:a"}},
+		{map[string]string{"balance_type": "credit", "count": "4"}, []string{"card:a"}},
+		{map[string]string{"balance_type": "credit", "count": "3"}, nil},
+		{map[string]string{"balance_type": "debit"}, nil},
+		{map[string]string{"missing": ""}, nil},
+	}
+	for _, tt := range filterTests {
+		res, err := b.ListAccounts(ctx, AccountFilter{AddressPrefix: "card:", Metadata: tt.metadata}, Page{})
+		if err != nil {
+			t.Fatalf("ListAccounts %v: %v", tt.metadata, err)
+		}
+		var addresses []string
+		for _, account := range res.Accounts {
+			addresses = append(addresses, account.Address)
+		}
+		if !reflect.DeepEqual(addresses, tt.want) {
+			t.Errorf("ListAccounts %v: got %v, want %v", tt.metadata, addresses, tt.want)
+		}
+	}
+}
+
+func testTransactionMetadata(t *testing.T, b Backend) {
+	ctx := context.Background()
+	post(t, b, "", TransactionPosting{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 1})
+	if err := b.AddMetaDataToTransaction(ctx, 0, map[string]interface{}{"reverted_by": float64(1)}); err != nil {
+		t.Fatalf("AddMetaDataToTransaction: %v", err)
+	}
+	txn, err := b.GetTransaction(ctx, 0)
+	if err != nil {
+		t.Fatalf("GetTransaction: %v", err)
+	}
+	want := map[string]interface{}{"transaction_type": "test", "reverted_by": float64(1)}
+	if !reflect.DeepEqual(txn.Metadata, want) {
+		t.Errorf("metadata: got %v, want %v", txn.Metadata, want)
+	}
+	if err = b.AddMetaDataToTransaction(ctx, 7, map[string]interface{}{"reverted_by": 1}); err == nil {
+		t.Errorf("AddMetaDataToTransaction of a missing transaction: got no error")
+	}
+}
@@ -0,0 +1,131 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"magic-ledger/logger"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the ledger while the circuit breaker is open
+var ErrCircuitOpen = errors.New("ledger circuit breaker is open")
+
+type CircuitState string
+
+const (
+	// CircuitClosed lets every call through
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails every call right away
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single trial call through, its outcome closes or opens the circuit again
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// CircuitBreaker stops calling a ledger that failed FailureThreshold times in a row, for OpenTimeout. only
+// the failures of the ledger itself count, not the errors it attributes to the request.
+type CircuitBreaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// trial is set while the call let through by the half open circuit is running
+	trial bool
+	// generation is incremented every time the circuit opens, the calls let through before then can't
+	// report on the circuit anymore
+	generation uint64
+}
+
+// breakerCall is a call let through by allow, its outcome is reported with record or abandon
+type breakerCall struct {
+	generation uint64
+	trial      bool
+}
+
+// NewCircuitBreaker returns a closed circuit breaker, it never opens when failureThreshold is 0
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		state:            CircuitClosed,
+	}
+}
+
+// State returns the state of the circuit, and when it was opened if it isn't closed
+func (b *CircuitBreaker) State() (CircuitState, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openTimeout {
+		return CircuitHalfOpen, b.openedAt
+	}
+	return b.state, b.openedAt
+}
+
+// allow fails with ErrCircuitOpen unless a call may be made now
+func (b *CircuitBreaker) allow(ctx context.Context) (breakerCall, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	call := breakerCall{generation: b.generation}
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return call, ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		logger.Info(ctx, "ledger circuit breaker half open, trying a call")
+		fallthrough
+	case CircuitHalfOpen:
+		if b.trial {
+			return call, ErrCircuitOpen
+		}
+		b.trial = true
+		call.trial = true
+	}
+	return call, nil
+}
+
+// abandon reports a call let through by allow that the caller gave up on, it tells nothing of the ledger
+func (b *CircuitBreaker) abandon(call breakerCall) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if call.trial && call.generation == b.generation {
+		b.trial = false
+	}
+}
+
+// record reports the outcome of a call let through by allow. the outcome of a call let through before the
+// circuit last opened is ignored, only the trial call decides whether a half open circuit closes.
+func (b *CircuitBreaker) record(ctx context.Context, call breakerCall, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if call.generation != b.generation {
+		return
+	}
+	if call.trial {
+		b.trial = false
+	}
+	if !failed {
+		if b.state != CircuitClosed {
+			logger.Info(ctx, "ledger circuit breaker closed")
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failureThreshold <= 0 {
+		return
+	}
+	if (b.state == CircuitHalfOpen && call.trial) || (b.state == CircuitClosed && b.failures >= b.failureThreshold) {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+		b.generation++
+		logger.Warn(ctx, "ledger circuit breaker opened, failing fast",
+			"consecutive_failures", b.failures,
+			"open_for", b.openTimeout,
+		)
+	}
+}
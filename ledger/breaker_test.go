@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerIgnoresStaleCalls(t *testing.T) {
+	ctx := context.Background()
+	b := NewCircuitBreaker(1, time.Millisecond)
+	failing, err := b.allow(ctx)
+	if err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	stale, err := b.allow(ctx)
+	if err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	b.record(ctx, failing, true)
+	if state, _ := b.State(); state != CircuitOpen {
+		t.Fatalf("after a failure: got %s, want %s", state, CircuitOpen)
+	}
+	if _, err = b.allow(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow while open: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	trial, err := b.allow(ctx)
+	if err != nil || !trial.trial {
+		t.Fatalf("allow once half open: got %+v, %v, want a trial", trial, err)
+	}
+	// the call let through before the circuit opened returns during the trial
+	b.record(ctx, stale, false)
+	if state, _ := b.State(); state != CircuitHalfOpen {
+		t.Fatalf("after a stale success: got %s, want %s", state, CircuitHalfOpen)
+	}
+	if _, err = b.allow(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow during the trial: got %v, want %v", err, ErrCircuitOpen)
+	}
+	b.abandon(stale)
+	if _, err = b.allow(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow after abandoning a stale call: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	b.record(ctx, trial, true)
+	if state, _ := b.State(); state != CircuitOpen {
+		t.Fatalf("after a failed trial: got %s, want %s", state, CircuitOpen)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if trial, err = b.allow(ctx); err != nil {
+		t.Fatalf("allow once half open again: %v", err)
+	}
+	b.record(ctx, trial, false)
+	if state, _ := b.State(); state != CircuitClosed {
+		t.Fatalf("after a successful trial: got %s, want %s", state, CircuitClosed)
+	}
+}
@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrDuplicateReference is returned when a transaction is posted with a reference that is already in use
+	ErrDuplicateReference = errors.New("duplicate transaction reference")
+	// ErrInvalidPostings is returned when a transaction is rejected before any of its postings is applied
+	ErrInvalidPostings = errors.New("invalid postings")
+	// ErrInvalidCursor is returned when a list is requested with a cursor the backend did not issue
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// FormanceError is returned when formance answers a request with an error status. it unwraps to the
+// matching error of this package when formance reports an insufficient fund, conflict, validation or script error.
+type FormanceError struct {
+	Operation  string
+	StatusCode int
+	Code       shared.ErrorsEnum
+	Message    string
+	Details    string
+}
+
+func (e *FormanceError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("formance %s failed with status code %d", e.Operation, e.StatusCode)
+	}
+	return fmt.Sprintf("formance %s failed with status code %d: %s", e.Operation, e.StatusCode, e.Message)
+}
+
+func (e *FormanceError) Unwrap() error {
+	switch e.Code {
+	case shared.ErrorsEnumInsufficientFund:
+		return ErrInsufficientFunds
+	case shared.ErrorsEnumConflict:
+		return ErrDuplicateReference
+	case shared.ErrorsEnumValidation, shared.ErrorsEnumCompilationFailed, shared.ErrorsEnumNoScript:
+		return ErrInvalidPostings
+	}
+	return nil
+}
+
+// formanceError builds the error returned for a formance response with an error status
+func formanceError(operation string, statusCode int, res *shared.ErrorResponse) error {
+	err := &FormanceError{
+		Operation:  operation,
+		StatusCode: statusCode,
+	}
+	if res != nil {
+		if res.ErrorCode != nil {
+			err.Code = *res.ErrorCode
+		}
+		if res.ErrorMessage != nil {
+			err.Message = *res.ErrorMessage
+		}
+		if res.Details != nil {
+			err.Details = *res.Details
+		}
+	}
+	return err
+}
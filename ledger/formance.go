@@ -0,0 +1,346 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go"
+	"github.com/formancehq/formance-sdk-go/pkg/models/operations"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	time2 "time"
+)
+
+// Formance is a Backend that stores the ledger in a formance instance
+type Formance struct {
+	client *formance.Formance
+	ledger string
+}
+
+// FormanceOptions configures the connection to a formance instance
+type FormanceOptions struct {
+	ServerURL string
+	// Ledger is the name of the formance ledger the accounts and transactions live in
+	Ledger string
+	// ClientID and ClientSecret are exchanged at TokenURL for the access token sent with every request.
+	// without a ClientID, ClientSecret is sent as a static bearer token instead.
+	ClientID     string
+	ClientSecret string
+	// TokenURL defaults to the oauth endpoint of ServerURL
+	TokenURL string
+	// Timeout bounds every request made to formance, 0 means no timeout
+	Timeout time2.Duration
+}
+
+func NewFormance(opts FormanceOptions) *Formance {
+	client := &http.Client{Timeout: opts.Timeout}
+	sdkOpts := []formance.SDKOption{
+		formance.WithServerURL(opts.ServerURL),
+		formance.WithClient(client),
+	}
+	if opts.ClientID != "" {
+		tokenURL := opts.TokenURL
+		if tokenURL == "" {
+			tokenURL = strings.TrimSuffix(opts.ServerURL, "/") + "/api/auth/oauth/token"
+		}
+		client.Transport = &oauthTransport{
+			source: NewTokenSource(tokenURL, opts.ClientID, opts.ClientSecret, &http.Client{Timeout: opts.Timeout}),
+			base:   http.DefaultTransport,
+		}
+	} else {
+		sdkOpts = append(sdkOpts, formance.WithSecurity(shared.Security{
+			Authorization: fmt.Sprintf("Bearer %s", opts.ClientSecret),
+		}))
+	}
+	return &Formance{
+		client: formance.New(sdkOpts...),
+		ledger: opts.Ledger,
+	}
+}
+
+func (f *Formance) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	res, err := f.client.Ledger.AddMetadataToAccount(ctx, operations.AddMetadataToAccountRequest{
+		RequestBody: metadata,
+		Address:     address,
+		Ledger:      f.ledger,
+	})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return formanceError("add metadata to account", res.StatusCode, res.ErrorResponse)
+	}
+	return nil
+}
+
+func (f *Formance) AddMetaDataToTransaction(ctx context.Context, txid int64, metadata map[string]interface{}) error {
+	res, err := f.client.Ledger.AddMetadataOnTransaction(ctx, operations.AddMetadataOnTransactionRequest{
+		RequestBody: metadata,
+		Ledger:      f.ledger,
+		Txid:        txid,
+	})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return formanceError("add metadata on transaction", res.StatusCode, res.ErrorResponse)
+	}
+	return nil
+}
+
+func (f *Formance) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	res, err := f.client.Ledger.GetAccount(ctx, operations.GetAccountRequest{
+		Address: address,
+		Ledger:  f.ledger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, formanceError("get account", res.StatusCode, res.ErrorResponse)
+	}
+	if res.AccountResponse == nil || len(res.AccountResponse.Data.Address) == 0 {
+		return nil, nil
+	}
+	return &res.AccountResponse.Data, nil
+}
+
+func (f *Formance) ListAccounts(ctx context.Context, filter AccountFilter, page Page) (*AccountsPage, error) {
+	req := operations.ListAccountsRequest{
+		Ledger: f.ledger,
+	}
+	// formance rejects any other parameter alongside a cursor
+	if page.Cursor != "" {
+		req.Cursor = formance.String(page.Cursor)
+	} else {
+		req.PageSize = formance.Int64(formancePageSize(page))
+		// formance matches address as a regular expression between ^ and $
+		if filter.AddressPrefix != "" {
+			req.Address = formance.String(regexp.QuoteMeta(filter.AddressPrefix) + ".*")
+		}
+		if len(filter.Metadata) > 0 {
+			req.Metadata = make(map[string]interface{}, len(filter.Metadata))
+			for k, v := range filter.Metadata {
+				req.Metadata[k] = v
+			}
+		}
+	}
+	res, err := f.client.Ledger.ListAccounts(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, formanceError("list accounts", res.StatusCode, res.ErrorResponse)
+	}
+
+	cursor := res.AccountsCursorResponse.Cursor
+	return &AccountsPage{
+		Accounts: cursor.Data,
+		Next:     formanceNext(cursor.HasMore, cursor.Next),
+	}, nil
+}
+
+func (f *Formance) ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error) {
+	req := operations.ListTransactionsRequest{
+		Ledger: f.ledger,
+	}
+	if page.Cursor != "" {
+		req.Cursor = formance.String(page.Cursor)
+	} else {
+		req.PageSize = formance.Int64(formancePageSize(page))
+		// formance matches account as a regular expression
+		if filter.Account != "" {
+			req.Account = formance.String(regexp.QuoteMeta(filter.Account))
+		}
+		if len(filter.Metadata) > 0 {
+			req.Metadata = make(map[string]interface{}, len(filter.Metadata))
+			for k, v := range filter.Metadata {
+				req.Metadata[k] = v
+			}
+		}
+		req.StartTime = filter.StartTime
+		req.EndTime = filter.EndTime
+	}
+	res, err := f.client.Ledger.ListTransactions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, formanceError("list transactions", res.StatusCode, res.ErrorResponse)
+	}
+
+	cursor := res.TransactionsCursorResponse.Cursor
+	return &TransactionsPage{
+		Transactions: cursor.Data,
+		Next:         formanceNext(cursor.HasMore, cursor.Next),
+	}, nil
+}
+
+func (f *Formance) GetTransaction(ctx context.Context, txid int64) (*shared.Transaction, error) {
+	res, err := f.client.Ledger.GetTransaction(ctx, operations.GetTransactionRequest{
+		Ledger: f.ledger,
+		Txid:   txid,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, formanceError("get transaction", res.StatusCode, res.ErrorResponse)
+	}
+	if res.TransactionResponse == nil {
+		return nil, nil
+	}
+	return &res.TransactionResponse.Data, nil
+}
+
+func (f *Formance) GetTransactionByReference(ctx context.Context, reference string) (*shared.Transaction, error) {
+	res, err := f.client.Ledger.ListTransactions(ctx, operations.ListTransactionsRequest{
+		Ledger:    f.ledger,
+		Reference: &reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, formanceError("get transaction by reference", res.StatusCode, res.ErrorResponse)
+	}
+	if res.TransactionsCursorResponse == nil || len(res.TransactionsCursorResponse.Cursor.Data) == 0 {
+		return nil, nil
+	}
+	return &res.TransactionsCursorResponse.Cursor.Data[0], nil
+}
+
+// balancesAddressesPerRequest bounds the addresses matched by one balances request, they are all in its url
+const balancesAddressesPerRequest = 50
+
+func (f *Formance) ListBalances(ctx context.Context, addresses ...string) (map[string]map[string]int64, error) {
+	if len(addresses) == 0 {
+		return f.listBalances(ctx, nil)
+	}
+	accountToBalance := make(map[string]map[string]int64)
+	for start := 0; start < len(addresses); start += balancesAddressesPerRequest {
+		end := start + balancesAddressesPerRequest
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		chunk := addresses[start:end]
+		// formance matches the address filter as a regular expression
+		quoted := make([]string, len(chunk))
+		for i, address := range chunk {
+			quoted[i] = regexp.QuoteMeta(address)
+		}
+		pattern := "^(" + strings.Join(quoted, "|") + ")$"
+		balances, err := f.listBalances(ctx, &pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range chunk {
+			if balance, ok := balances[address]; ok {
+				accountToBalance[address] = balance
+			}
+		}
+	}
+	return accountToBalance, nil
+}
+
+// listBalances reads every page of the balances of the accounts matching address, every account when it is nil
+func (f *Formance) listBalances(ctx context.Context, address *string) (map[string]map[string]int64, error) {
+	cursor := ""
+	accountToBalance := make(map[string]map[string]int64)
+	for {
+		res, err := f.client.Ledger.GetBalances(ctx, operations.GetBalancesRequest{
+			Ledger:  f.ledger,
+			Address: address,
+			Cursor:  &cursor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= http.StatusBadRequest {
+			return nil, formanceError("get balances", res.StatusCode, res.ErrorResponse)
+		}
+		for _, balances := range res.BalancesCursorResponse.Cursor.Data {
+			for acct, balance := range balances {
+				accountToBalance[acct] = make(map[string]int64, len(balance))
+				for asset, amount := range balance {
+					accountToBalance[acct][asset] = amount.Int64()
+				}
+			}
+		}
+		if !res.BalancesCursorResponse.Cursor.HasMore {
+			break
+		}
+		cursor = *res.BalancesCursorResponse.Cursor.Next
+	}
+	return accountToBalance, nil
+}
+
+func (f *Formance) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	formancePostings := make([]shared.Posting, len(postings))
+	for i, p := range postings {
+		formancePostings[i] = shared.Posting{
+			Amount:      big.NewInt(p.Amount),
+			Asset:       p.Asset,
+			Destination: p.Dest,
+			Source:      p.Src,
+		}
+	}
+	return f.createTransaction(ctx, shared.PostTransaction{
+		Metadata: metadata,
+		Postings: formancePostings,
+	}, reference)
+}
+
+// CreateTransactionFromScript runs script through the numscript endpoint of formance
+func (f *Formance) CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error) {
+	return f.createTransaction(ctx, shared.PostTransaction{
+		Metadata: metadata,
+		Script: &shared.PostTransactionScript{
+			Plain: script.Plain,
+			Vars:  script.Vars,
+		},
+	}, reference)
+}
+
+func (f *Formance) createTransaction(ctx context.Context, postTransaction shared.PostTransaction, reference string) (*shared.Transaction, error) {
+	time := time2.Now()
+	postTransaction.Timestamp = &time
+	if reference != "" {
+		postTransaction.Reference = &reference
+	}
+	res, err := f.client.Ledger.CreateTransaction(ctx, operations.CreateTransactionRequest{
+		PostTransaction: postTransaction,
+		Ledger:          f.ledger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, formanceError("create transaction", res.StatusCode, res.ErrorResponse)
+	}
+	if res.TransactionsResponse == nil || len(res.TransactionsResponse.Data) == 0 {
+		return nil, errors.New("expected to create a transaction but none were created")
+	}
+	return &res.TransactionsResponse.Data[0], nil
+}
+
+func formancePageSize(page Page) int64 {
+	if page.PageSize <= 0 {
+		return DefaultPageSize
+	}
+	return page.PageSize
+}
+
+// formanceNext is the cursor of the page after a formance cursor response, empty on the last page
+func formanceNext(hasMore bool, next *string) string {
+	if !hasMore || next == nil {
+		return ""
+	}
+	return *next
+}
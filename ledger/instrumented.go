@@ -0,0 +1,108 @@
+package ledger
+
+import (
+	"context"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var (
+	callDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "magic_ledger_ledger_call_duration_seconds",
+		Help:    "Latency of the calls made to the ledger backend, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	callErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "magic_ledger_ledger_call_errors_total",
+		Help: "Calls made to the ledger backend that failed, by operation.",
+	}, []string{"operation"})
+)
+
+// Instrumented records the latency and the errors of every call made to the Backend it wraps
+type Instrumented struct {
+	backend Backend
+}
+
+// Instrument wraps backend so its calls are exported as metrics
+func Instrument(backend Backend) *Instrumented {
+	return &Instrumented{backend: backend}
+}
+
+func observe(operation string, start time.Time, err error) {
+	callDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		callErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (i *Instrumented) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	start := time.Now()
+	account, err := i.backend.GetAccount(ctx, address)
+	observe("GetAccount", start, err)
+	return account, err
+}
+
+func (i *Instrumented) ListAccounts(ctx context.Context, filter AccountFilter, page Page) (*AccountsPage, error) {
+	start := time.Now()
+	accounts, err := i.backend.ListAccounts(ctx, filter, page)
+	observe("ListAccounts", start, err)
+	return accounts, err
+}
+
+func (i *Instrumented) ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error) {
+	start := time.Now()
+	transactions, err := i.backend.ListTransactions(ctx, filter, page)
+	observe("ListTransactions", start, err)
+	return transactions, err
+}
+
+func (i *Instrumented) GetTransaction(ctx context.Context, txid int64) (*shared.Transaction, error) {
+	start := time.Now()
+	txn, err := i.backend.GetTransaction(ctx, txid)
+	observe("GetTransaction", start, err)
+	return txn, err
+}
+
+func (i *Instrumented) GetTransactionByReference(ctx context.Context, reference string) (*shared.Transaction, error) {
+	start := time.Now()
+	txn, err := i.backend.GetTransactionByReference(ctx, reference)
+	observe("GetTransactionByReference", start, err)
+	return txn, err
+}
+
+func (i *Instrumented) ListBalances(ctx context.Context, addresses ...string) (map[string]map[string]int64, error) {
+	start := time.Now()
+	balances, err := i.backend.ListBalances(ctx, addresses...)
+	observe("ListBalances", start, err)
+	return balances, err
+}
+
+func (i *Instrumented) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	start := time.Now()
+	err := i.backend.AddMetaDataToAccount(ctx, address, metadata)
+	observe("AddMetaDataToAccount", start, err)
+	return err
+}
+
+func (i *Instrumented) AddMetaDataToTransaction(ctx context.Context, txid int64, metadata map[string]interface{}) error {
+	start := time.Now()
+	err := i.backend.AddMetaDataToTransaction(ctx, txid, metadata)
+	observe("AddMetaDataToTransaction", start, err)
+	return err
+}
+
+func (i *Instrumented) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	start := time.Now()
+	txn, err := i.backend.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+	observe("CreateTransactionWithPostings", start, err)
+	return txn, err
+}
+
+func (i *Instrumented) CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error) {
+	start := time.Now()
+	txn, err := i.backend.CreateTransactionFromScript(ctx, script, metadata, reference)
+	observe("CreateTransactionFromScript", start, err)
+	return txn, err
+}
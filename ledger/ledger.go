@@ -2,147 +2,53 @@ package ledger
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"github.com/formancehq/formance-sdk-go"
-	"github.com/formancehq/formance-sdk-go/pkg/models/operations"
 	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
-	"math/big"
-	"net/http"
-	time2 "time"
 )
 
-const (
-	ledgerName     = "gift-card-ledger"
-	usdAsset       = "USD"
-	formanceUrl    = "REDACTED"
-	formanceSecret = "REDACTED"
-)
-
-var formanceClient = formance.New(
-	formance.WithServerURL(formanceUrl),
-	formance.WithSecurity(shared.Security{
-		Authorization: fmt.Sprintf("Bearer %s", formanceSecret),
-	}),
-)
-
-func AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
-	res, err := formanceClient.Ledger.AddMetadataToAccount(ctx, operations.AddMetadataToAccountRequest{
-		RequestBody: metadata,
-		Address:     address,
-		Ledger:      ledgerName,
-	})
-	if err != nil {
-		return err
-	}
-	if res.StatusCode >= http.StatusBadRequest {
-		return errors.New(fmt.Sprintf("failed to add metadata to account with error code %d", res.StatusCode))
-	}
-	return nil
-}
-
-func GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
-	res, err := formanceClient.Ledger.GetAccount(ctx, operations.GetAccountRequest{
-		Address: address,
-		Ledger:  ledgerName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode >= http.StatusBadRequest {
-		return nil, errors.New(fmt.Sprintf("failed to get ledger account with error code %d", res.StatusCode))
-	}
-	if res.AccountResponse == nil || len(res.AccountResponse.Data.Address) == 0 {
-		return nil, nil
-	}
-	return &res.AccountResponse.Data, nil
-}
-
-func ListAccounts(ctx context.Context) ([]shared.Account, error) {
-	res, err := formanceClient.Ledger.ListAccounts(ctx, operations.ListAccountsRequest{
-		Ledger:   ledgerName,
-		PageSize: formance.Int64(500), // will need to paginate but formance pagination is broken
-	})
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode >= http.StatusBadRequest {
-		return nil, errors.New(fmt.Sprintf("failed to get ledger account with error code %d", res.StatusCode))
-	}
-
-	return res.AccountsCursorResponse.Cursor.Data, nil
+// WorldAccount is the only account allowed to carry a negative balance
+const WorldAccount = "world"
+
+// Backend is the set of ledger operations the api depends on. Formance is the production
+// implementation, Memory is a self-contained double-entry ledger for tests and local development.
+type Backend interface {
+	GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error)
+	// ListAccounts returns a page of the accounts matching filter, sorted by address. filter is only read for the
+	// first page, the cursor of the following pages carries it. ListAllAccounts walks every page
+	ListAccounts(ctx context.Context, filter AccountFilter, page Page) (*AccountsPage, error)
+	// ListTransactions returns a page of the transactions matching filter, most recent first. filter is only
+	// read for the first page, the cursor of the following pages carries it. ListAllTransactions walks every page
+	ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error)
+	// GetTransaction returns nil if no transaction has the id txid
+	GetTransaction(ctx context.Context, txid int64) (*shared.Transaction, error)
+	// GetTransactionByReference returns nil if no transaction was posted with reference
+	GetTransactionByReference(ctx context.Context, reference string) (*shared.Transaction, error)
+	// ListBalances returns the balance of every account, or of addresses only when some are given, keyed by
+	// account address then by asset
+	ListBalances(ctx context.Context, addresses ...string) (map[string]map[string]int64, error)
+	AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error
+	// AddMetaDataToTransaction adds metadata to the posted transaction txid, overwriting the keys it already has
+	AddMetaDataToTransaction(ctx context.Context, txid int64, metadata map[string]interface{}) error
+	// CreateTransactionWithPostings posts every posting atomically. A non-empty reference must be unique
+	// across the ledger, posting it twice fails with ErrDuplicateReference.
+	CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error)
+	// CreateTransactionFromScript posts the postings made by running script, atomically. the reference is
+	// handled as by CreateTransactionWithPostings, a script that fails to compile fails with ErrInvalidPostings.
+	CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error)
 }
 
-func ListTransactions(ctx context.Context) ([]shared.Transaction, error) {
-	res, err := formanceClient.Ledger.ListTransactions(ctx, operations.ListTransactionsRequest{
-		Ledger:   ledgerName,
-		PageSize: formance.Int64(500), // will need to paginate but formance pagination is broken
-
-	})
-	if err != nil {
-		return nil, err
-	}
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode >= http.StatusBadRequest {
-		return nil, errors.New(fmt.Sprintf("failed to get ledger account with error code %d", res.StatusCode))
+// validatePostings checks the postings of a transaction before they are applied
+func validatePostings(postings []TransactionPosting) error {
+	if len(postings) == 0 {
+		return fmt.Errorf("%w: transaction must contain at least one posting", ErrInvalidPostings)
 	}
-
-	return res.TransactionsCursorResponse.Cursor.Data, nil
-}
-
-func ListBalances(ctx context.Context) (map[string]int64, error) {
-	cursor := ""
-	accountToBalance := make(map[string]int64)
-	for {
-		res, err := formanceClient.Ledger.GetBalances(ctx, operations.GetBalancesRequest{
-			Ledger: ledgerName,
-			Cursor: &cursor,
-		})
-		if err != nil {
-			return nil, err
-		}
-		for _, balances := range res.BalancesCursorResponse.Cursor.Data {
-			for acct, balance := range balances {
-				accountToBalance[acct] = balance[usdAsset].Int64()
-			}
+	for _, p := range postings {
+		if p.Asset == "" {
+			return fmt.Errorf("%w: missing asset on posting from %s to %s", ErrInvalidPostings, p.Src, p.Dest)
 		}
-		if !res.BalancesCursorResponse.Cursor.HasMore {
-			break
+		if p.Amount < 0 {
+			return fmt.Errorf("%w: negative amount %d from %s to %s", ErrInvalidPostings, p.Amount, p.Src, p.Dest)
 		}
-		cursor = *res.BalancesCursorResponse.Cursor.Next
 	}
-	return accountToBalance, nil
-}
-
-func CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting) (*shared.Transaction, error) {
-	time := time2.Now()
-	formancePostings := make([]shared.Posting, len(postings))
-	for i, p := range postings {
-		formancePostings[i] = shared.Posting{
-			Amount:      big.NewInt(p.Amount),
-			Asset:       usdAsset,
-			Destination: p.Dest,
-			Source:      p.Src,
-		}
-	}
-	res, err := formanceClient.Ledger.CreateTransaction(ctx, operations.CreateTransactionRequest{
-		PostTransaction: shared.PostTransaction{
-			Metadata:  metadata,
-			Postings:  formancePostings,
-			Timestamp: &time,
-		},
-		Ledger: ledgerName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(*res.ErrorResponse.ErrorMessage)
-	}
-	if res.TransactionsResponse == nil || len(res.TransactionsResponse.Data) == 0 {
-		return nil, errors.New("expected to create a transaction but none were created")
-	}
-	return &res.TransactionsResponse.Data[0], nil
+	return nil
 }
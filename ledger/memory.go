@@ -0,0 +1,366 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryAccount struct {
+	metadata map[string]interface{}
+	// asset -> input/output volumes
+	volumes map[string]*shared.Volume
+}
+
+// Memory is a double-entry Backend held entirely in process memory. Every account except
+// world must keep a non-negative balance, a transaction that would overdraw one is rejected
+// without applying any of its postings.
+type Memory struct {
+	mu           sync.RWMutex
+	accounts     map[string]*memoryAccount
+	transactions []shared.Transaction
+	// reference -> index in transactions
+	references map[string]int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		accounts:   make(map[string]*memoryAccount),
+		references: make(map[string]int),
+	}
+}
+
+func (m *Memory) AddMetaDataToAccount(_ context.Context, address string, metadata map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acct := m.account(address)
+	for k, v := range metadata {
+		acct.metadata[k] = v
+	}
+	return nil
+}
+
+func (m *Memory) AddMetaDataToTransaction(_ context.Context, txid int64, metadata map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if txid < 0 || txid >= int64(len(m.transactions)) {
+		return fmt.Errorf("no transaction with txid %d", txid)
+	}
+	// the transactions already returned keep the metadata they were returned with
+	updated := copyMetadata(m.transactions[txid].Metadata)
+	for k, v := range metadata {
+		updated[k] = v
+	}
+	m.transactions[txid].Metadata = updated
+	return nil
+}
+
+func (m *Memory) GetAccount(_ context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	acct, ok := m.accounts[address]
+	if !ok {
+		return nil, nil
+	}
+	res := &shared.AccountWithVolumesAndBalances{
+		Address:  address,
+		Balances: make(map[string]*big.Int),
+		Metadata: copyMetadata(acct.metadata),
+		Volumes:  make(map[string]map[string]*big.Int),
+	}
+	for asset, volume := range acct.volumes {
+		res.Balances[asset] = new(big.Int).Set(volume.Balance)
+		res.Volumes[asset] = map[string]*big.Int{
+			"input":  new(big.Int).Set(volume.Input),
+			"output": new(big.Int).Set(volume.Output),
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) ListAccounts(_ context.Context, filter AccountFilter, page Page) (*AccountsPage, error) {
+	c, err := readAccountsPage(filter, page)
+	if err != nil {
+		return nil, err
+	}
+	after, pageSize := c.After, c.PageSize
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	addresses := make([]string, 0, len(m.accounts))
+	for address := range m.accounts {
+		if (after == "" || address > after) && c.AccountFilter.matches(address, m.accounts[address].metadata) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	res := &AccountsPage{}
+	if int64(len(addresses)) > pageSize {
+		addresses = addresses[:pageSize]
+		res.Next = cursor{After: addresses[pageSize-1], PageSize: pageSize, AccountFilter: c.AccountFilter}.encode()
+	}
+	res.Accounts = make([]shared.Account, len(addresses))
+	for i, address := range addresses {
+		res.Accounts[i] = shared.Account{
+			Address:  address,
+			Metadata: copyMetadata(m.accounts[address].metadata),
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) ListTransactions(_ context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error) {
+	c, err := readTransactionsPage(filter, page)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// most recent first, matching formance
+	start := int64(len(m.transactions)) - 1
+	if c.After != "" {
+		txid, err := strconv.ParseInt(c.After, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+		}
+		if txid-1 < start {
+			start = txid - 1
+		}
+	}
+	res := &TransactionsPage{
+		Transactions: make([]shared.Transaction, 0),
+	}
+	for txid := start; txid >= 0; txid-- {
+		if !c.Filter.matches(m.transactions[txid]) {
+			continue
+		}
+		if int64(len(res.Transactions)) == c.PageSize {
+			last := res.Transactions[len(res.Transactions)-1].Txid
+			res.Next = cursor{After: strconv.FormatInt(last, 10), PageSize: c.PageSize, Filter: c.Filter}.encode()
+			break
+		}
+		res.Transactions = append(res.Transactions, m.transactions[txid])
+	}
+	return res, nil
+}
+
+func (m *Memory) GetTransaction(_ context.Context, txid int64) (*shared.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if txid < 0 || txid >= int64(len(m.transactions)) {
+		return nil, nil
+	}
+	txn := m.transactions[txid]
+	return &txn, nil
+}
+
+func (m *Memory) GetTransactionByReference(_ context.Context, reference string) (*shared.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, ok := m.references[reference]
+	if !ok {
+		return nil, nil
+	}
+	txn := m.transactions[i]
+	return &txn, nil
+}
+
+func (m *Memory) ListBalances(_ context.Context, addresses ...string) (map[string]map[string]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	selected := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		selected[address] = true
+	}
+	accountToBalance := make(map[string]map[string]int64)
+	for address, acct := range m.accounts {
+		if len(addresses) > 0 && !selected[address] {
+			continue
+		}
+		accountToBalance[address] = make(map[string]int64, len(acct.volumes))
+		for asset, volume := range acct.volumes {
+			accountToBalance[address][asset] = volume.Balance.Int64()
+		}
+	}
+	return accountToBalance, nil
+}
+
+// CreateTransactionFromScript runs script locally, see compileScript
+func (m *Memory) CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error) {
+	postings, err := compileScript(script)
+	if err != nil {
+		return nil, err
+	}
+	return m.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+}
+
+func (m *Memory) CreateTransactionWithPostings(_ context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	if err := validatePostings(postings); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.references[reference]; ok && reference != "" {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateReference, reference)
+	}
+
+	// compute every balance this transaction touches before mutating anything so a
+	// rejected transaction leaves the ledger untouched
+	pre := make(map[string]map[string]shared.Volume)
+	post := make(map[string]map[string]shared.Volume)
+	for _, p := range postings {
+		for _, address := range []string{p.Src, p.Dest} {
+			if _, ok := pre[address]; !ok {
+				pre[address] = make(map[string]shared.Volume)
+				post[address] = make(map[string]shared.Volume)
+			}
+			if _, ok := pre[address][p.Asset]; ok {
+				continue
+			}
+			volume := m.volume(address, p.Asset)
+			pre[address][p.Asset] = copyVolume(volume)
+			post[address][p.Asset] = copyVolume(volume)
+		}
+		amount := big.NewInt(p.Amount)
+		src := post[p.Src][p.Asset]
+		src.Output.Add(src.Output, amount)
+		src.Balance.Sub(src.Balance, amount)
+		dest := post[p.Dest][p.Asset]
+		dest.Input.Add(dest.Input, amount)
+		dest.Balance.Add(dest.Balance, amount)
+	}
+	for address, volumes := range post {
+		for asset, volume := range volumes {
+			if address != WorldAccount && volume.Balance.Sign() < 0 {
+				return nil, fmt.Errorf("%w: account %s in %s", ErrInsufficientFunds, address, asset)
+			}
+		}
+	}
+
+	for address, volumes := range post {
+		for asset, volume := range volumes {
+			volume := volume
+			m.account(address).volumes[asset] = &volume
+		}
+	}
+	formancePostings := make([]shared.Posting, len(postings))
+	for i, p := range postings {
+		formancePostings[i] = shared.Posting{
+			Amount:      big.NewInt(p.Amount),
+			Asset:       p.Asset,
+			Destination: p.Dest,
+			Source:      p.Src,
+		}
+	}
+	txn := shared.Transaction{
+		Metadata:          copyMetadata(metadata),
+		PostCommitVolumes: post,
+		Postings:          formancePostings,
+		PreCommitVolumes:  pre,
+		Timestamp:         time.Now(),
+		Txid:              int64(len(m.transactions)),
+	}
+	if reference != "" {
+		txn.Reference = &reference
+		m.references[reference] = len(m.transactions)
+	}
+	m.transactions = append(m.transactions, txn)
+	return &txn, nil
+}
+
+// account returns the account at address, creating it if it does not exist yet. callers must hold mu.
+func (m *Memory) account(address string) *memoryAccount {
+	acct, ok := m.accounts[address]
+	if !ok {
+		acct = &memoryAccount{
+			metadata: make(map[string]interface{}),
+			volumes:  make(map[string]*shared.Volume),
+		}
+		m.accounts[address] = acct
+	}
+	return acct
+}
+
+// volume returns the current volume of asset held by address, zero if the account does not exist yet
+func (m *Memory) volume(address string, asset string) shared.Volume {
+	if acct, ok := m.accounts[address]; ok {
+		if volume, ok := acct.volumes[asset]; ok {
+			return *volume
+		}
+	}
+	return shared.Volume{Balance: big.NewInt(0), Input: big.NewInt(0), Output: big.NewInt(0)}
+}
+
+func copyVolume(v shared.Volume) shared.Volume {
+	return shared.Volume{
+		Balance: new(big.Int).Set(v.Balance),
+		Input:   new(big.Int).Set(v.Input),
+		Output:  new(big.Int).Set(v.Output),
+	}
+}
+
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		res[k] = v
+	}
+	return res
+}
+
+// matches reports whether txn is selected by the filter
+func (f *TransactionFilter) matches(txn shared.Transaction) bool {
+	if f.StartTime != nil && txn.Timestamp.Before(*f.StartTime) {
+		return false
+	}
+	if f.EndTime != nil && !txn.Timestamp.Before(*f.EndTime) {
+		return false
+	}
+	for k, v := range f.Metadata {
+		value, ok := txn.Metadata[k]
+		if !ok || metadataString(value) != v {
+			return false
+		}
+	}
+	if f.Account == "" {
+		return true
+	}
+	for _, p := range txn.Postings {
+		if p.Source == f.Account || p.Destination == f.Account {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *AccountFilter) matches(address string, metadata map[string]interface{}) bool {
+	if !strings.HasPrefix(address, f.AddressPrefix) {
+		return false
+	}
+	for k, v := range f.Metadata {
+		value, ok := metadata[k]
+		if !ok || metadataString(value) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataString is the string a metadata value is stored as once encoded, pointers included
+func metadataString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	var str string
+	if json.Unmarshal(b, &str) == nil {
+		return str
+	}
+	return string(b)
+}
@@ -0,0 +1,7 @@
+package ledger
+
+import "testing"
+
+func TestMemory(t *testing.T) {
+	testBackend(t, func(*testing.T) Backend { return NewMemory() })
+}
@@ -0,0 +1,39 @@
+CREATE TABLE accounts (
+    address    VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL
+);
+
+CREATE TABLE account_metadata (
+    address VARCHAR(255) NOT NULL REFERENCES accounts (address),
+    key     VARCHAR(255) NOT NULL,
+    value   TEXT         NOT NULL,
+    PRIMARY KEY (address, key)
+);
+
+CREATE TABLE transactions (
+    txid      BIGINT PRIMARY KEY,
+    timestamp TIMESTAMP NOT NULL,
+    reference VARCHAR(255) UNIQUE,
+    metadata  TEXT      NOT NULL
+);
+
+CREATE TABLE postings (
+    txid        BIGINT       NOT NULL REFERENCES transactions (txid),
+    idx         INTEGER      NOT NULL,
+    source      VARCHAR(255) NOT NULL REFERENCES accounts (address),
+    destination VARCHAR(255) NOT NULL REFERENCES accounts (address),
+    asset       VARCHAR(32)  NOT NULL,
+    amount      BIGINT       NOT NULL CHECK (amount >= 0),
+    PRIMARY KEY (txid, idx)
+);
+
+CREATE INDEX postings_source ON postings (source);
+CREATE INDEX postings_destination ON postings (destination);
+
+CREATE TABLE volumes (
+    address VARCHAR(255) NOT NULL REFERENCES accounts (address),
+    asset   VARCHAR(32)  NOT NULL,
+    input   BIGINT       NOT NULL DEFAULT 0,
+    output  BIGINT       NOT NULL DEFAULT 0,
+    PRIMARY KEY (address, asset)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE sequences (
+    name  VARCHAR(64) PRIMARY KEY,
+    value BIGINT      NOT NULL
+);
+
+INSERT INTO sequences (name, value) SELECT 'txid', COALESCE(MAX(txid) + 1, 0) FROM transactions;
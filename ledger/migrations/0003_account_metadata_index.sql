@@ -0,0 +1 @@
+CREATE INDEX account_metadata_key_value ON account_metadata (key, value);
@@ -1,7 +1,52 @@
 package ledger
 
+import (
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"time"
+)
+
 type TransactionPosting struct {
-	Src    string
-	Dest   string
+	Src  string
+	Dest string
+	// Asset is the currency moved by the posting along with its precision, ex. USD/2
+	Asset  string
 	Amount int64
 }
+
+// TransactionFilter selects the transactions matching every field that is set
+type TransactionFilter struct {
+	// Account matches transactions with a posting from or to the address
+	Account string `json:"account,omitempty"`
+	// Metadata matches transactions carrying every key with the given value
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// StartTime is inclusive, EndTime is exclusive
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+}
+
+// AccountFilter selects the accounts matching every field that is set
+type AccountFilter struct {
+	// AddressPrefix matches the accounts whose address starts with it, ex. holds:
+	AddressPrefix string `json:"address_prefix,omitempty"`
+	// Metadata matches accounts carrying every key with the given value
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Page selects one page of a list. An empty Cursor selects the first page, PageSize is only read
+// for the first page, the following pages keep the size the cursor was issued with.
+type Page struct {
+	Cursor   string
+	PageSize int64
+}
+
+type AccountsPage struct {
+	Accounts []shared.Account
+	// Next is the cursor of the following page, empty on the last page
+	Next string
+}
+
+type TransactionsPage struct {
+	Transactions []shared.Transaction
+	// Next is the cursor of the following page, empty on the last page
+	Next string
+}
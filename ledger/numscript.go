@@ -0,0 +1,393 @@
+package ledger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Script is a Numscript program along with the values of the variables it declares
+type Script struct {
+	Plain string
+	// Vars holds an account address for account variables and a Monetary for monetary variables
+	Vars map[string]interface{}
+}
+
+// Monetary is an amount of an asset, the value of a monetary variable
+type Monetary struct {
+	Asset  string `json:"asset"`
+	Amount int64  `json:"amount"`
+}
+
+const (
+	ScriptVarAccount  = "account"
+	ScriptVarMonetary = "monetary"
+)
+
+// ScriptVar is a variable declared in the vars block of a Numscript program
+type ScriptVar struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ScriptVars parses plain and returns the variables it declares, in their order of declaration
+func ScriptVars(plain string) ([]ScriptVar, error) {
+	prog, err := parseScript(plain)
+	if err != nil {
+		return nil, err
+	}
+	return prog.vars, nil
+}
+
+// compileScript runs script and returns the postings it makes. only the subset of Numscript the templates
+// use is supported: send statements from a single source account, to a single destination account or to a
+// list of max ... to destinations ending with remaining to. the backends without a script endpoint post
+// the returned postings, the balances are checked then.
+func compileScript(script Script) ([]TransactionPosting, error) {
+	prog, err := parseScript(script.Plain)
+	if err != nil {
+		return nil, err
+	}
+	declared := make(map[string]string, len(prog.vars))
+	for _, v := range prog.vars {
+		declared[v.Name] = v.Type
+	}
+	for name := range script.Vars {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("%w: variable $%s is not declared", ErrInvalidPostings, name)
+		}
+	}
+	vm := scriptVM{declared: declared, vars: script.Vars}
+	var postings []TransactionPosting
+	for _, send := range prog.sends {
+		sent, err := vm.send(send)
+		if err != nil {
+			return nil, err
+		}
+		postings = append(postings, sent...)
+	}
+	return postings, nil
+}
+
+type scriptProgram struct {
+	vars  []ScriptVar
+	sends []scriptSend
+}
+
+// scriptValue is either a variable or a literal, an account address or a monetary
+type scriptValue struct {
+	variable string
+	account  string
+	monetary Monetary
+}
+
+type scriptSend struct {
+	amount      scriptValue
+	source      scriptValue
+	destination []scriptDestination
+}
+
+// scriptDestination receives up to max, or what remains when max is nil
+type scriptDestination struct {
+	max     *scriptValue
+	account scriptValue
+}
+
+type scriptVM struct {
+	declared map[string]string
+	vars     map[string]interface{}
+}
+
+func (vm scriptVM) account(v scriptValue) (string, error) {
+	if v.variable == "" {
+		return v.account, nil
+	}
+	if vm.declared[v.variable] != ScriptVarAccount {
+		return "", fmt.Errorf("%w: $%s is not an account", ErrInvalidPostings, v.variable)
+	}
+	address, ok := vm.vars[v.variable].(string)
+	if !ok || address == "" {
+		return "", fmt.Errorf("%w: missing account variable $%s", ErrInvalidPostings, v.variable)
+	}
+	return address, nil
+}
+
+func (vm scriptVM) monetary(v scriptValue) (Monetary, error) {
+	if v.variable == "" {
+		return v.monetary, nil
+	}
+	if vm.declared[v.variable] != ScriptVarMonetary {
+		return Monetary{}, fmt.Errorf("%w: $%s is not a monetary", ErrInvalidPostings, v.variable)
+	}
+	var m Monetary
+	switch value := vm.vars[v.variable].(type) {
+	case Monetary:
+		m = value
+	case *Monetary:
+		if value != nil {
+			m = *value
+		}
+	}
+	if m.Asset == "" {
+		return Monetary{}, fmt.Errorf("%w: missing monetary variable $%s", ErrInvalidPostings, v.variable)
+	}
+	if m.Amount < 0 {
+		return Monetary{}, fmt.Errorf("%w: negative amount %d in $%s", ErrInvalidPostings, m.Amount, v.variable)
+	}
+	return m, nil
+}
+
+func (vm scriptVM) send(send scriptSend) ([]TransactionPosting, error) {
+	amount, err := vm.monetary(send.amount)
+	if err != nil {
+		return nil, err
+	}
+	source, err := vm.account(send.source)
+	if err != nil {
+		return nil, err
+	}
+	postings := make([]TransactionPosting, 0, len(send.destination))
+	remaining := amount.Amount
+	for _, d := range send.destination {
+		dest, err := vm.account(d.account)
+		if err != nil {
+			return nil, err
+		}
+		part := remaining
+		if d.max != nil {
+			max, err := vm.monetary(*d.max)
+			if err != nil {
+				return nil, err
+			}
+			if max.Asset != amount.Asset {
+				return nil, fmt.Errorf("%w: cannot send at most %s of %s", ErrInvalidPostings, max.Asset, amount.Asset)
+			}
+			if max.Amount < part {
+				part = max.Amount
+			}
+		}
+		remaining -= part
+		postings = append(postings, TransactionPosting{
+			Src:    source,
+			Dest:   dest,
+			Asset:  amount.Asset,
+			Amount: part,
+		})
+	}
+	return postings, nil
+}
+
+// scriptParser reads a program token by token, see scriptTokens
+type scriptParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseScript(plain string) (*scriptProgram, error) {
+	tokens, err := scriptTokens(plain)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	prog := &scriptProgram{}
+	if p.peek() == "vars" {
+		if prog.vars, err = p.varsBlock(); err != nil {
+			return nil, err
+		}
+	}
+	for p.peek() != "" {
+		send, err := p.send()
+		if err != nil {
+			return nil, err
+		}
+		prog.sends = append(prog.sends, send)
+	}
+	if len(prog.sends) == 0 {
+		return nil, fmt.Errorf("%w: script sends nothing", ErrInvalidPostings)
+	}
+	return prog, nil
+}
+
+func (p *scriptParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *scriptParser) expect(expected string) error {
+	if token := p.next(); token != expected {
+		return p.unexpected(token, expected)
+	}
+	return nil
+}
+
+func (p *scriptParser) unexpected(token string, expected string) error {
+	if token == "" {
+		token = "end of script"
+	}
+	return fmt.Errorf("%w: script syntax error, expected %s but got %q", ErrInvalidPostings, expected, token)
+}
+
+func (p *scriptParser) varsBlock() ([]ScriptVar, error) {
+	p.next()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var vars []ScriptVar
+	seen := map[string]bool{}
+	for p.peek() != "}" {
+		typ := p.next()
+		if typ != ScriptVarAccount && typ != ScriptVarMonetary {
+			return nil, p.unexpected(typ, "a variable type, account or monetary")
+		}
+		name := p.next()
+		if !strings.HasPrefix(name, "$") {
+			return nil, p.unexpected(name, "a variable name")
+		}
+		name = name[1:]
+		if seen[name] {
+			return nil, fmt.Errorf("%w: variable $%s is declared twice", ErrInvalidPostings, name)
+		}
+		seen[name] = true
+		vars = append(vars, ScriptVar{Name: name, Type: typ})
+	}
+	p.next()
+	return vars, nil
+}
+
+func (p *scriptParser) send() (scriptSend, error) {
+	var send scriptSend
+	var err error
+	if err = p.expect("send"); err != nil {
+		return send, err
+	}
+	if send.amount, err = p.monetary(); err != nil {
+		return send, err
+	}
+	for _, token := range []string{"(", "source", "="} {
+		if err = p.expect(token); err != nil {
+			return send, err
+		}
+	}
+	if send.source, err = p.account(); err != nil {
+		return send, err
+	}
+	for _, token := range []string{"destination", "="} {
+		if err = p.expect(token); err != nil {
+			return send, err
+		}
+	}
+	if p.peek() != "{" {
+		account, err := p.account()
+		if err != nil {
+			return send, err
+		}
+		send.destination = []scriptDestination{{account: account}}
+		return send, p.expect(")")
+	}
+	p.next()
+	for {
+		var d scriptDestination
+		switch token := p.next(); token {
+		case "max":
+			max, err := p.monetary()
+			if err != nil {
+				return send, err
+			}
+			d.max = &max
+		case "remaining":
+		default:
+			return send, p.unexpected(token, "max or remaining")
+		}
+		if err = p.expect("to"); err != nil {
+			return send, err
+		}
+		if d.account, err = p.account(); err != nil {
+			return send, err
+		}
+		send.destination = append(send.destination, d)
+		if d.max == nil {
+			break
+		}
+	}
+	if err = p.expect("}"); err != nil {
+		return send, err
+	}
+	return send, p.expect(")")
+}
+
+func (p *scriptParser) account() (scriptValue, error) {
+	token := p.next()
+	switch {
+	case strings.HasPrefix(token, "$"):
+		return scriptValue{variable: token[1:]}, nil
+	case strings.HasPrefix(token, "@") && len(token) > 1:
+		return scriptValue{account: token[1:]}, nil
+	}
+	return scriptValue{}, p.unexpected(token, "an account")
+}
+
+// monetary reads a variable or a literal, ex. [USD/2 100]
+func (p *scriptParser) monetary() (scriptValue, error) {
+	token := p.next()
+	if strings.HasPrefix(token, "$") {
+		return scriptValue{variable: token[1:]}, nil
+	}
+	if token != "[" {
+		return scriptValue{}, p.unexpected(token, "a monetary")
+	}
+	asset := p.next()
+	if asset == "" || !unicode.IsUpper(rune(asset[0])) {
+		return scriptValue{}, p.unexpected(asset, "an asset")
+	}
+	amountToken := p.next()
+	amount, err := strconv.ParseInt(amountToken, 10, 64)
+	if err != nil || amount < 0 {
+		return scriptValue{}, p.unexpected(amountToken, "an amount")
+	}
+	if err = p.expect("]"); err != nil {
+		return scriptValue{}, err
+	}
+	return scriptValue{monetary: Monetary{Asset: asset, Amount: amount}}, nil
+}
+
+// scriptTokens splits plain into punctuation and words, a word being a keyword, a variable, an account,
+// an asset or an amount. comments run from // to the end of the line.
+func scriptTokens(plain string) ([]string, error) {
+	var tokens []string
+	runes := []rune(plain)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case strings.ContainsRune("{}()[]=", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '$' || r == '@' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			start := i
+			for i++; i < len(runes) && scriptWordRune(runes[i]); i++ {
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fmt.Errorf("%w: script syntax error, unexpected %q", ErrInvalidPostings, r)
+		}
+	}
+	return tokens, nil
+}
+
+func scriptWordRune(r rune) bool {
+	return r == '_' || r == ':' || r == '-' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptVars(t *testing.T) {
+	vars, err := ScriptVars(`
+// a comment
+vars {
+  account $card
+  monetary $amount
+}
+send $amount ( source = $card destination = @world )`)
+	if err != nil {
+		t.Fatalf("ScriptVars: %v", err)
+	}
+	want := []ScriptVar{{Name: "card", Type: ScriptVarAccount}, {Name: "amount", Type: ScriptVarMonetary}}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("got %v, want %v", vars, want)
+	}
+}
+
+func TestCompileScript(t *testing.T) {
+	tests := []struct {
+		name  string
+		plain string
+		vars  map[string]interface{}
+		want  []TransactionPosting
+	}{
+		{
+			name:  "literals",
+			plain: `send [USD/2 100] ( source = @world destination = @cards:1 )`,
+			want:  []TransactionPosting{{Src: "world", Dest: "cards:1", Asset: "USD/2", Amount: 100}},
+		},
+		{
+			name: "max capped by the amount",
+			plain: `vars { monetary $amount monetary $max }
+send $amount ( source = @world destination = { max $max to @revenue remaining to @cards:1 } )`,
+			vars: map[string]interface{}{"amount": Monetary{"USD/2", 100}, "max": Monetary{"USD/2", 250}},
+			want: []TransactionPosting{
+				{Src: "world", Dest: "revenue", Asset: "USD/2", Amount: 100},
+				{Src: "world", Dest: "cards:1", Asset: "USD/2", Amount: 0},
+			},
+		},
+		{
+			name: "several max destinations",
+			plain: `vars { account $card }
+send [EUR/2 100] ( source = @world destination = { max [EUR/2 10] to @revenue max [EUR/2 20] to @expenses remaining to $card } )`,
+			vars: map[string]interface{}{"card": "cards:1"},
+			want: []TransactionPosting{
+				{Src: "world", Dest: "revenue", Asset: "EUR/2", Amount: 10},
+				{Src: "world", Dest: "expenses", Asset: "EUR/2", Amount: 20},
+				{Src: "world", Dest: "cards:1", Asset: "EUR/2", Amount: 70},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postings, err := compileScript(Script{Plain: tt.plain, Vars: tt.vars})
+			if err != nil {
+				t.Fatalf("compileScript: %v", err)
+			}
+			if !reflect.DeepEqual(postings, tt.want) {
+				t.Errorf("got %v, want %v", postings, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileScriptErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		plain     string
+		vars      map[string]interface{}
+		wantError string
+	}{
+		{
+			name:      "several sources",
+			plain:     `send [USD/2 100] ( source = { @a @b } destination = @c )`,
+			wantError: "expected an account",
+		},
+		{
+			name:      "portions",
+			plain:     `send [USD/2 100] ( source = @world destination = { 50% to @a remaining to @b } )`,
+			wantError: "unexpected '%'",
+		},
+		{
+			name:      "unsupported statement",
+			plain:     `set_tx_meta("key", "value")`,
+			wantError: "unexpected '\"'",
+		},
+		{
+			name:      "unknown keyword",
+			plain:     `save [USD/2 100] from @a`,
+			wantError: `expected send but got "save"`,
+		},
+		{
+			name:      "destinations without remaining",
+			plain:     `send [USD/2 100] ( source = @world destination = { max [USD/2 10] to @a } )`,
+			wantError: `expected max or remaining but got "}"`,
+		},
+		{
+			name:      "unknown variable type",
+			plain:     `vars { portion $p } send [USD/2 1] ( source = @world destination = @a )`,
+			wantError: "expected a variable type",
+		},
+		{
+			name:      "nothing sent",
+			plain:     `vars { account $a }`,
+			wantError: "script sends nothing",
+		},
+		{
+			name:      "undeclared variable",
+			plain:     `send [USD/2 1] ( source = @world destination = @a )`,
+			vars:      map[string]interface{}{"a": "cards:1"},
+			wantError: "variable $a is not declared",
+		},
+		{
+			name:      "missing variable",
+			plain:     `vars { account $a } send [USD/2 1] ( source = @world destination = $a )`,
+			wantError: "missing account variable $a",
+		},
+		{
+			name:      "negative amount",
+			plain:     `vars { monetary $m } send $m ( source = @world destination = @a )`,
+			vars:      map[string]interface{}{"m": Monetary{"USD/2", -1}},
+			wantError: "negative amount",
+		},
+		{
+			name:      "max in another asset",
+			plain:     `send [USD/2 10] ( source = @world destination = { max [EUR/2 1] to @a remaining to @b } )`,
+			wantError: "cannot send at most EUR/2 of USD/2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileScript(Script{Plain: tt.plain, Vars: tt.vars})
+			if !errors.Is(err, ErrInvalidPostings) || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got %v, want an invalid postings error with %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestScriptInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	funding := []TransactionPosting{{Src: "world", Dest: "cards:1", Asset: "USD/2", Amount: 100}}
+	if _, err := backend.CreateTransactionWithPostings(ctx, nil, funding, ""); err != nil {
+		t.Fatalf("funding: %v", err)
+	}
+	script := Script{
+		Plain: `vars { account $card monetary $amount } send $amount ( source = $card destination = @merchant:1 )`,
+		Vars:  map[string]interface{}{"card": "cards:1", "amount": Monetary{"USD/2", 101}},
+	}
+	if _, err := backend.CreateTransactionFromScript(ctx, script, nil, ""); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, ErrInsufficientFunds)
+	}
+	account, err := backend.GetAccount(ctx, "cards:1")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if balance := account.Balances["USD/2"].Int64(); balance != 100 {
+		t.Errorf("balance after a rejected script: got %d, want 100", balance)
+	}
+}
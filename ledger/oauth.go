@@ -0,0 +1,144 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	time2 "time"
+)
+
+// tokenRefreshMargin is how long before its expiry a token is replaced, so a request never leaves with a
+// token that expires on the way
+const tokenRefreshMargin = 30 * time2.Second
+
+// TokenSource exchanges oauth2 client credentials for an access token. The token is cached and replaced
+// shortly before it expires.
+type TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time2.Time
+}
+
+func NewTokenSource(tokenURL string, clientID string, clientSecret string, client *http.Client) *TokenSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &TokenSource{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       client,
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is the lifetime of the token in seconds, the token never expires when it is 0
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// Token returns the cached access token, requesting a new one if there is none or it is about to expire
+func (t *TokenSource) Token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && (t.expiry.IsZero() || time2.Now().Add(tokenRefreshMargin).Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+	res, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting access token: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("reading access token: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting access token failed with status code %d: %s", res.StatusCode, body)
+	}
+	var token tokenResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("decoding access token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned no access token")
+	}
+	t.token = token.AccessToken
+	t.expiry = time2.Time{}
+	if token.ExpiresIn > 0 {
+		t.expiry = time2.Now().Add(time2.Duration(token.ExpiresIn) * time2.Second)
+	}
+	return t.token, nil
+}
+
+// invalidate drops token if it is still the cached one, the next call to Token requests a new one
+func (t *TokenSource) invalidate(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+// oauthTransport authenticates every request with a token of source. A request rejected with a 401 is sent
+// once more with a new token, in case the token was revoked before its expiry.
+type oauthTransport struct {
+	source *TokenSource
+	base   http.RoundTripper
+}
+
+func (o *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, token, err := o.send(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	// the body was consumed by the first attempt, it can only be sent again if it can be rewound
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	o.source.invalidate(token)
+	retry := req
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	res, _, err = o.send(retry)
+	return res, err
+}
+
+func (o *oauthTransport) send(req *http.Request) (*http.Response, string, error) {
+	token, err := o.source.Token(req.Context())
+	if err != nil {
+		return nil, "", err
+	}
+	// a RoundTripper must not modify the request it is given
+	authenticated := req.Clone(req.Context())
+	authenticated.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	res, err := o.base.RoundTrip(authenticated)
+	return res, token, err
+}
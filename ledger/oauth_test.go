@@ -0,0 +1,223 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	time2 "time"
+)
+
+// fakeTokenServer issues token-1, token-2... valid for expiresIn seconds
+type fakeTokenServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	issued    int
+	expiresIn int64
+}
+
+func newFakeTokenServer(t *testing.T, expiresIn int64) *fakeTokenServer {
+	f := &fakeTokenServer{expiresIn: expiresIn}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.issued++
+		issued := f.issued
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, issued, f.expiresIn)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTokenServer) tokens() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func TestTokenSourceCachesToken(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeTokenServer(t, 3600)
+	source := NewTokenSource(server.URL, "client", "secret", nil)
+	for i := 0; i < 3; i++ {
+		token, err := source.Token(ctx)
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if token != "token-1" {
+			t.Fatalf("call %d: got %s, want token-1", i, token)
+		}
+	}
+	if server.tokens() != 1 {
+		t.Errorf("token requests: got %d, want 1", server.tokens())
+	}
+
+	if _, err := NewTokenSource(server.URL, "client", "wrong", nil).Token(ctx); err == nil {
+		t.Errorf("Token with a wrong secret: got no error")
+	}
+}
+
+func TestTokenSourceRefreshesBeforeExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time2.Duration
+		refreshed bool
+	}{
+		{"long before expiry", tokenRefreshMargin + time2.Minute, false},
+		{"within the margin", tokenRefreshMargin - time2.Second, true},
+		{"expired", -time2.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := newFakeTokenServer(t, 3600)
+			source := NewTokenSource(server.URL, "client", "secret", nil)
+			if _, err := source.Token(ctx); err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			source.expiry = time2.Now().Add(tt.expiresIn)
+
+			token, err := source.Token(ctx)
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			want := "token-1"
+			if tt.refreshed {
+				want = "token-2"
+			}
+			if token != want {
+				t.Errorf("got %s, want %s", token, want)
+			}
+		})
+	}
+
+	// a lifetime shorter than the margin is never reused
+	server := newFakeTokenServer(t, 10)
+	source := NewTokenSource(server.URL, "client", "secret", nil)
+	for i := 0; i < 2; i++ {
+		if _, err := source.Token(context.Background()); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+	if server.tokens() != 2 {
+		t.Errorf("token requests for a short lived token: got %d, want 2", server.tokens())
+	}
+}
+
+// fakeAPI rejects the tokens in revoked, and every token when rejectAll is set, recording each call
+type fakeAPI struct {
+	*httptest.Server
+	mu        sync.Mutex
+	revoked   map[string]bool
+	rejectAll bool
+	calls     []string
+	bodies    []string
+}
+
+func newFakeAPI(t *testing.T, rejectAll bool, revoked ...string) *fakeAPI {
+	f := &fakeAPI{revoked: make(map[string]bool), rejectAll: rejectAll}
+	for _, token := range revoked {
+		f.revoked[token] = true
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.calls = append(f.calls, token)
+		f.bodies = append(f.bodies, string(body))
+		f.mu.Unlock()
+		if f.rejectAll || f.revoked[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestOAuthTransportRetriesUnauthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		rejectAll  bool
+		wantStatus int
+		wantCalls  []string
+	}{
+		{"revoked token", false, http.StatusOK, []string{"token-1", "token-2"}},
+		// the retry is sent once, its 401 is returned
+		{"rejected client", true, http.StatusUnauthorized, []string{"token-1", "token-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newFakeTokenServer(t, 3600)
+			api := newFakeAPI(t, tt.rejectAll, "token-1")
+			client := &http.Client{Transport: &oauthTransport{
+				source: NewTokenSource(tokens.URL, "client", "secret", nil),
+				base:   http.DefaultTransport,
+			}}
+
+			// strings.Reader bodies get a GetBody, the request can be sent again
+			req, err := http.NewRequest(http.MethodPost, api.URL, strings.NewReader(`{"postings":[]}`))
+			if err != nil {
+				t.Fatalf("NewRequest: %v", err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status: got %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if strings.Join(api.calls, ",") != strings.Join(tt.wantCalls, ",") {
+				t.Errorf("calls: got %v, want %v", api.calls, tt.wantCalls)
+			}
+			for i, body := range api.bodies {
+				if body != `{"postings":[]}` {
+					t.Errorf("body of call %d: got %q", i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestOAuthTransportKeepsUnrewindableBody(t *testing.T) {
+	tokens := newFakeTokenServer(t, 3600)
+	api := newFakeAPI(t, false, "token-1")
+	client := &http.Client{Transport: &oauthTransport{
+		source: NewTokenSource(tokens.URL, "client", "secret", nil),
+		base:   http.DefaultTransport,
+	}}
+
+	req, err := http.NewRequest(http.MethodPost, api.URL, io.NopCloser(strings.NewReader(`{"postings":[]}`)))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if req.GetBody != nil {
+		t.Fatalf("the request body can be rewound")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status: got %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+	if len(api.calls) != 1 {
+		t.Errorf("calls: got %v, want a single call", api.calls)
+	}
+}
@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+)
+
+const (
+	DefaultPageSize int64 = 15
+	// MaxPageSize is the largest page formance will return
+	MaxPageSize int64 = 1000
+)
+
+// cursor is the position encoded in the cursors of the memory and sql backends. like formance, the
+// cursor carries the filter of the first page so the following pages are requested with the cursor alone.
+type cursor struct {
+	// After is the address, or the txid, of the last item of the previous page
+	After    string             `json:"after"`
+	PageSize int64              `json:"page_size"`
+	Filter   *TransactionFilter `json:"filter,omitempty"`
+	// AccountFilter is the filter of a list of accounts
+	AccountFilter *AccountFilter `json:"account_filter,omitempty"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// readPage returns where page starts, with an empty After for the first page
+func readPage(page Page) (cursor, error) {
+	if page.Cursor == "" {
+		if page.PageSize <= 0 {
+			return cursor{PageSize: DefaultPageSize}, nil
+		}
+		return cursor{PageSize: page.PageSize}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err != nil {
+		return cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+	}
+	var c cursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+	}
+	if c.After == "" || c.PageSize <= 0 {
+		return cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// readTransactionsPage is readPage for transactions, the filter of the first page is kept in the cursor
+func readTransactionsPage(filter TransactionFilter, page Page) (cursor, error) {
+	c, err := readPage(page)
+	if err != nil {
+		return c, err
+	}
+	if page.Cursor == "" {
+		c.Filter = &filter
+	} else if c.Filter == nil {
+		c.Filter = &TransactionFilter{}
+	}
+	return c, nil
+}
+
+// readAccountsPage is readPage for accounts, the filter of the first page is kept in the cursor
+func readAccountsPage(filter AccountFilter, page Page) (cursor, error) {
+	c, err := readPage(page)
+	if err != nil {
+		return c, err
+	}
+	if page.Cursor == "" {
+		c.AccountFilter = &filter
+	} else if c.AccountFilter == nil {
+		c.AccountFilter = &AccountFilter{}
+	}
+	return c, nil
+}
+
+// ListAllAccounts follows the cursors of backend until every account matching filter has been listed
+func ListAllAccounts(ctx context.Context, backend Backend, filter AccountFilter) ([]shared.Account, error) {
+	var accounts []shared.Account
+	page := Page{PageSize: MaxPageSize}
+	for {
+		res, err := backend.ListAccounts(ctx, filter, page)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, res.Accounts...)
+		if res.Next == "" {
+			return accounts, nil
+		}
+		page = Page{Cursor: res.Next}
+	}
+}
+
+// ListAllTransactions follows the cursors of backend until every transaction matching filter has been listed,
+// most recent first
+func ListAllTransactions(ctx context.Context, backend Backend, filter TransactionFilter) ([]shared.Transaction, error) {
+	var transactions []shared.Transaction
+	page := Page{PageSize: MaxPageSize}
+	for {
+		res, err := backend.ListTransactions(ctx, filter, page)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, res.Transactions...)
+		if res.Next == "" {
+			return transactions, nil
+		}
+		page = Page{Cursor: res.Next}
+	}
+}
+
+// ListBalancesByPage reads the balances of addresses from backend, MaxPageSize addresses at a time. unlike
+// ListBalances it reads nothing when addresses is empty.
+func ListBalancesByPage(ctx context.Context, backend Backend, addresses []string) (map[string]map[string]int64, error) {
+	balances := make(map[string]map[string]int64)
+	for start := 0; start < len(addresses); start += int(MaxPageSize) {
+		end := start + int(MaxPageSize)
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		page, err := backend.ListBalances(ctx, addresses[start:end]...)
+		if err != nil {
+			return nil, err
+		}
+		for address, balance := range page {
+			balances[address] = balance
+		}
+	}
+	return balances, nil
+}
@@ -0,0 +1,224 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"magic-ledger/logger"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// RetryOptions configures the retries of the calls that fail for a reason other than the request
+type RetryOptions struct {
+	// MaxAttempts counts the first call, 1 disables retries
+	MaxAttempts int
+	// InitialInterval is the wait before the first retry, it doubles with every retry up to MaxInterval.
+	// every wait is randomized by half its length so the retries of concurrent requests spread out.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+}
+
+// Resilient retries the calls to the Backend it wraps that fail transiently, and fails fast through its
+// circuit breaker while the backend keeps failing. reads are always retried, writes only when they carry a
+// reference, which makes a write that reached the backend before failing fail again with
+// ErrDuplicateReference instead of being posted twice. that transaction is then returned, as if the first
+// attempt had succeeded.
+type Resilient struct {
+	backend Backend
+	retry   RetryOptions
+	breaker *CircuitBreaker
+}
+
+// NewResilient wraps backend, the calls are never failed fast when breaker is nil
+func NewResilient(backend Backend, retry RetryOptions, breaker *CircuitBreaker) *Resilient {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	if breaker == nil {
+		breaker = NewCircuitBreaker(0, 0)
+	}
+	return &Resilient{
+		backend: backend,
+		retry:   retry,
+		breaker: breaker,
+	}
+}
+
+// transient reports whether err is a failure of the backend worth retrying, rather than an error the
+// backend attributes to the request or the caller giving up
+func transient(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var formanceErr *FormanceError
+	if errors.As(err, &formanceErr) {
+		return formanceErr.StatusCode >= http.StatusInternalServerError || formanceErr.StatusCode == http.StatusTooManyRequests
+	}
+	switch {
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrDuplicateReference),
+		errors.Is(err, ErrInvalidPostings), errors.Is(err, ErrInvalidCursor):
+		return false
+	}
+	// the backend could not be reached or answered something unreadable
+	return true
+}
+
+// call runs op through the circuit breaker, retrying it while it fails transiently when retry is set
+func (r *Resilient) call(ctx context.Context, operation string, retry bool, op func() error) error {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = r.retry.InitialInterval
+	b.MaxInterval = r.retry.MaxInterval
+	b.MaxElapsedTime = 0
+	attempts := uint64(0)
+	if retry {
+		attempts = uint64(r.retry.MaxAttempts - 1)
+	}
+	return backoff.RetryNotify(
+		func() error {
+			call, err := r.breaker.allow(ctx)
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			err = op()
+			switch {
+			case err == nil:
+				r.breaker.record(ctx, call, false)
+				return nil
+			case ctx.Err() != nil:
+				r.breaker.abandon(call)
+				return backoff.Permanent(err)
+			case transient(ctx, err):
+				r.breaker.record(ctx, call, true)
+				return err
+			}
+			// the backend answered, the error is the request's
+			r.breaker.record(ctx, call, false)
+			return backoff.Permanent(err)
+		},
+		backoff.WithContext(backoff.WithMaxRetries(b, attempts), ctx),
+		func(err error, next time.Duration) {
+			logger.Warn(ctx, "ledger call failed, retrying", "operation", operation, "error", err, "retry_in", next)
+		},
+	)
+}
+
+func (r *Resilient) GetAccount(ctx context.Context, address string) (account *shared.AccountWithVolumesAndBalances, err error) {
+	err = r.call(ctx, "GetAccount", true, func() error {
+		account, err = r.backend.GetAccount(ctx, address)
+		return err
+	})
+	return account, err
+}
+
+func (r *Resilient) ListAccounts(ctx context.Context, filter AccountFilter, page Page) (accounts *AccountsPage, err error) {
+	err = r.call(ctx, "ListAccounts", true, func() error {
+		accounts, err = r.backend.ListAccounts(ctx, filter, page)
+		return err
+	})
+	return accounts, err
+}
+
+func (r *Resilient) ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (transactions *TransactionsPage, err error) {
+	err = r.call(ctx, "ListTransactions", true, func() error {
+		transactions, err = r.backend.ListTransactions(ctx, filter, page)
+		return err
+	})
+	return transactions, err
+}
+
+func (r *Resilient) GetTransaction(ctx context.Context, txid int64) (txn *shared.Transaction, err error) {
+	err = r.call(ctx, "GetTransaction", true, func() error {
+		txn, err = r.backend.GetTransaction(ctx, txid)
+		return err
+	})
+	return txn, err
+}
+
+func (r *Resilient) GetTransactionByReference(ctx context.Context, reference string) (txn *shared.Transaction, err error) {
+	err = r.call(ctx, "GetTransactionByReference", true, func() error {
+		txn, err = r.backend.GetTransactionByReference(ctx, reference)
+		return err
+	})
+	return txn, err
+}
+
+func (r *Resilient) ListBalances(ctx context.Context, addresses ...string) (balances map[string]map[string]int64, err error) {
+	err = r.call(ctx, "ListBalances", true, func() error {
+		balances, err = r.backend.ListBalances(ctx, addresses...)
+		return err
+	})
+	return balances, err
+}
+
+// AddMetaDataToAccount is not retried, it carries no reference
+func (r *Resilient) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	return r.call(ctx, "AddMetaDataToAccount", false, func() error {
+		return r.backend.AddMetaDataToAccount(ctx, address, metadata)
+	})
+}
+
+// AddMetaDataToTransaction is not retried, it carries no reference
+func (r *Resilient) AddMetaDataToTransaction(ctx context.Context, txid int64, metadata map[string]interface{}) error {
+	return r.call(ctx, "AddMetaDataToTransaction", false, func() error {
+		return r.backend.AddMetaDataToTransaction(ctx, txid, metadata)
+	})
+}
+
+// CreateTransactionWithPostings is only retried when the transaction has a reference
+func (r *Resilient) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	return r.createTransaction(ctx, "CreateTransactionWithPostings", reference, metadata, func() (*shared.Transaction, error) {
+		return r.backend.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+	})
+}
+
+// CreateTransactionFromScript is only retried when the transaction has a reference
+func (r *Resilient) CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error) {
+	return r.createTransaction(ctx, "CreateTransactionFromScript", reference, metadata, func() (*shared.Transaction, error) {
+		return r.backend.CreateTransactionFromScript(ctx, script, metadata, reference)
+	})
+}
+
+// createTransaction posts a transaction with post, retried when it has a reference. a retry failing with
+// ErrDuplicateReference finds the reference used by an earlier attempt that was posted before failing,
+// the transaction it posted is returned. a transaction with other metadata was posted by another caller,
+// the duplicate is theirs.
+func (r *Resilient) createTransaction(ctx context.Context, operation string, reference string, metadata map[string]interface{}, post func() (*shared.Transaction, error)) (txn *shared.Transaction, err error) {
+	attempts := 0
+	err = r.call(ctx, operation, reference != "", func() error {
+		attempts++
+		txn, err = post()
+		if attempts == 1 || !errors.Is(err, ErrDuplicateReference) {
+			return err
+		}
+		posted, getErr := r.backend.GetTransactionByReference(ctx, reference)
+		if getErr != nil {
+			return getErr
+		}
+		if posted == nil || !sameMetadata(posted.Metadata, metadata) {
+			return err
+		}
+		logger.Info(ctx, "ledger call posted before failing", "operation", operation, "reference", reference, "txid", posted.Txid)
+		txn = posted
+		return nil
+	})
+	return txn, err
+}
+
+// sameMetadata compares metadata as the backends return it, decoded from json
+func sameMetadata(a map[string]interface{}, b map[string]interface{}) bool {
+	var decoded [2]interface{}
+	for i, metadata := range []map[string]interface{}{a, b} {
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+		encoded, err := json.Marshal(metadata)
+		if err != nil || json.Unmarshal(encoded, &decoded[i]) != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(decoded[0], decoded[1])
+}
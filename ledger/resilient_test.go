@@ -0,0 +1,199 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+)
+
+// flakyBackend fails its first call as a gateway error, after posting the transaction when landed is set
+type flakyBackend struct {
+	Backend
+	landed bool
+	calls  int
+}
+
+func (f *flakyBackend) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	f.calls++
+	if f.calls > 1 {
+		return f.Backend.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+	}
+	if f.landed {
+		if _, err := f.Backend.CreateTransactionWithPostings(ctx, metadata, postings, reference); err != nil {
+			return nil, err
+		}
+	}
+	return nil, &FormanceError{Operation: "create transaction", StatusCode: 502}
+}
+
+func TestResilientResolvesDuplicateOnRetry(t *testing.T) {
+	ctx := context.Background()
+	postings := []TransactionPosting{{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 10}}
+	metadata := map[string]interface{}{"transaction_type": "capture_card", "amount": 10}
+
+	backend := &flakyBackend{Backend: NewMemory(), landed: true}
+	r := NewResilient(backend, RetryOptions{MaxAttempts: 3}, nil)
+	txn, err := r.CreateTransactionWithPostings(ctx, metadata, postings, "capture_card:1")
+	if err != nil {
+		t.Fatalf("retrying a posted transaction: %v", err)
+	}
+	if txn.Txid != 0 || backend.calls != 2 {
+		t.Fatalf("got txid %d after %d calls, want txid 0 after 2 calls", txn.Txid, backend.calls)
+	}
+
+	// a duplicate on the first attempt was posted by another caller
+	_, err = r.CreateTransactionWithPostings(ctx, metadata, postings, "capture_card:1")
+	if !errors.Is(err, ErrDuplicateReference) {
+		t.Fatalf("posting the reference again: got %v, want %v", err, ErrDuplicateReference)
+	}
+
+	// so is a transaction with other metadata found by a retry
+	memory := NewMemory()
+	if _, err = memory.CreateTransactionWithPostings(ctx, map[string]interface{}{"transaction_type": "void_card"}, postings, "hold:1"); err != nil {
+		t.Fatalf("posting: %v", err)
+	}
+	r = NewResilient(&flakyBackend{Backend: memory}, RetryOptions{MaxAttempts: 3}, nil)
+	_, err = r.CreateTransactionWithPostings(ctx, metadata, postings, "hold:1")
+	if !errors.Is(err, ErrDuplicateReference) {
+		t.Fatalf("retry finding another caller's transaction: got %v, want %v", err, ErrDuplicateReference)
+	}
+}
+
+// failingBackend fails its first failures calls with err, the following calls reach Backend
+type failingBackend struct {
+	Backend
+	failures int
+	err      error
+	calls    int
+}
+
+// errBackendDown is what a backend that can't be reached fails with
+var errBackendDown = errors.New("connection refused")
+
+func (f *failingBackend) fail() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *failingBackend) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Backend.GetAccount(ctx, address)
+}
+
+func (f *failingBackend) ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Backend.ListTransactions(ctx, filter, page)
+}
+
+func (f *failingBackend) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Backend.AddMetaDataToAccount(ctx, address, metadata)
+}
+
+func (f *failingBackend) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Backend.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+}
+
+func TestResilientRetries(t *testing.T) {
+	ctx := context.Background()
+	gateway := &FormanceError{Operation: "test", StatusCode: 502}
+	postings := []TransactionPosting{{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 10}}
+	getAccount := func(r *Resilient) error {
+		_, err := r.GetAccount(ctx, "card:a")
+		return err
+	}
+	listTransactions := func(r *Resilient) error {
+		_, err := r.ListTransactions(ctx, TransactionFilter{}, Page{})
+		return err
+	}
+	post := func(reference string) func(r *Resilient) error {
+		return func(r *Resilient) error {
+			_, err := r.CreateTransactionWithPostings(ctx, nil, postings, reference)
+			return err
+		}
+	}
+	tests := []struct {
+		name     string
+		call     func(r *Resilient) error
+		failures int
+		err      error
+		// wantCalls counts the calls that reached the backend
+		wantCalls int
+		wantErr   error
+	}{
+		{"read retried until it succeeds", getAccount, 2, gateway, 3, nil},
+		{"read retried at most MaxAttempts times", getAccount, 3, gateway, 3, gateway},
+		{"read of an unreachable backend retried", listTransactions, 1, errors.New("connection reset"), 2, nil},
+		{"read throttled retried", listTransactions, 1, &FormanceError{Operation: "test", StatusCode: 429}, 2, nil},
+		{"read rejected not retried", getAccount, 1, &FormanceError{Operation: "test", StatusCode: 400}, 1, &FormanceError{Operation: "test", StatusCode: 400}},
+		{"write with a reference retried", post("ref:1"), 1, gateway, 2, nil},
+		{"write without a reference not retried", post(""), 1, gateway, 1, gateway},
+		{"write overdrawing not retried", post("ref:2"), 1, ErrInsufficientFunds, 1, ErrInsufficientFunds},
+		{"metadata not retried", func(r *Resilient) error {
+			return r.AddMetaDataToAccount(ctx, "card:a", map[string]interface{}{"name": "alice"})
+		}, 1, gateway, 1, gateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &failingBackend{Backend: NewMemory(), failures: tt.failures, err: tt.err}
+			r := NewResilient(backend, RetryOptions{MaxAttempts: 3}, nil)
+			err := tt.call(r)
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && err == nil {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && err.Error() != tt.wantErr.Error() {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+			if backend.calls != tt.wantCalls {
+				t.Errorf("calls: got %d, want %d", backend.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResilientCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		maxAttempts int
+		// calls are made one after the other, each getting the matching error
+		wantErrs  []error
+		wantCalls int
+	}{
+		{"opened by failed calls", 1, []error{errBackendDown, errBackendDown, ErrCircuitOpen, ErrCircuitOpen}, 2},
+		{"opened by the retries of a call", 3, []error{ErrCircuitOpen, ErrCircuitOpen}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &failingBackend{Backend: NewMemory(), failures: 100, err: errBackendDown}
+			breaker := NewCircuitBreaker(2, time.Hour)
+			r := NewResilient(backend, RetryOptions{MaxAttempts: tt.maxAttempts}, breaker)
+			for i, want := range tt.wantErrs {
+				if _, err := r.GetAccount(ctx, "card:a"); !errors.Is(err, want) {
+					t.Errorf("call %d: got %v, want %v", i, err, want)
+				}
+			}
+			if backend.calls != tt.wantCalls {
+				t.Errorf("calls reaching the backend: got %d, want %d", backend.calls, tt.wantCalls)
+			}
+			if state, _ := breaker.State(); state != CircuitOpen {
+				t.Errorf("circuit: got %s, want %s", state, CircuitOpen)
+			}
+		})
+	}
+}
@@ -0,0 +1,705 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/formancehq/formance-sdk-go/pkg/models/shared"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// registers the "postgres" driver
+	"github.com/lib/pq"
+	// registers the embedded "sqlite" driver
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// the database/sql drivers the SQL backend runs on
+const (
+	// SQLiteDriver is the embedded sqlite driver
+	SQLiteDriver = "sqlite"
+	// PostgresDriver is the postgres driver of github.com/lib/pq
+	PostgresDriver = "postgres"
+)
+
+// SQL is a Backend that stores the ledger in an embedded sqlite database or in postgres
+type SQL struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// NewSQL opens the database and brings its schema up to date
+func NewSQL(ctx context.Context, driver string, dsn string) (*SQL, error) {
+	var d dialect
+	switch driver {
+	case SQLiteDriver:
+		d = sqliteDialect
+		// pragmas only apply to the connection they run on, the driver runs the ones of the dsn on every new connection
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "_pragma=foreign_keys(1)"
+	case PostgresDriver:
+		d = postgresDialect
+	default:
+		return nil, fmt.Errorf("unsupported sql driver %q, the sql backend runs on %s or %s", driver, SQLiteDriver, PostgresDriver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SQLiteDriver {
+		// sqlite only allows a single writer, serialize access instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQL{
+		db:      db,
+		dialect: d,
+	}
+	if err = s.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate ledger database: %w", err)
+	}
+	return s, nil
+}
+
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies, in order, every embedded migration that has not been applied yet
+func (s *SQL) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	entries, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		version, err := strconv.Atoi(strings.SplitN(entry.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("invalid migration name %s", entry.Name())
+		}
+		script, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		err = s.inTx(ctx, func(tx *sql.Tx) error {
+			var applied int
+			if err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied > 0 {
+				return nil
+			}
+			for _, stmt := range strings.Split(string(script), ";") {
+				if strings.TrimSpace(stmt) == "" {
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return fmt.Errorf("migration %s: %w", entry.Name(), err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQL) AddMetaDataToAccount(ctx context.Context, address string, metadata map[string]interface{}) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.ensureAccount(ctx, tx, address); err != nil {
+			return err
+		}
+		for k, v := range metadata {
+			value, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO account_metadata (address, key, value) VALUES (?, ?, ?)
+				ON CONFLICT (address, key) DO UPDATE SET value = excluded.value`), address, k, string(value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQL) AddMetaDataToTransaction(ctx context.Context, txid int64, metadata map[string]interface{}) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var encoded string
+		err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT metadata FROM transactions WHERE txid = ?"+s.dialect.lockRow), txid).Scan(&encoded)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no transaction with txid %d", txid)
+		} else if err != nil {
+			return err
+		}
+		updated := make(map[string]interface{})
+		if err = json.Unmarshal([]byte(encoded), &updated); err != nil {
+			return err
+		}
+		for k, v := range metadata {
+			updated[k] = v
+		}
+		b, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind("UPDATE transactions SET metadata = ? WHERE txid = ?"), string(b), txid)
+		return err
+	})
+}
+
+func (s *SQL) GetAccount(ctx context.Context, address string) (*shared.AccountWithVolumesAndBalances, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind("SELECT COUNT(*) FROM accounts WHERE address = ?"), address).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, nil
+	}
+	metadata, err := s.accountMetadata(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	res := &shared.AccountWithVolumesAndBalances{
+		Address:  address,
+		Balances: make(map[string]*big.Int),
+		Metadata: metadata[address],
+		Volumes:  make(map[string]map[string]*big.Int),
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind("SELECT asset, input, output FROM volumes WHERE address = ?"), address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var asset string
+		var input, output int64
+		if err = rows.Scan(&asset, &input, &output); err != nil {
+			return nil, err
+		}
+		res.Balances[asset] = big.NewInt(input - output)
+		res.Volumes[asset] = map[string]*big.Int{
+			"input":  big.NewInt(input),
+			"output": big.NewInt(output),
+		}
+	}
+	return res, rows.Err()
+}
+
+func (s *SQL) ListAccounts(ctx context.Context, filter AccountFilter, page Page) (*AccountsPage, error) {
+	c, err := readAccountsPage(filter, page)
+	if err != nil {
+		return nil, err
+	}
+	after, pageSize, prefix := c.After, c.PageSize, c.AccountFilter.AddressPrefix
+	conditions := []string{"address > ?", "substr(address, 1, ?) = ?"}
+	args := []interface{}{after, len(prefix), prefix}
+	// sorted so the query, and its placeholders, are the same for the same filter
+	keys := make([]string, 0, len(c.AccountFilter.Metadata))
+	for k := range c.AccountFilter.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// values are stored encoded, a string matches its json encoding and any other value its text, see metadataString
+		quoted, err := json.Marshal(c.AccountFilter.Metadata[k])
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "address IN (SELECT address FROM account_metadata WHERE key = ? AND (value = ? OR value = ?))")
+		args = append(args, k, string(quoted), c.AccountFilter.Metadata[k])
+	}
+	// one more than the page size tells whether there is a next page
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind("SELECT address FROM accounts WHERE "+strings.Join(conditions, " AND ")+" ORDER BY address LIMIT ?"),
+		append(args, pageSize+1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := &AccountsPage{
+		Accounts: make([]shared.Account, 0),
+	}
+	for rows.Next() {
+		var address string
+		if err = rows.Scan(&address); err != nil {
+			return nil, err
+		}
+		if int64(len(res.Accounts)) == pageSize {
+			res.Next = cursor{After: res.Accounts[len(res.Accounts)-1].Address, PageSize: pageSize, AccountFilter: c.AccountFilter}.encode()
+			break
+		}
+		res.Accounts = append(res.Accounts, shared.Account{
+			Address: address,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// closed before the next query, sqlite runs on a single connection
+	_ = rows.Close()
+
+	addresses := make([]string, len(res.Accounts))
+	for i, account := range res.Accounts {
+		addresses[i] = account.Address
+	}
+	metadata, err := s.accountMetadata(ctx, addresses...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res.Accounts {
+		res.Accounts[i].Metadata = metadata[res.Accounts[i].Address]
+	}
+	return res, nil
+}
+
+func (s *SQL) ListTransactions(ctx context.Context, filter TransactionFilter, page Page) (*TransactionsPage, error) {
+	c, err := readTransactionsPage(filter, page)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []interface{}
+	if c.After != "" {
+		txid, err := strconv.ParseInt(c.After, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+		}
+		conditions, args = append(conditions, "txid < ?"), append(args, txid)
+	}
+	if c.Filter.Account != "" {
+		conditions = append(conditions, "txid IN (SELECT txid FROM postings WHERE source = ? OR destination = ?)")
+		args = append(args, c.Filter.Account, c.Filter.Account)
+	}
+	if c.Filter.StartTime != nil {
+		conditions, args = append(conditions, s.dialect.timestamp("timestamp")+" >= ?"), append(args, s.dialect.timestampArg(*c.Filter.StartTime))
+	}
+	if c.Filter.EndTime != nil {
+		conditions, args = append(conditions, s.dialect.timestamp("timestamp")+" < ?"), append(args, s.dialect.timestampArg(*c.Filter.EndTime))
+	}
+	// sorted so the query, and its placeholders, are the same for the same filter
+	keys := make([]string, 0, len(c.Filter.Metadata))
+	for k := range c.Filter.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conditions, args = append(conditions, s.dialect.jsonField("metadata")+" = ?"), append(args, s.dialect.jsonFieldArg(k), c.Filter.Metadata[k])
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	transactions, err := s.queryTransactions(ctx, where, c.PageSize+1, args...)
+	if err != nil {
+		return nil, err
+	}
+	res := &TransactionsPage{
+		Transactions: transactions,
+	}
+	if res.Transactions == nil {
+		res.Transactions = make([]shared.Transaction, 0)
+	}
+	if int64(len(transactions)) > c.PageSize {
+		res.Transactions = transactions[:c.PageSize]
+		last := res.Transactions[c.PageSize-1].Txid
+		res.Next = cursor{After: strconv.FormatInt(last, 10), PageSize: c.PageSize, Filter: c.Filter}.encode()
+	}
+	return res, nil
+}
+
+func (s *SQL) GetTransaction(ctx context.Context, txid int64) (*shared.Transaction, error) {
+	transactions, err := s.queryTransactions(ctx, "WHERE txid = ?", 0, txid)
+	if err != nil || len(transactions) == 0 {
+		return nil, err
+	}
+	return &transactions[0], nil
+}
+
+func (s *SQL) GetTransactionByReference(ctx context.Context, reference string) (*shared.Transaction, error) {
+	transactions, err := s.queryTransactions(ctx, "WHERE reference = ?", 0, reference)
+	if err != nil || len(transactions) == 0 {
+		return nil, err
+	}
+	return &transactions[0], nil
+}
+
+// queryTransactions returns, most recent first, the transactions matching the where clause along with their postings
+func (s *SQL) queryTransactions(ctx context.Context, where string, limit int64, args ...interface{}) ([]shared.Transaction, error) {
+	// most recent first, matching formance. a limit of 0 returns every matching transaction
+	where += " ORDER BY txid DESC"
+	if limit > 0 {
+		where += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind("SELECT txid, timestamp, reference, metadata FROM transactions "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transactions []shared.Transaction
+	txnIndex := make(map[int64]int)
+	for rows.Next() {
+		var txn shared.Transaction
+		var reference sql.NullString
+		var metadata string
+		if err = rows.Scan(&txn.Txid, &txn.Timestamp, &reference, &metadata); err != nil {
+			return nil, err
+		}
+		if reference.Valid {
+			txn.Reference = &reference.String
+		}
+		if err = json.Unmarshal([]byte(metadata), &txn.Metadata); err != nil {
+			return nil, err
+		}
+		txnIndex[txn.Txid] = len(transactions)
+		transactions = append(transactions, txn)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	postingRows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT txid, source, destination, asset, amount FROM postings
+		WHERE txid IN (SELECT txid FROM transactions `+where+`) ORDER BY txid, idx`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer postingRows.Close()
+	for postingRows.Next() {
+		var txid, amount int64
+		var posting shared.Posting
+		if err = postingRows.Scan(&txid, &posting.Source, &posting.Destination, &posting.Asset, &amount); err != nil {
+			return nil, err
+		}
+		posting.Amount = big.NewInt(amount)
+		if i, ok := txnIndex[txid]; ok {
+			transactions[i].Postings = append(transactions[i].Postings, posting)
+		}
+	}
+	return transactions, postingRows.Err()
+}
+
+func (s *SQL) ListBalances(ctx context.Context, addresses ...string) (map[string]map[string]int64, error) {
+	query := "SELECT address, asset, input - output FROM volumes"
+	args := make([]interface{}, len(addresses))
+	for i, address := range addresses {
+		args[i] = address
+	}
+	if len(addresses) > 0 {
+		query += " WHERE address IN (?" + strings.Repeat(", ?", len(addresses)-1) + ")"
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accountToBalance := make(map[string]map[string]int64)
+	for rows.Next() {
+		var address, asset string
+		var balance int64
+		if err = rows.Scan(&address, &asset, &balance); err != nil {
+			return nil, err
+		}
+		if _, ok := accountToBalance[address]; !ok {
+			accountToBalance[address] = make(map[string]int64)
+		}
+		accountToBalance[address][asset] = balance
+	}
+	return accountToBalance, rows.Err()
+}
+
+// CreateTransactionFromScript runs script locally, see compileScript
+func (s *SQL) CreateTransactionFromScript(ctx context.Context, script Script, metadata map[string]interface{}, reference string) (*shared.Transaction, error) {
+	postings, err := compileScript(script)
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateTransactionWithPostings(ctx, metadata, postings, reference)
+}
+
+// CreateTransactionWithPostings applies every posting inside a single database transaction. Each
+// debit is a conditional update so an account other than world can never be overdrawn, even by
+// concurrent writers.
+func (s *SQL) CreateTransactionWithPostings(ctx context.Context, metadata map[string]interface{}, postings []TransactionPosting, reference string) (*shared.Transaction, error) {
+	if err := validatePostings(postings); err != nil {
+		return nil, err
+	}
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := &shared.Transaction{
+		Metadata:          copyMetadata(metadata),
+		PostCommitVolumes: make(map[string]map[string]shared.Volume),
+		PreCommitVolumes:  make(map[string]map[string]shared.Volume),
+		Timestamp:         time.Now().UTC(),
+	}
+	var nullableReference sql.NullString
+	if reference != "" {
+		txn.Reference = &reference
+		nullableReference = sql.NullString{String: reference, Valid: true}
+	}
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		// the sequence is rolled back with the transaction, so txids have no gaps
+		err := tx.QueryRowContext(ctx, "UPDATE sequences SET value = value + 1 WHERE name = 'txid' RETURNING value - 1").Scan(&txn.Txid)
+		if err != nil {
+			return err
+		}
+		// the unique constraint, not a lookup, rejects a reused reference so concurrent writers can't both post it
+		_, err = tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO transactions (txid, timestamp, reference, metadata) VALUES (?, ?, ?, ?)"),
+			txn.Txid, txn.Timestamp, nullableReference, string(encodedMetadata))
+		if s.dialect.isDuplicateReference(err) {
+			return fmt.Errorf("%w: %s", ErrDuplicateReference, reference)
+		} else if err != nil {
+			return err
+		}
+
+		for i, p := range postings {
+			for _, address := range []string{p.Src, p.Dest} {
+				if err = s.ensureAccount(ctx, tx, address); err != nil {
+					return err
+				}
+				if err = s.ensureVolume(ctx, tx, address, p.Asset); err != nil {
+					return err
+				}
+				if _, ok := txn.PreCommitVolumes[address]; !ok {
+					txn.PreCommitVolumes[address] = make(map[string]shared.Volume)
+				}
+				if _, ok := txn.PreCommitVolumes[address][p.Asset]; ok {
+					continue
+				}
+				volume, err := s.volume(ctx, tx, address, p.Asset)
+				if err != nil {
+					return err
+				}
+				txn.PreCommitVolumes[address][p.Asset] = volume
+			}
+
+			debit := "UPDATE volumes SET output = output + ? WHERE address = ? AND asset = ?"
+			args := []interface{}{p.Amount, p.Src, p.Asset}
+			if p.Src != WorldAccount {
+				debit += " AND input - output >= ?"
+				args = append(args, p.Amount)
+			}
+			res, err := tx.ExecContext(ctx, s.dialect.rebind(debit), args...)
+			if err != nil {
+				return err
+			}
+			if updated, err := res.RowsAffected(); err != nil {
+				return err
+			} else if updated == 0 {
+				return fmt.Errorf("%w: account %s in %s", ErrInsufficientFunds, p.Src, p.Asset)
+			}
+			_, err = tx.ExecContext(ctx, s.dialect.rebind("UPDATE volumes SET input = input + ? WHERE address = ? AND asset = ?"),
+				p.Amount, p.Dest, p.Asset)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO postings (txid, idx, source, destination, asset, amount)
+				VALUES (?, ?, ?, ?, ?, ?)`), txn.Txid, i, p.Src, p.Dest, p.Asset, p.Amount)
+			if err != nil {
+				return err
+			}
+			txn.Postings = append(txn.Postings, shared.Posting{
+				Amount:      big.NewInt(p.Amount),
+				Asset:       p.Asset,
+				Destination: p.Dest,
+				Source:      p.Src,
+			})
+		}
+
+		for address, volumes := range txn.PreCommitVolumes {
+			txn.PostCommitVolumes[address] = make(map[string]shared.Volume, len(volumes))
+			for asset := range volumes {
+				volume, err := s.volume(ctx, tx, address, asset)
+				if err != nil {
+					return err
+				}
+				txn.PostCommitVolumes[address][asset] = volume
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// ensureAccount creates address if it does not exist yet
+func (s *SQL) ensureAccount(ctx context.Context, tx *sql.Tx, address string) error {
+	_, err := tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO accounts (address, created_at) VALUES (?, ?) ON CONFLICT (address) DO NOTHING"),
+		address, time.Now().UTC())
+	return err
+}
+
+// ensureVolume creates a zero volume of asset for address if it does not exist yet
+func (s *SQL) ensureVolume(ctx context.Context, tx *sql.Tx, address string, asset string) error {
+	_, err := tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO volumes (address, asset) VALUES (?, ?) ON CONFLICT (address, asset) DO NOTHING"),
+		address, asset)
+	return err
+}
+
+func (s *SQL) volume(ctx context.Context, tx *sql.Tx, address string, asset string) (shared.Volume, error) {
+	var input, output int64
+	err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT input, output FROM volumes WHERE address = ? AND asset = ?"), address, asset).
+		Scan(&input, &output)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return shared.Volume{}, err
+	}
+	return shared.Volume{
+		Balance: big.NewInt(input - output),
+		Input:   big.NewInt(input),
+		Output:  big.NewInt(output),
+	}, nil
+}
+
+// accountMetadata returns the metadata of every address, an address without metadata gets an empty map
+func (s *SQL) accountMetadata(ctx context.Context, addresses ...string) (map[string]map[string]interface{}, error) {
+	res := make(map[string]map[string]interface{}, len(addresses))
+	if len(addresses) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, len(addresses))
+	for i, address := range addresses {
+		res[address] = make(map[string]interface{})
+		args[i] = address
+	}
+	query := "SELECT address, key, value FROM account_metadata WHERE address IN (?" + strings.Repeat(", ?", len(addresses)-1) + ")"
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var acct, key, value string
+		if err = rows.Scan(&acct, &key, &value); err != nil {
+			return nil, err
+		}
+		var decoded interface{}
+		if err = json.Unmarshal([]byte(value), &decoded); err != nil {
+			return nil, err
+		}
+		res[acct][key] = decoded
+	}
+	return res, rows.Err()
+}
+
+func (s *SQL) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// dialect is what the queries need to know of the database they run on. they are written for sqlite, with ?
+// placeholders, and rebound to the placeholders of the database before running
+type dialect struct {
+	rebind func(query string) string
+	// jsonField is an expression of the text of a key of the json object in column, the key is bound with jsonFieldArg
+	jsonField    func(column string) string
+	jsonFieldArg func(key string) interface{}
+	// timestamp is an expression of a timestamp column that compares in time order with timestampArg
+	timestamp    func(column string) string
+	timestampArg func(t time.Time) interface{}
+	// isDuplicateReference tells whether err is the unique constraint on the reference of a transaction failing
+	isDuplicateReference func(err error) bool
+	// lockRow ends a select reading a row the transaction then updates, so concurrent updates don't overwrite
+	// each other
+	lockRow string
+}
+
+var sqliteDialect = dialect{
+	rebind: func(query string) string {
+		return query
+	},
+	jsonField: func(column string) string {
+		return fmt.Sprintf("json_extract(%s, ?)", column)
+	},
+	jsonFieldArg: func(key string) interface{} {
+		return `$."` + key + `"`
+	},
+	// the sqlite driver stores timestamps as the text of time.Time.String, which neither sorts nor parses, every
+	// timestamp is written in UTC so the zone is dropped before formatting it to a fixed width
+	timestamp: func(column string) string {
+		return fmt.Sprintf("strftime('%%Y-%%m-%%dT%%H:%%M:%%f', replace(%s, ' +0000 UTC', ''))", column)
+	},
+	timestampArg: func(t time.Time) interface{} {
+		return t.UTC().Format(sqliteTimestamp)
+	},
+	isDuplicateReference: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+			strings.Contains(sqliteErr.Error(), "transactions.reference")
+	},
+	// the single connection already serializes the transactions
+	lockRow: "",
+}
+
+// sqliteTimestamp is the fixed width format the sqlite timestamps compare in
+const sqliteTimestamp = "2006-01-02T15:04:05.000"
+
+var postgresDialect = dialect{
+	rebind: func(query string) string {
+		var b strings.Builder
+		n := 0
+		for _, r := range query {
+			if r == '?' {
+				n++
+				fmt.Fprintf(&b, "$%d", n)
+				continue
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	},
+	// the key is cast as ->> also takes an array index
+	jsonField: func(column string) string {
+		return fmt.Sprintf("(%s::jsonb ->> CAST(? AS TEXT))", column)
+	},
+	jsonFieldArg: func(key string) interface{} {
+		return key
+	},
+	timestamp: func(column string) string {
+		return column
+	},
+	timestampArg: func(t time.Time) interface{} {
+		return t.UTC()
+	},
+	isDuplicateReference: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "transactions_reference_key"
+	},
+	lockRow: " FOR UPDATE",
+}
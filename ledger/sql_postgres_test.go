@@ -0,0 +1,36 @@
+//go:build postgres
+
+package ledger
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// run the sql tests on postgres with
+//
+//	MAGIC_LEDGER_TEST_POSTGRES_DSN=postgres://localhost/magic_ledger_test?sslmode=disable go test -tags postgres ./ledger
+//
+// every test starts by dropping the tables of the ledger, the database must not hold anything else
+func init() {
+	testSQLDriver = PostgresDriver
+	testSQLDSN = os.Getenv("MAGIC_LEDGER_TEST_POSTGRES_DSN")
+	resetTestSQL = resetPostgres
+}
+
+func resetPostgres(t *testing.T) {
+	t.Helper()
+	if testSQLDSN == "" {
+		t.Skip("MAGIC_LEDGER_TEST_POSTGRES_DSN is not set")
+	}
+	db, err := sql.Open(PostgresDriver, testSQLDSN)
+	if err != nil {
+		t.Fatalf("opening postgres: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec("DROP TABLE IF EXISTS postings, volumes, account_metadata, transactions, accounts, sequences, schema_migrations")
+	if err != nil {
+		t.Fatalf("dropping the ledger tables: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package ledger
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// the database the sql tests run on, built with the postgres tag they run on postgres instead, see sql_postgres_test.go
+var (
+	testSQLDriver = SQLiteDriver
+	testSQLDSN    = "file::memory:"
+	// resetTestSQL empties the database before a test, an in-memory sqlite database starts empty
+	resetTestSQL = func(t *testing.T) {}
+)
+
+func newTestSQL(t *testing.T) *SQL {
+	t.Helper()
+	resetTestSQL(t)
+	s, err := NewSQL(context.Background(), testSQLDriver, testSQLDSN)
+	if err != nil {
+		t.Fatalf("NewSQL: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestSQLReopen(t *testing.T) {
+	ctx := context.Background()
+	resetTestSQL(t)
+	dsn := testSQLDSN
+	if testSQLDriver == SQLiteDriver {
+		dsn = "file:" + filepath.Join(t.TempDir(), "ledger.db")
+	}
+	s, err := NewSQL(ctx, testSQLDriver, dsn)
+	if err != nil {
+		t.Fatalf("NewSQL: %v", err)
+	}
+	post(t, s, "", TransactionPosting{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 1})
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the migrations are applied once, the txid sequence carries on
+	s, err = NewSQL(ctx, testSQLDriver, dsn)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer s.Close()
+	if testSQLDriver == SQLiteDriver {
+		var foreignKeys int
+		if err = s.db.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+			t.Errorf("foreign keys: got %d, %v, want enforced", foreignKeys, err)
+		}
+	}
+	txn, err := s.CreateTransactionWithPostings(ctx, nil, []TransactionPosting{
+		{Src: WorldAccount, Dest: "card:a", Asset: "USD/2", Amount: 1},
+	}, "")
+	if err != nil || txn.Txid != 1 {
+		t.Fatalf("posting after reopening: got %+v, %v, want txid 1", txn, err)
+	}
+
+	if _, err = NewSQL(ctx, "mysql", dsn); err == nil {
+		t.Errorf("NewSQL with the mysql driver: got no error")
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	got := postgresDialect.rebind("SELECT address FROM accounts WHERE address > ? AND substr(address, 1, ?) = ? LIMIT ?")
+	if want := "SELECT address FROM accounts WHERE address > $1 AND substr(address, 1, $2) = $3 LIMIT $4"; got != want {
+		t.Errorf("rebind: got %q, want %q", got, want)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	testBackend(t, func(t *testing.T) Backend { return newTestSQL(t) })
+}
@@ -2,26 +2,284 @@ package logger
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func Error(ctx context.Context, err error, msg string, args ...interface{}) {
-	errorFmt := msg
-	if len(args) > 0 {
-		errorFmt = fmt.Sprintf(msg, args)
+// Level is the severity of a log line, lines below the level set with SetLevel are dropped
+type Level int32
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int32(l))
+}
+
+// ParseLevel reads one of debug, info, warn or error, in any case
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of debug, info, warn or error", s)
+}
+
+// Format is how log lines are written
+type Format int32
+
+const (
+	// FormatText writes key=value pairs after the message, values are quoted when they need to be
+	FormatText Format = iota
+	// FormatJSON writes every line as a JSON object
+	FormatJSON
+)
+
+// ParseFormat reads one of text or json
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q, expected text or json", s)
+}
+
+var (
+	level  atomic.Int32
+	format atomic.Int32
+
+	mu  sync.Mutex
+	out io.Writer = os.Stderr
+)
+
+// SetLevel changes the minimum level logged, it is safe to call while logging
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// GetLevel returns the minimum level logged
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+// SetFormat changes how the lines are written, it is safe to call while logging
+func SetFormat(f Format) {
+	format.Store(int32(f))
+}
+
+// SetOutput changes where the lines are written, stderr by default
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Enabled reports whether lines of level l are logged
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	routeKey
+)
+
+// WithRequestID returns a copy of ctx whose log lines carry the request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the request id of ctx, empty if it has none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRoute returns a copy of ctx whose log lines carry the name of the route being served
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey, route)
+}
+
+// Route returns the name of the route of ctx, empty if it has none
+func Route(ctx context.Context) string {
+	route, _ := ctx.Value(routeKey).(string)
+	return route
+}
+
+// Debug logs msg with the alternating keys and values of kv, ex. Debug(ctx, "card spent", "card_id", id)
+func Debug(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelDebug, nil, msg, kv)
+}
+
+func Info(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelInfo, nil, msg, kv)
+}
+
+func Warn(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelWarn, nil, msg, kv)
+}
+
+// Error logs msg with err, which may be nil, under the error key
+func Error(ctx context.Context, err error, msg string, kv ...interface{}) {
+	write(ctx, LevelError, err, msg, kv)
+}
+
+// Fatal logs msg like Error then exits the process
+func Fatal(ctx context.Context, err error, msg string, kv ...interface{}) {
+	write(ctx, LevelError, err, msg, kv)
+	os.Exit(1)
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func write(ctx context.Context, l Level, err error, msg string, kv []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	fields := make([]field, 0, 3+len(kv)/2)
+	if id := RequestID(ctx); id != "" {
+		fields = append(fields, field{"request_id", id})
+	}
+	if route := Route(ctx); route != "" {
+		fields = append(fields, field{"route", route})
 	}
 	if err != nil {
-		log.Print(fmt.Sprintf("ERROR [context=%v] [error=%s] %s", ctx, err.Error(), errorFmt))
+		fields = append(fields, field{"error", err})
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		// like slog, a value without a key is kept under !BADKEY rather than lost
+		if !ok || i+1 == len(kv) {
+			fields = append(fields, field{"!BADKEY", kv[i]})
+			i--
+			continue
+		}
+		fields = append(fields, field{key, kv[i+1]})
+	}
+
+	now := time.Now()
+	var line []byte
+	if Format(format.Load()) == FormatJSON {
+		line = jsonLine(now, l, msg, fields)
 	} else {
-		log.Print(fmt.Sprintf("ERROR [context=%v] %s", ctx, errorFmt))
+		line = textLine(now, l, msg, fields)
 	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, _ = out.Write(line)
 }
 
-func Info(ctx context.Context, msg string, args ...interface{}) {
-	infoFmt := msg
-	if len(args) > 0 {
-		infoFmt = fmt.Sprintf(msg, args)
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func textLine(now time.Time, l Level, msg string, fields []field) []byte {
+	var b strings.Builder
+	b.WriteString(now.Format(timeFormat))
+	b.WriteByte(' ')
+	b.WriteString(l.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(quote(textValue(f.value)))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	// structs such as requests are mostly pointers, their JSON is what is worth reading
+	if encoded, err := json.Marshal(v); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+// quote quotes s when it would otherwise be ambiguous in a key=value line
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func jsonLine(now time.Time, l Level, msg string, fields []field) []byte {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	writeJSON(&b, now.Format(timeFormat))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, l.String())
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, msg)
+	for _, f := range fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.key)
+		b.WriteByte(':')
+		writeJSON(&b, jsonValue(f.value))
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(b *strings.Builder, v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%+v", v))
 	}
-	log.Print(fmt.Sprintf("INFO [context=%v] %s", ctx, infoFmt))
+	b.Write(encoded)
 }
@@ -0,0 +1,120 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the lines to a buffer at level l in format f, until the end of the test
+func captureLogs(t *testing.T, l Level, f Format) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	mu.Lock()
+	previousOut := out
+	mu.Unlock()
+	previousLevel, previousFormat := GetLevel(), Format(format.Load())
+	SetOutput(&buf)
+	SetLevel(l)
+	SetFormat(f)
+	t.Cleanup(func() {
+		SetOutput(previousOut)
+		SetLevel(previousLevel)
+		SetFormat(previousFormat)
+	})
+	return &buf
+}
+
+func TestLevelFiltering(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		level Level
+		want  []string
+	}{
+		{LevelDebug, []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{LevelInfo, []string{"INFO", "WARN", "ERROR"}},
+		{LevelWarn, []string{"WARN", "ERROR"}},
+		{LevelError, []string{"ERROR"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			buf := captureLogs(t, tt.level, FormatText)
+			Debug(ctx, "debug")
+			Info(ctx, "info")
+			Warn(ctx, "warn")
+			Error(ctx, nil, "error")
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				got = append(got, strings.Fields(line)[1])
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("levels logged: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warning": LevelWarn, "Error": LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q): got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel of an unknown level: got no error")
+	}
+}
+
+func TestTextLine(t *testing.T) {
+	buf := captureLogs(t, LevelInfo, FormatText)
+	ctx := WithRoute(WithRequestID(context.Background(), "req-1"), "PurchaseCard")
+	Error(ctx, errors.New("ledger down"), "purchase failed", "card_id", "cards:1", "amount", 100, "dangling")
+
+	line := strings.TrimSpace(buf.String())
+	fields := strings.SplitN(line, " ", 3)
+	if _, err := time.Parse(timeFormat, fields[0]); err != nil {
+		t.Errorf("time of %q: %v", line, err)
+	}
+	// values with spaces are quoted, a value without a key is kept
+	want := `ERROR purchase failed request_id=req-1 route=PurchaseCard error="ledger down" card_id=cards:1 amount=100 !BADKEY=dangling`
+	if got := fields[1] + " " + fields[2]; got != want {
+		t.Errorf("text line: got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLine(t *testing.T) {
+	buf := captureLogs(t, LevelInfo, FormatJSON)
+	ctx := WithRequestID(context.Background(), "req-1")
+	Info(ctx, "request handled", "status", 201, "duration", 1500*time.Millisecond, "path", "/card/purchase")
+	Debug(ctx, "dropped")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1: %q", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("decoding %q: %v", lines[0], err)
+	}
+	want := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "request handled",
+		"request_id": "req-1",
+		"status":     float64(201),
+		"duration":   "1.5s",
+		"path":       "/card/purchase",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Errorf("no time in %q", lines[0])
+	}
+}
@@ -1,15 +1,232 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cenkalti/backoff/v4"
 	"magic-ledger/api"
+	"magic-ledger/config"
+	"magic-ledger/ledger"
+	"magic-ledger/logger"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	api.InitializeInternalAccounts()
-	router := api.NewRouter()
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"_CONFIG"), "yaml configuration file, settings can also be set through the environment")
+	backend := flag.String("ledger", "", "ledger backend to use, one of formance, memory or sql (overrides ledger.backend)")
+	sqlDriver := flag.String("sql-driver", "", "driver of the sql ledger backend, sqlite or postgres (overrides sql.driver)")
+	sqlDsn := flag.String("sql-dsn", "", "data source name used by the sql ledger backend (overrides sql.dsn)")
+	breakageInterval := flag.Duration("breakage-interval", 0, "how often to recognize breakage on expired cards, 0 disables the job (overrides features.breakage)")
+	breakageDryRun := flag.Bool("breakage-dry-run", false, "log the breakage that would be recognized without posting it (overrides features.breakage.dry_run)")
+	flag.Parse()
+	// canceled on SIGTERM or SIGINT, which stops the background jobs and drains the server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Fatal(ctx, err, "error loading config")
+	}
+	// flags only override the settings they are explicitly given for
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ledger":
+			cfg.Ledger.Backend = *backend
+		case "sql-driver":
+			cfg.SQL.Driver = *sqlDriver
+		case "sql-dsn":
+			cfg.SQL.DSN = *sqlDsn
+		case "breakage-interval":
+			cfg.Features.Breakage.Enabled = *breakageInterval > 0
+			cfg.Features.Breakage.Interval = *breakageInterval
+		case "breakage-dry-run":
+			cfg.Features.Breakage.DryRun = *breakageDryRun
+		}
+	})
+	if err = cfg.Validate(); err != nil {
+		logger.Fatal(ctx, err, "invalid config")
+	}
+	// both were validated above
+	logLevel, _ := logger.ParseLevel(cfg.Log.Level)
+	logFormat, _ := logger.ParseFormat(cfg.Log.Format)
+	logger.SetLevel(logLevel)
+	logger.SetFormat(logFormat)
 
+	var ledgerBackend ledger.Backend
+	var ledgerBreaker *ledger.CircuitBreaker
+	switch cfg.Ledger.Backend {
+	case "formance":
+		ledgerBreaker = ledger.NewCircuitBreaker(cfg.Formance.CircuitBreaker.FailureThreshold, cfg.Formance.CircuitBreaker.OpenTimeout)
+		ledgerBackend = ledger.NewResilient(
+			ledger.NewFormance(ledger.FormanceOptions{
+				ServerURL:    cfg.Formance.URL,
+				Ledger:       cfg.Ledger.Name,
+				ClientID:     cfg.Formance.ClientID,
+				ClientSecret: cfg.Formance.ClientSecret,
+				TokenURL:     cfg.Formance.TokenURL,
+				Timeout:      cfg.Timeouts.Ledger,
+			}),
+			ledger.RetryOptions{
+				MaxAttempts:     cfg.Formance.Retry.MaxAttempts,
+				InitialInterval: cfg.Formance.Retry.InitialInterval,
+				MaxInterval:     cfg.Formance.Retry.MaxInterval,
+			},
+			ledgerBreaker,
+		)
+	case "memory":
+		ledgerBackend = ledger.NewMemory()
+	case "sql":
+		sqlBackend, err := ledger.NewSQL(ctx, cfg.SQL.Driver, cfg.SQL.DSN)
+		if err != nil {
+			logger.Fatal(ctx, err, "error opening sql ledger", "driver", cfg.SQL.Driver)
+		}
+		defer sqlBackend.Close()
+		ledgerBackend = sqlBackend
+	}
+
+	ledgerBackend = ledger.Instrument(ledgerBackend)
+
+	var auth *api.Authenticator
+	if cfg.Auth.Enabled {
+		apiKeys := make([]api.APIKey, len(cfg.Auth.APIKeys))
+		for i, k := range cfg.Auth.APIKeys {
+			apiKeys[i] = api.APIKey{
+				Key: k.Key,
+				Principal: api.Principal{
+					Subject: fmt.Sprintf("api_keys[%d]", i),
+					Role:    api.Role(k.Role),
+					Account: k.Account,
+				},
+			}
+		}
+		auth = api.NewAuthenticator(cfg.Auth.JWTSecret, apiKeys)
+	} else {
+		// logged at the error level so it stands out of the startup lines, auth is only off when configured so
+		logger.Error(ctx, nil, "AUTH IS DISABLED: auth.enabled is false, every request is handled as an operator without credentials",
+			"listen_addr", cfg.ListenAddr)
+	}
+	server := api.NewServer(ledgerBackend, api.Options{
+		Auth:               auth,
+		RequestTimeout:     cfg.Timeouts.Request,
+		LongRequestTimeout: cfg.Timeouts.LongRequest,
+		LedgerBreaker:      ledgerBreaker,
+		HoldExpiry:         cfg.Features.Holds.Expiry,
+	})
+	if flag.Arg(0) == "repair" {
+		if err = repair(ctx, server, flag.Args()[1:]); err != nil {
+			logger.Fatal(ctx, err, "repair failed")
+		}
+		return
+	}
+
+	// the server listens while the ledger is unreachable, /readyz reports it until the accounts are created
+	go func() {
+		initialize(ctx, server)
+		go server.ScheduleMetrics(ctx, cfg.Metrics.Interval)
+		go server.ScheduleHoldExpiry(ctx, cfg.Features.Holds.Interval)
+		if cfg.Features.Payouts.Enabled {
+			go server.SchedulePayouts(ctx, cfg.Features.Payouts.Interval, cfg.Features.Payouts.MinAmount)
+		}
+		if cfg.Features.Breakage.Enabled {
+			server.ScheduleBreakage(ctx, cfg.Features.Breakage.Interval, cfg.Features.Breakage.DryRun)
+		}
+	}()
+	router := server.NewRouter()
+
+	if err = serve(ctx, cfg, router); err != nil {
+		logger.Fatal(ctx, err, "server stopped")
+	}
+	logger.Info(ctx, "server stopped")
+}
+
+// serve serves handler until ctx is done, then stops accepting connections and waits for the in-flight
+// requests to complete, so a deploy doesn't cut a purchase between its transaction and its metadata
+func serve(ctx context.Context, cfg config.Config, handler http.Handler) error {
+	httpServer := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if cfg.TLS.CertFile != "" {
+			logger.Info(ctx, "listening", "addr", cfg.ListenAddr, "tls", true)
+			errs <- httpServer.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			logger.Info(ctx, "listening", "addr", cfg.ListenAddr, "tls", false)
+			errs <- httpServer.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info(ctx, "shutting down, draining in-flight requests", "timeout", cfg.Timeouts.Shutdown)
+	shutdownCtx := context.Background()
+	if cfg.Timeouts.Shutdown > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, cfg.Timeouts.Shutdown)
+		defer cancel()
+	}
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error draining in-flight requests: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// repair adds their metadata back to the card and merchant accounts missing it, ex. after the process was
+// killed between a purchase and the metadata of its card
+func repair(ctx context.Context, server *api.Server, args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "log the accounts that would be repaired without repairing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	repairs, err := server.RepairAccounts(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range repairs {
+		if r.Error != "" {
+			failed++
+			logger.Error(ctx, errors.New(r.Error), "account not repaired", "address", r.Address)
+			continue
+		}
+		logger.Info(ctx, "account repaired", "dry_run", *dryRun, "address", r.Address, "txid", r.Txid, "metadata", r.Metadata)
+	}
+	logger.Info(ctx, "repair done", "dry_run", *dryRun, "repaired", len(repairs)-failed, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d accounts could not be repaired", failed)
+	}
+	return nil
+}
+
+// initialize creates the internal accounts, retrying with an exponential backoff until it succeeds
+func initialize(ctx context.Context, server *api.Server) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	_ = backoff.RetryNotify(
+		func() error {
+			return server.InitializeInternalAccounts(ctx)
+		},
+		backoff.WithContext(b, ctx),
+		func(err error, next time.Duration) {
+			logger.Error(ctx, err, "error initializing internal accounts", "retry_in", next)
+		},
+	)
 }
@@ -0,0 +1,139 @@
+// Package templates holds the Numscript program of every transaction type, so the rules moving the money
+// can be reviewed in one place. a template is named after the transaction type it posts, the templates
+// reversing a transaction type after it prefixed with revert_.
+package templates
+
+import (
+	"embed"
+	"fmt"
+	"magic-ledger/ledger"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed *.num
+var files embed.FS
+
+// Template is a Numscript program and the variables it must be given
+type Template struct {
+	Name  string             `json:"name"`
+	Plain string             `json:"plain"`
+	Vars  []ledger.ScriptVar `json:"vars"`
+}
+
+var templates = load()
+
+// load parses every embedded template, a template that doesn't parse is a programming error
+func load() map[string]Template {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		panic(err)
+	}
+	loaded := make(map[string]Template, len(entries))
+	for _, entry := range entries {
+		plain, err := files.ReadFile(entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		vars, err := ledger.ScriptVars(string(plain))
+		if err != nil {
+			panic(fmt.Sprintf("template %s: %s", entry.Name(), err.Error()))
+		}
+		name := strings.TrimSuffix(entry.Name(), ".num")
+		loaded[name] = Template{
+			Name:  name,
+			Plain: string(plain),
+			Vars:  vars,
+		}
+	}
+	return loaded
+}
+
+// Get returns the template called name, ok is false if there is none
+func Get(name string) (t Template, ok bool) {
+	t, ok = templates[name]
+	return t, ok
+}
+
+// All returns every template, sorted by name
+func All() []Template {
+	all := make([]Template, 0, len(templates))
+	for _, t := range templates {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// Script binds vars to the variables of t. every variable must be given, an account as its address and
+// a monetary as a ledger.Monetary.
+func (t Template) Script(vars map[string]interface{}) (ledger.Script, error) {
+	bound := make(map[string]interface{}, len(t.Vars))
+	for _, v := range t.Vars {
+		value, ok := vars[v.Name]
+		if !ok {
+			return ledger.Script{}, fmt.Errorf("missing variable %s of template %s", v.Name, t.Name)
+		}
+		switch v.Type {
+		case ledger.ScriptVarAccount:
+			_, ok = value.(string)
+		case ledger.ScriptVarMonetary:
+			_, ok = value.(ledger.Monetary)
+		}
+		if !ok {
+			return ledger.Script{}, fmt.Errorf("variable %s of template %s must be a %s", v.Name, t.Name, v.Type)
+		}
+		bound[v.Name] = value
+	}
+	if len(vars) != len(bound) {
+		for name := range vars {
+			if _, ok := bound[name]; !ok {
+				return ledger.Script{}, fmt.Errorf("template %s has no variable %s", t.Name, name)
+			}
+		}
+	}
+	return ledger.Script{Plain: t.Plain, Vars: bound}, nil
+}
+
+var (
+	varsBlock = regexp.MustCompile(`(?s)vars\s*\{(.*?)\}`)
+	variable  = regexp.MustCompile(`\$[A-Za-z0-9_]+`)
+)
+
+// Repeat binds every element of vars to a copy of the sends of t, all in one script, so a single transaction
+// makes the moves of t a variable number of times, ex. a payout batch. the variables of the i-th copy are
+// suffixed with _i.
+func (t Template) Repeat(vars []map[string]interface{}) (ledger.Script, error) {
+	if len(vars) == 0 {
+		return ledger.Script{}, fmt.Errorf("template %s is repeated no time", t.Name)
+	}
+	block := varsBlock.FindStringSubmatchIndex(t.Plain)
+	if block == nil {
+		return ledger.Script{}, fmt.Errorf("template %s declares no variables", t.Name)
+	}
+	declarations, sends := t.Plain[block[2]:block[3]], t.Plain[block[1]:]
+	var plain strings.Builder
+	plain.WriteString(t.Plain[:block[0]])
+	plain.WriteString("vars {")
+	repeated := Template{Name: t.Name}
+	bound := make(map[string]interface{}, len(vars)*len(t.Vars))
+	for i, v := range vars {
+		suffix := fmt.Sprintf("_%d", i)
+		plain.WriteString(variable.ReplaceAllString(declarations, "${0}"+suffix))
+		for _, declared := range t.Vars {
+			repeated.Vars = append(repeated.Vars, ledger.ScriptVar{Name: declared.Name + suffix, Type: declared.Type})
+		}
+		for name, value := range v {
+			bound[name+suffix] = value
+		}
+	}
+	plain.WriteString("}")
+	for i := range vars {
+		plain.WriteString(variable.ReplaceAllString(sends, fmt.Sprintf("${0}_%d", i)))
+	}
+	repeated.Plain = plain.String()
+	return repeated.Script(bound)
+}
@@ -0,0 +1,249 @@
+package templates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"magic-ledger/ledger"
+	"testing"
+)
+
+func usd(amount int64) ledger.Monetary {
+	return ledger.Monetary{Asset: "USD/2", Amount: amount}
+}
+
+// TestTemplates runs every template on the memory backend, which interprets it the way the formance script
+// endpoint does for this subset of Numscript
+func TestTemplates(t *testing.T) {
+	tests := []struct {
+		name string
+		// funded are the accounts given 10000 from world beforehand
+		funded []string
+		vars   map[string]interface{}
+		want   []string
+	}{
+		{
+			name:   "authorize_card",
+			funded: []string{"cards:1"},
+			vars:   map[string]interface{}{"card": "cards:1", "hold": "holds:1", "amount": usd(300)},
+			want:   []string{"cards:1 -> holds:1 300 USD/2"},
+		},
+		{
+			name:   "breakage",
+			funded: []string{"cards:1"},
+			vars:   map[string]interface{}{"card": "cards:1", "amount": usd(10000)},
+			want:   []string{"cards:1 -> revenue 10000 USD/2"},
+		},
+		{
+			name:   "capture_card",
+			funded: []string{"holds:1"},
+			vars: map[string]interface{}{
+				"hold": "holds:1", "card": "cards:1", "merchant": "merchant:1", "held": usd(300), "captured": usd(200),
+			},
+			want: []string{"holds:1 -> merchant:1 200 USD/2", "holds:1 -> cards:1 100 USD/2"},
+		},
+		{
+			name: "create_merchant",
+			vars: map[string]interface{}{"merchant": "merchant:1", "amount": usd(0)},
+			want: []string{"world -> merchant:1 0 USD/2"},
+		},
+		{
+			name: "merchant_fees",
+			vars: map[string]interface{}{"merchant": "merchant:1", "amount": usd(0)},
+			want: []string{"world -> merchant:1 0 USD/2"},
+		},
+		{
+			name:   "payout_batch",
+			funded: []string{"merchant:1"},
+			vars:   map[string]interface{}{"merchant": "merchant:1", "payout": "payouts:1", "amount": usd(500)},
+			want:   []string{"merchant:1 -> payouts:1 500 USD/2"},
+		},
+		{
+			name:   "payout_failed",
+			funded: []string{"payouts:1"},
+			vars:   map[string]interface{}{"payout": "payouts:1", "merchant": "merchant:1", "amount": usd(500)},
+			want:   []string{"payouts:1 -> merchant:1 500 USD/2"},
+		},
+		{
+			name:   "payout_merchant",
+			funded: []string{"merchant:1", "assets"},
+			vars:   map[string]interface{}{"merchant": "merchant:1", "amount": usd(500)},
+			want:   []string{"merchant:1 -> world 500 USD/2", "assets -> world 500 USD/2"},
+		},
+		{
+			name:   "payout_settled",
+			funded: []string{"payouts:1", "assets"},
+			vars:   map[string]interface{}{"payout": "payouts:1", "amount": usd(500)},
+			want:   []string{"payouts:1 -> world 500 USD/2", "assets -> world 500 USD/2"},
+		},
+		{
+			name: "promotional_credit",
+			vars: map[string]interface{}{"card": "cards:1", "amount": usd(200)},
+			want: []string{"world -> cards:1 200 USD/2", "world -> expenses 200 USD/2"},
+		},
+		{
+			name: "purchase_card",
+			vars: map[string]interface{}{
+				"card": "cards:1", "amount": usd(1000), "revenue_take": usd(100), "expenses": usd(30),
+			},
+			want: []string{
+				"world -> revenue 100 USD/2",
+				"world -> cards:1 900 USD/2",
+				"world -> expenses 30 USD/2",
+				"world -> assets 970 USD/2",
+			},
+		},
+		{
+			name:   "refund_card",
+			funded: []string{"cards:1", "assets", "revenue", "expenses"},
+			vars: map[string]interface{}{
+				"card": "cards:1", "remaining": usd(600), "assets": usd(643), "revenue": usd(66), "expenses": usd(23),
+			},
+			want: []string{
+				"cards:1 -> world 600 USD/2",
+				"assets -> world 643 USD/2",
+				"revenue -> world 66 USD/2",
+				"expenses -> world 23 USD/2",
+			},
+		},
+		{
+			name:   "revert_purchase_card",
+			funded: []string{"cards:1", "assets", "revenue", "expenses"},
+			vars: map[string]interface{}{
+				"card": "cards:1", "assets": usd(970), "expenses": usd(30), "card_amount": usd(900), "revenue": usd(100),
+			},
+			want: []string{
+				"assets -> world 970 USD/2",
+				"expenses -> world 30 USD/2",
+				"cards:1 -> world 900 USD/2",
+				"revenue -> world 100 USD/2",
+			},
+		},
+		{
+			name:   "revert_spend_card",
+			funded: []string{"merchant:1"},
+			vars:   map[string]interface{}{"merchant": "merchant:1", "card": "cards:1", "amount": usd(250)},
+			want:   []string{"merchant:1 -> cards:1 250 USD/2"},
+		},
+		{
+			name:   "spend_card",
+			funded: []string{"cards:1"},
+			vars:   map[string]interface{}{"card": "cards:1", "merchant": "merchant:1", "amount": usd(250)},
+			want:   []string{"cards:1 -> merchant:1 250 USD/2"},
+		},
+		{
+			name:   "void_card",
+			funded: []string{"holds:1"},
+			vars:   map[string]interface{}{"hold": "holds:1", "card": "cards:1", "held": usd(300)},
+			want:   []string{"holds:1 -> cards:1 300 USD/2"},
+		},
+	}
+	tested := make(map[string]bool, len(tests))
+	for _, tt := range tests {
+		tested[tt.name] = true
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			template, ok := Get(tt.name)
+			if !ok {
+				t.Fatalf("no template %s", tt.name)
+			}
+			backend := ledger.NewMemory()
+			for _, address := range tt.funded {
+				funding := []ledger.TransactionPosting{{Src: "world", Dest: address, Asset: "USD/2", Amount: 10000}}
+				if _, err := backend.CreateTransactionWithPostings(ctx, nil, funding, ""); err != nil {
+					t.Fatalf("funding %s: %v", address, err)
+				}
+			}
+
+			script, err := template.Script(tt.vars)
+			if err != nil {
+				t.Fatalf("Script: %v", err)
+			}
+			txn, err := backend.CreateTransactionFromScript(ctx, script, nil, "")
+			if err != nil {
+				t.Fatalf("CreateTransactionFromScript: %v", err)
+			}
+			if len(txn.Postings) != len(tt.want) {
+				t.Fatalf("postings: got %v, want %v", txn.Postings, tt.want)
+			}
+			for i, p := range txn.Postings {
+				if got := fmt.Sprintf("%s -> %s %s %s", p.Source, p.Destination, p.Amount, p.Asset); got != tt.want[i] {
+					t.Errorf("posting %d: got %s, want %s", i, got, tt.want[i])
+				}
+			}
+
+			// the source accounts other than world must hold what they send
+			if len(tt.funded) > 0 {
+				if _, err = ledger.NewMemory().CreateTransactionFromScript(ctx, script, nil, ""); !errors.Is(err, ledger.ErrInsufficientFunds) {
+					t.Errorf("unfunded: got %v, want %v", err, ledger.ErrInsufficientFunds)
+				}
+			}
+		})
+	}
+	for _, template := range All() {
+		if !tested[template.Name] {
+			t.Errorf("template %s is not tested", template.Name)
+		}
+	}
+}
+
+func TestTemplateScriptVars(t *testing.T) {
+	template, _ := Get("spend_card")
+	tests := []struct {
+		name string
+		vars map[string]interface{}
+	}{
+		{"missing variable", map[string]interface{}{"card": "cards:1", "amount": usd(1)}},
+		{"account given a monetary", map[string]interface{}{"card": usd(1), "merchant": "merchant:1", "amount": usd(1)}},
+		{"monetary given an address", map[string]interface{}{"card": "cards:1", "merchant": "merchant:1", "amount": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := template.Script(tt.vars); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestTemplateRepeat(t *testing.T) {
+	ctx := context.Background()
+	template, _ := Get("payout_batch")
+	script, err := template.Repeat([]map[string]interface{}{
+		{"merchant": "merchant:1", "payout": "payouts:1", "amount": usd(500)},
+		{"merchant": "merchant:2", "payout": "payouts:2", "amount": usd(300)},
+	})
+	if err != nil {
+		t.Fatalf("Repeat: %v", err)
+	}
+	backend := ledger.NewMemory()
+	for _, address := range []string{"merchant:1", "merchant:2"} {
+		funding := []ledger.TransactionPosting{{Src: "world", Dest: address, Asset: "USD/2", Amount: 1000}}
+		if _, err := backend.CreateTransactionWithPostings(ctx, nil, funding, ""); err != nil {
+			t.Fatalf("funding %s: %v", address, err)
+		}
+	}
+	txn, err := backend.CreateTransactionFromScript(ctx, script, nil, "")
+	if err != nil {
+		t.Fatalf("CreateTransactionFromScript: %v", err)
+	}
+	want := []string{"merchant:1 -> payouts:1 500 USD/2", "merchant:2 -> payouts:2 300 USD/2"}
+	if len(txn.Postings) != len(want) {
+		t.Fatalf("postings: got %v, want %v", txn.Postings, want)
+	}
+	for i, p := range txn.Postings {
+		if got := fmt.Sprintf("%s -> %s %s %s", p.Source, p.Destination, p.Amount, p.Asset); got != want[i] {
+			t.Errorf("posting %d: got %s, want %s", i, got, want[i])
+		}
+	}
+
+	for name, vars := range map[string][]map[string]interface{}{
+		"no copy":          nil,
+		"missing variable": {{"merchant": "merchant:1", "payout": "payouts:1", "amount": usd(500)}, {"merchant": "merchant:2", "amount": usd(300)}},
+		"unknown variable": {{"merchant": "merchant:1", "payout": "payouts:1", "amount": usd(500), "other": "cards:1"}},
+	} {
+		if _, err := template.Repeat(vars); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}